@@ -0,0 +1,415 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrAccountExists indica que el nombre ya está registrado
+	ErrAccountExists = errors.New("el nombre de usuario ya está registrado")
+
+	// ErrInvalidCredentials indica usuario o contraseña incorrectos
+	ErrInvalidCredentials = errors.New("usuario o contraseña incorrectos")
+
+	// ErrLoginRequired indica que el nombre pertenece a una cuenta y falta el token
+	ErrLoginRequired = errors.New("este nombre está registrado: inicia sesión para usarlo")
+
+	// ErrGuestsDisabled indica que solo se permiten usuarios registrados
+	ErrGuestsDisabled = errors.New("se requiere iniciar sesión")
+)
+
+const (
+	// Longitud de contraseña permitida (bcrypt ignora lo que pase de 72 bytes)
+	minPasswordLength = 8
+	maxPasswordLength = 72
+
+	// Coste de bcrypt para los hashes de contraseña
+	passwordHashCost = 12
+
+	// Intentos de registro y login permitidos por IP y minuto
+	defaultAuthAttempts = 10
+)
+
+// Account es una cuenta registrada con contraseña
+type Account struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Role         string    `json:"role"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// AccountStore guarda las cuentas en un archivo JSON local
+type AccountStore struct {
+	accounts map[string]*Account
+	path     string
+	cost     int
+	mu       sync.RWMutex
+}
+
+// NewAccountStore crea el almacén y carga las cuentas existentes
+func NewAccountStore(path string) (*AccountStore, error) {
+	s := &AccountStore{
+		accounts: make(map[string]*Account),
+		path:     path,
+		cost:     passwordHashCost,
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Register crea una cuenta con la contraseña hasheada con bcrypt
+func (s *AccountStore) Register(username, password string) (*Account, error) {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return nil, errors.New("la contraseña debe tener entre 8 y 72 caracteres")
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), s.cost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.accounts[username]; exists {
+		return nil, ErrAccountExists
+	}
+
+	account := &Account{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         RoleUser,
+		CreatedAt:    time.Now(),
+	}
+	s.accounts[username] = account
+
+	if err := s.saveLocked(); err != nil {
+		delete(s.accounts, username)
+		return nil, err
+	}
+
+	slog.Info("cuenta registrada", "user", username)
+	return account, nil
+}
+
+// Authenticate verifica la contraseña de una cuenta
+func (s *AccountStore) Authenticate(username, password string) (*Account, error) {
+	s.mu.RLock()
+	account, exists := s.accounts[username]
+	s.mu.RUnlock()
+
+	if !exists {
+		// Comparar igualmente para no revelar por tiempo qué cuentas existen
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return nil, ErrInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return account, nil
+}
+
+// dummyPasswordHash se usa al autenticar cuentas inexistentes
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("cuenta-inexistente"), bcrypt.MinCost)
+
+// Exists indica si el nombre pertenece a una cuenta registrada
+func (s *AccountStore) Exists(username string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.accounts[username]
+	return exists
+}
+
+// Role devuelve el rol actual de una cuenta ("" si no existe)
+func (s *AccountStore) Role(username string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if account, exists := s.accounts[username]; exists {
+		return account.Role
+	}
+	return ""
+}
+
+// SetRole cambia el rol de una cuenta
+func (s *AccountStore) SetRole(username, role string) error {
+	switch role {
+	case RoleUser, RoleModerator, RoleAdmin:
+	default:
+		return errors.New("rol inválido: " + role)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, exists := s.accounts[username]
+	if !exists {
+		return errors.New("cuenta no encontrada")
+	}
+
+	account.Role = role
+	return s.saveLocked()
+}
+
+// List devuelve las cuentas sin el hash de la contraseña
+func (s *AccountStore) List() []Account {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]Account, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accountCopy := *account
+		accountCopy.PasswordHash = ""
+		list = append(list, accountCopy)
+	}
+	return list
+}
+
+// load lee las cuentas persistidas
+func (s *AccountStore) load() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var accounts []*Account
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return err
+	}
+
+	for _, account := range accounts {
+		s.accounts[account.Username] = account
+	}
+	slog.Info("cuentas cargadas", "count", len(accounts))
+	return nil
+}
+
+// saveLocked persiste las cuentas de forma atómica. Requiere s.mu tomado.
+func (s *AccountStore) saveLocked() error {
+	if s.path == "" {
+		return nil
+	}
+
+	accounts := make([]*Account, 0, len(s.accounts))
+	for _, account := range s.accounts {
+		accounts = append(accounts, account)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// AuthService resuelve la identidad de cada conexión a partir de cuentas y tokens de sesión
+type AuthService struct {
+	accounts    *AccountStore
+	signer      *TokenSigner
+	allowGuests bool
+	guestPrefix string
+
+	// Intentos de registro y login por IP (nil sin límite)
+	limiter *IPLimiter
+}
+
+// NewAuthService crea el servicio de autenticación
+func NewAuthService(accounts *AccountStore, signer *TokenSigner, allowGuests bool, guestPrefix string) *AuthService {
+	return &AuthService{
+		accounts:    accounts,
+		signer:      signer,
+		allowGuests: allowGuests,
+		guestPrefix: guestPrefix,
+		limiter:     NewIPLimiter(defaultAuthAttempts, time.Minute),
+	}
+}
+
+// ResolveIdentity decide el nombre y el rol de una conexión a /ws.
+// Con token se usa la identidad firmada; sin token solo se admiten invitados,
+// que reciben el prefijo de invitado y nunca pueden usar un nombre registrado.
+func (a *AuthService) ResolveIdentity(requested, token string) (string, string, error) {
+	if token != "" {
+		claims, err := a.signer.Verify(token)
+		if err != nil {
+			return "", "", err
+		}
+
+		// El rol vigente es el de la cuenta (puede haber cambiado tras emitir el token)
+		role := a.accounts.Role(claims.Subject)
+		if role == "" {
+			return "", "", ErrInvalidToken
+		}
+		return claims.Subject, role, nil
+	}
+
+	if a.accounts.Exists(requested) {
+		return "", "", ErrLoginRequired
+	}
+
+	if !a.allowGuests {
+		return "", "", ErrGuestsDisabled
+	}
+
+	username := requested
+	if !strings.HasPrefix(username, a.guestPrefix) {
+		username = a.guestPrefix + username
+	}
+	return username, RoleGuest, nil
+}
+
+// credentialsRequest es el cuerpo de /api/register y /api/login
+type credentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// decodeCredentials lee y valida el cuerpo de una petición de credenciales. Cada
+// petición cuenta como un intento para el límite por IP.
+func (a *AuthService) decodeCredentials(w http.ResponseWriter, r *http.Request) (*credentialsRequest, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+
+	if a.limiter != nil && !a.limiter.Allow(clientIP(r)) {
+		requestLogger(r).Warn("demasiados intentos de autenticación", "path", r.URL.Path, "ip", clientIP(r))
+		w.Header().Set("Retry-After", strconv.Itoa(int(a.limiter.window.Seconds())))
+		http.Error(w, "Demasiados intentos, espera un momento", http.StatusTooManyRequests)
+		return nil, false
+	}
+
+	var req credentialsRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return nil, false
+	}
+
+	req.Username = strings.TrimSpace(req.Username)
+	return &req, true
+}
+
+// writeSession responde con un token de sesión recién emitido
+func (a *AuthService) writeSession(w http.ResponseWriter, status int, account *Account) {
+	token, err := a.signer.Sign(account.Username, account.Role)
+	if err != nil {
+		http.Error(w, "Error emitiendo sesión", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"token":     token,
+		"username":  account.Username,
+		"role":      account.Role,
+		"expiresIn": int(a.signer.ttl.Seconds()),
+	})
+}
+
+// serveRegister registra una cuenta nueva: POST /api/register
+func (a *AuthService) serveRegister(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	if !validateUsername(req.Username) {
+		http.Error(w, "Nombre de usuario inválido", http.StatusBadRequest)
+		return
+	}
+
+	if a.guestPrefix != "" && strings.HasPrefix(req.Username, a.guestPrefix) {
+		http.Error(w, "El prefijo '"+a.guestPrefix+"' está reservado para invitados", http.StatusBadRequest)
+		return
+	}
+
+	account, err := a.accounts.Register(req.Username, req.Password)
+	if errors.Is(err, ErrAccountExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.writeSession(w, http.StatusCreated, account)
+}
+
+// serveLogin inicia sesión: POST /api/login
+func (a *AuthService) serveLogin(w http.ResponseWriter, r *http.Request) {
+	req, ok := a.decodeCredentials(w, r)
+	if !ok {
+		return
+	}
+
+	account, err := a.accounts.Authenticate(req.Username, req.Password)
+	if err != nil {
+		requestLogger(r).Warn("login fallido", "user", req.Username, "ip", clientIP(r), "error", err)
+		http.Error(w, ErrInvalidCredentials.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	requestLogger(r).Info("login correcto", "user", account.Username, "ip", clientIP(r))
+	a.writeSession(w, http.StatusOK, account)
+}
+
+// serveAccountsAdmin lista cuentas (GET) o cambia el rol de una (POST {username, role})
+func serveAccountsAdmin(accounts *AccountStore, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"accounts": accounts.List()})
+
+	case "POST":
+		var req struct {
+			Username string `json:"username"`
+			Role     string `json:"role"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+
+		if err := accounts.SetRole(req.Username, req.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		requestLogger(r).Info("rol de cuenta cambiado", "user", req.Username, "role", req.Role)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tipos de evento de confirmación de los mensajes enviados con clientMsgId
+const (
+	EventTypeAck  = "ack"
+	EventTypeNack = "nack"
+)
+
+// Límites de los clientMsgId: longitud máxima, cuántos se recuerdan por sesión y
+// cuánto se conservan los de una cuenta después de desconectarse
+const (
+	maxClientMsgIDLength   = 64
+	maxRememberedClientIDs = 256
+	clientMsgIDRetention   = 10 * time.Minute
+)
+
+// AckEvent confirma al autor que su mensaje se aceptó y se guardó en el historial
+type AckEvent struct {
+	Type        string `json:"type"` // Siempre "ack"
+	ClientMsgID string `json:"clientMsgId"`
+	MessageID   string `json:"messageId,omitempty"` // Vacío si lo atendió un bot (comandos)
+	Duplicate   bool   `json:"duplicate,omitempty"` // Reintento de un mensaje ya aceptado
+}
+
+// EventType implementa Event
+func (e *AckEvent) EventType() string { return EventTypeAck }
+
+// NackEvent avisa al autor de que su mensaje no se aceptó. Con HUB_BUSY puede
+// reintentarlo con el mismo clientMsgId.
+type NackEvent struct {
+	Type        string `json:"type"` // Siempre "nack"
+	ClientMsgID string `json:"clientMsgId"`
+	Code        string `json:"code"`
+	Reason      string `json:"reason"`
+}
+
+// EventType implementa Event
+func (e *NackEvent) EventType() string { return EventTypeNack }
+
+// pendingAck es la conexión que espera la confirmación de un mensaje
+type pendingAck struct {
+	client      *Client
+	clientMsgID string
+}
+
+// clientMsgIDs recuerda los últimos clientMsgId aceptados de cada sesión y el ID del
+// mensaje que generaron, para que un reintento no duplique el mensaje. La sesión de
+// una cuenta es su nombre y sobrevive a la reconexión durante clientMsgIDRetention;
+// la de un invitado o un nombre sin cuenta es su conexión, porque otro puede usar
+// el mismo nombre después.
+type clientMsgIDs struct {
+	sessions map[string]*recentClientIDs
+	next     uint64 // Contador de sesiones por conexión
+	now      func() time.Time
+	mu       sync.Mutex
+}
+
+// recentClientIDs son los clientMsgId de una sesión en orden de llegada
+type recentClientIDs struct {
+	messageIDs map[string]string
+	order      []string
+	expires    time.Time // Cero mientras la sesión sigue conectada
+}
+
+// newClientMsgIDs crea el registro vacío
+func newClientMsgIDs() *clientMsgIDs {
+	return &clientMsgIDs{sessions: make(map[string]*recentClientIDs), now: time.Now}
+}
+
+// NewSession devuelve la sesión de una conexión: el nombre si es una cuenta
+// autenticada (persistent) o una sesión nueva que solo dura lo que la conexión
+func (s *clientMsgIDs) NewSession(username string, persistent bool) string {
+	if persistent {
+		return username
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	return username + "#" + strconv.FormatUint(s.next, 10)
+}
+
+// recent devuelve los clientMsgId de la sesión, descartándolos si caducaron
+func (s *clientMsgIDs) recent(session string) *recentClientIDs {
+	recent, exists := s.sessions[session]
+	if exists && !recent.expires.IsZero() && !s.now().Before(recent.expires) {
+		delete(s.sessions, session)
+		return nil
+	}
+	return recent
+}
+
+// Lookup devuelve el ID del mensaje generado por un clientMsgId ya aceptado
+func (s *clientMsgIDs) Lookup(session, clientMsgID string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recent := s.recent(session)
+	if recent == nil {
+		return "", false
+	}
+	messageID, seen := recent.messageIDs[clientMsgID]
+	return messageID, seen
+}
+
+// Remember anota un clientMsgId aceptado, olvidando el más antiguo si hay demasiados
+func (s *clientMsgIDs) Remember(session, clientMsgID, messageID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recent := s.recent(session)
+	if recent == nil {
+		recent = &recentClientIDs{messageIDs: make(map[string]string)}
+		s.sessions[session] = recent
+	}
+	recent.expires = time.Time{}
+	if _, seen := recent.messageIDs[clientMsgID]; !seen {
+		recent.order = append(recent.order, clientMsgID)
+	}
+	recent.messageIDs[clientMsgID] = messageID
+
+	if len(recent.order) > maxRememberedClientIDs {
+		delete(recent.messageIDs, recent.order[0])
+		recent.order = recent.order[1:]
+	}
+}
+
+// Forget olvida un clientMsgId cuyo mensaje no llegó al hub, para poder reintentarlo
+func (s *clientMsgIDs) Forget(session, clientMsgID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	recent := s.recent(session)
+	if recent == nil {
+		return
+	}
+	delete(recent.messageIDs, clientMsgID)
+	for i, id := range recent.order {
+		if id == clientMsgID {
+			recent.order = append(recent.order[:i], recent.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Close termina la conexión de una sesión: la de una cuenta se conserva durante
+// clientMsgIDRetention para los reintentos tras reconectar y la de una conexión se
+// olvida. De paso descarta las sesiones caducadas.
+func (s *clientMsgIDs) Close(session string, persistent bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for key, recent := range s.sessions {
+		if !recent.expires.IsZero() && !now.Before(recent.expires) {
+			delete(s.sessions, key)
+		}
+	}
+
+	recent, exists := s.sessions[session]
+	switch {
+	case !exists:
+	case persistent:
+		recent.expires = now.Add(clientMsgIDRetention)
+	default:
+		delete(s.sessions, session)
+	}
+}
+
+// sendAck confirma un mensaje al autor desde el loop del hub
+func (h *Hub) sendAck(ack *pendingAck, messageID string) {
+	h.sendToClient(ack.client, newWireEvent(&AckEvent{
+		Type:        EventTypeAck,
+		ClientMsgID: ack.clientMsgID,
+		MessageID:   messageID,
+	}))
+}
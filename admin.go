@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// adminAuth protege los endpoints de administración con un token estático (ADMIN_TOKEN)
+type adminAuth struct {
+	token string
+}
+
+// requireAdmin envuelve un handler exigiendo "Authorization: Bearer <token>"
+func (a *adminAuth) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			http.Error(w, "API de administración deshabilitada (ADMIN_TOKEN no configurado)", http.StatusNotFound)
+			return
+		}
+
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(a.token)) != 1 {
+			requestLogger(r).Warn("acceso de administración rechazado", "ip", clientIP(r), "path", r.URL.Path)
+			http.Error(w, "No autorizado", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// writeJSON serializa una respuesta JSON con el código de estado indicado
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Debug("error escribiendo respuesta JSON", "error", err)
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrAttachmentNotFound indica que el adjunto no existe en el almacenamiento
+var ErrAttachmentNotFound = errors.New("adjunto no encontrado")
+
+// attachmentURLPrefix es la ruta HTTP desde la que se sirven los adjuntos
+const attachmentURLPrefix = "/attachments/"
+
+// AttachmentStore define un backend de almacenamiento direccionado por contenido.
+// Las claves son siempre el hash SHA-256 (hex) del contenido.
+type AttachmentStore interface {
+	Put(key string, data []byte, contentType string) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// StorePinger lo implementan los backends que pueden comprobar su disponibilidad (/readyz)
+type StorePinger interface {
+	Ping() error
+}
+
+// SharedStore lo implementan los backends que varias instancias comparten (S3).
+// Cada nodo solo conoce sus propias referencias, así que el gestor no borra objetos
+// de estos backends: su limpieza queda para las reglas de ciclo de vida del bucket.
+type SharedStore interface {
+	Shared() bool
+}
+
+// attachmentEntry guarda los metadatos y el conteo de referencias de un adjunto
+type attachmentEntry struct {
+	refs        int
+	contentType string
+	size        int64
+}
+
+// Borrados pendientes antes de empezar a lanzarlos en goroutines sueltas
+const attachmentDeleteQueueSize = 256
+
+// AttachmentManager deduplica adjuntos y lleva el conteo de referencias
+// ligado a la retención de mensajes en el historial. mu solo protege el conteo:
+// las escrituras y borrados en el backend (llamadas de red con S3) van fuera de él,
+// y los borrados los hace una goroutine para no bloquear el loop del hub.
+type AttachmentManager struct {
+	store   AttachmentStore
+	entries map[string]*attachmentEntry
+	mu      sync.Mutex
+
+	// Serializan Put y Delete de un mismo hash (repartidos por su primer dígito)
+	keyLocks [16]sync.Mutex
+
+	deletes chan string
+	pending atomic.Int64 // Borrados encolados sin terminar
+
+	// El backend es compartido: se lleva el conteo pero nunca se borra
+	keepObjects bool
+}
+
+// NewAttachmentManager crea un gestor de adjuntos sobre el backend indicado
+func NewAttachmentManager(store AttachmentStore) *AttachmentManager {
+	m := &AttachmentManager{
+		store:   store,
+		entries: make(map[string]*attachmentEntry),
+		deletes: make(chan string, attachmentDeleteQueueSize),
+	}
+	if shared, ok := store.(SharedStore); ok && shared.Shared() {
+		m.keepObjects = true
+	}
+	go m.deleteLoop()
+	return m
+}
+
+// keyLock devuelve el candado de E/S de un hash
+func (m *AttachmentManager) keyLock(hash string) *sync.Mutex {
+	index, _ := strconv.ParseUint(hash[:1], 16, 8)
+	return &m.keyLocks[index]
+}
+
+// retainExisting suma una referencia si el adjunto ya está registrado
+func (m *AttachmentManager) retainExisting(hash string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, exists := m.entries[hash]; exists {
+		entry.refs++
+		return true
+	}
+	return false
+}
+
+// Store guarda el contenido (solo si es nuevo) y devuelve su hash.
+// Cada llamada suma una referencia que debe liberarse con Release.
+func (m *AttachmentManager) Store(data []byte, contentType string) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	if m.retainExisting(hash) {
+		return hash, nil
+	}
+
+	// Con el candado del hash ningún borrado pendiente puede llevarse lo que se escribe
+	lock := m.keyLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if m.retainExisting(hash) {
+		return hash, nil
+	}
+	if err := m.store.Put(hash, data, contentType); err != nil {
+		return "", err
+	}
+
+	m.mu.Lock()
+	m.entries[hash] = &attachmentEntry{
+		refs:        1,
+		contentType: contentType,
+		size:        int64(len(data)),
+	}
+	m.mu.Unlock()
+	return hash, nil
+}
+
+// Release libera una referencia y, cuando ya nadie usa el adjunto, encarga su
+// borrado a la goroutine de borrados (no bloquea)
+func (m *AttachmentManager) Release(hash string) {
+	m.mu.Lock()
+	entry, exists := m.entries[hash]
+	if !exists {
+		m.mu.Unlock()
+		return
+	}
+
+	entry.refs--
+	if entry.refs > 0 {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.entries, hash)
+	m.mu.Unlock()
+
+	if m.keepObjects {
+		return
+	}
+	m.pending.Add(1)
+	select {
+	case m.deletes <- hash:
+	default:
+		go m.deleteUnused(hash)
+	}
+}
+
+// deleteLoop borra los adjuntos liberados
+func (m *AttachmentManager) deleteLoop() {
+	for hash := range m.deletes {
+		m.deleteUnused(hash)
+	}
+}
+
+// deleteUnused borra el adjunto del backend salvo que alguien lo haya vuelto a
+// guardar o retener desde que se liberó
+func (m *AttachmentManager) deleteUnused(hash string) {
+	defer m.pending.Add(-1)
+
+	lock := m.keyLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	m.mu.Lock()
+	_, inUse := m.entries[hash]
+	m.mu.Unlock()
+	if inUse {
+		return
+	}
+
+	if err := m.store.Delete(hash); err != nil {
+		slog.Error("error eliminando adjunto", "hash", hash, "error", err)
+		return
+	}
+	slog.Debug("adjunto eliminado (sin referencias)", "hash", hash)
+}
+
+// Flush espera a que terminen los borrados pendientes o a que venza ctx
+func (m *AttachmentManager) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for m.pending.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d borrados de adjuntos pendientes: %w", m.pending.Load(), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Retain suma una referencia a un adjunto que ya está en el almacén
+// (p. ej. al restaurar el historial tras un reinicio)
+func (m *AttachmentManager) Retain(hash, contentType string, size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, exists := m.entries[hash]; exists {
+		entry.refs++
+		return
+	}
+	m.entries[hash] = &attachmentEntry{refs: 1, contentType: contentType, size: size}
+}
+
+// RefCount devuelve el número de referencias activas de un adjunto
+func (m *AttachmentManager) RefCount(hash string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry, exists := m.entries[hash]; exists {
+		return entry.refs
+	}
+	return 0
+}
+
+// Open devuelve el contenido y el tipo MIME de un adjunto
+func (m *AttachmentManager) Open(hash string) ([]byte, string, error) {
+	data, err := m.store.Get(hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	m.mu.Lock()
+	contentType := ""
+	if entry, exists := m.entries[hash]; exists {
+		contentType = entry.contentType
+	}
+	m.mu.Unlock()
+
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return data, contentType, nil
+}
+
+// StoreImage reemplaza el data URL de la imagen por una referencia al adjunto deduplicado
+func (m *AttachmentManager) StoreImage(image *ImageData) error {
+	data, err := decodeDataURL(image.Data)
+	if err != nil {
+		return err
+	}
+
+	hash, err := m.Store(data, image.Type)
+	if err != nil {
+		return err
+	}
+
+	image.Hash = hash
+	image.Data = attachmentURLPrefix + hash
+	image.Size = int64(len(data))
+	return nil
+}
+
+// decodeDataURL extrae los bytes de un data URL en base64
+func decodeDataURL(dataURL string) ([]byte, error) {
+	if !strings.HasPrefix(dataURL, "data:") {
+		return nil, errors.New("data URL inválido")
+	}
+
+	header, payload, found := strings.Cut(dataURL, ",")
+	if !found || !strings.HasSuffix(header, ";base64") {
+		return nil, errors.New("data URL sin codificación base64")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, fmt.Errorf("base64 inválido: %w", err)
+	}
+	return data, nil
+}
+
+// isValidAttachmentHash verifica que la clave tenga formato de SHA-256 en hex
+func isValidAttachmentHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// rasterImageTypes son los tipos que el navegador muestra como imagen sin ejecutar
+// nada. El resto (SVG, HTML, tipos desconocidos) puede llevar scripts.
+var rasterImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/jpg":  true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+	"image/bmp":  true,
+}
+
+// serveAttachment sirve un adjunto almacenado por su hash
+func serveAttachment(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if hub.attachments == nil {
+		http.Error(w, "Almacenamiento de adjuntos deshabilitado", http.StatusNotFound)
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, attachmentURLPrefix)
+	if !isValidAttachmentHash(hash) {
+		http.Error(w, "Adjunto no encontrado", http.StatusNotFound)
+		return
+	}
+
+	data, contentType, err := hub.attachments.Open(hash)
+	if err != nil {
+		if errors.Is(err, ErrAttachmentNotFound) {
+			http.Error(w, "Adjunto no encontrado", http.StatusNotFound)
+			return
+		}
+		requestLogger(r).Error("error leyendo adjunto", "hash", hash, "error", err)
+		http.Error(w, "Error leyendo adjunto", http.StatusInternalServerError)
+		return
+	}
+
+	// El contenido nunca cambia para un mismo hash
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	// ⭐ SEGURIDAD: el tipo lo declaró el cliente. Lo que no sea una imagen rasterizada
+	// (p. ej. un SVG con <script>) se descarga y, si se abre, sin ejecutar scripts
+	// en el origen del chat.
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	if !rasterImageTypes[strings.ToLower(strings.TrimSpace(mediaType))] {
+		w.Header().Set("Content-Disposition", "attachment")
+		w.Header().Set("Content-Security-Policy", "sandbox")
+	}
+	if _, err := w.Write(data); err != nil {
+		requestLogger(r).Debug("error enviando adjunto", "hash", hash, "error", err)
+	}
+}
+
+// DiskStore guarda adjuntos en el disco local, repartidos en subdirectorios por prefijo
+type DiskStore struct {
+	dir string
+}
+
+// NewDiskStore crea un backend en disco en el directorio indicado
+func NewDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &DiskStore{dir: dir}, nil
+}
+
+// Ping comprueba que el directorio existe y admite escrituras
+func (s *DiskStore) Ping() error {
+	tmp, err := os.CreateTemp(s.dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// path devuelve la ruta del archivo para una clave
+func (s *DiskStore) path(key string) string {
+	return filepath.Join(s.dir, key[:2], key)
+}
+
+// Put escribe el adjunto de forma atómica (archivo temporal + rename)
+func (s *DiskStore) Put(key string, data []byte, contentType string) error {
+	target := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(target), key+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// Get lee el adjunto del disco
+func (s *DiskStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrAttachmentNotFound
+	}
+	return data, err
+}
+
+// Delete elimina el adjunto del disco
+func (s *DiskStore) Delete(key string) error {
+	err := os.Remove(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
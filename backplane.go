@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Tipos de evento que los nodos intercambian por el backplane
+const (
+	BackplaneBroadcast  = "broadcast"  // Mensaje para todos los clientes del clúster
+	BackplanePresence   = "presence"   // Usuarios conectados a un nodo
+	BackplaneModeration = "moderation" // Aviso para los moderadores de todos los nodos
+	BackplaneDirect     = "direct"     // Mensaje para un usuario conectado a otro nodo
+)
+
+// Cada cuánto publica un nodo su presencia y renueva sus nombres de usuario.
+// Un nodo que no publica durante tres intervalos se da por caído.
+const presenceInterval = 10 * time.Second
+
+// BackplaneEvent es un evento publicado por un nodo para el resto del clúster
+type BackplaneEvent struct {
+	Node    string          `json:"node"`
+	Kind    string          `json:"kind"`
+	To      string          `json:"to,omitempty"`      // Destinatario de los mensajes directos
+	Users   []PresenceUser  `json:"users,omitempty"`   // Usuarios del nodo (presencia)
+	Leaving bool            `json:"leaving,omitempty"` // El nodo se apaga
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// PresenceUser es un usuario conectado a un nodo
+type PresenceUser struct {
+	Username    string    `json:"username"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	Bot         bool      `json:"bot,omitempty"`
+	Commands    []string  `json:"commands,omitempty"` // Comandos que atiende el bot
+}
+
+// Backplane conecta varias instancias del chat: lo que se publica en un nodo llega
+// a los demás, y los nombres de usuario se reservan en todo el clúster
+type Backplane interface {
+	// NodeID identifica a este nodo dentro del clúster
+	NodeID() string
+
+	// Publish envía un evento a los demás nodos (no debe bloquear)
+	Publish(event *BackplaneEvent) error
+
+	// Subscribe registra la función que recibe los eventos de los demás nodos
+	Subscribe(handler func(*BackplaneEvent)) error
+
+	// ClaimUsername reserva el nombre para este nodo. Devuelve false si otro nodo lo usa.
+	ClaimUsername(username string) (bool, error)
+
+	// ReleaseUsername libera un nombre reservado por este nodo
+	ReleaseUsername(username string) error
+
+	// RefreshUsernames renueva las reservas de los usuarios conectados al nodo
+	RefreshUsernames(usernames []string) error
+
+	Close() error
+}
+
+// remotePresence son los usuarios de otro nodo según su última publicación
+type remotePresence struct {
+	users []PresenceUser
+	seen  time.Time
+}
+
+// SetBackplane conecta el hub al clúster. Debe llamarse antes de Run.
+func (h *Hub) SetBackplane(backplane Backplane) error {
+	h.backplane = backplane
+	h.remoteNodes = make(map[string]*remotePresence)
+	h.claims = make(map[string]int)
+	return backplane.Subscribe(h.receiveRemote)
+}
+
+// receiveRemote encola un evento de otro nodo para el loop del hub (no bloquea)
+func (h *Hub) receiveRemote(event *BackplaneEvent) {
+	select {
+	case h.remote <- event:
+	default:
+		h.metrics.MessagesDropped.Inc("backplane_busy")
+		slog.Warn("hub ocupado, evento del backplane descartado", "kind", event.Kind, "node", event.Node)
+	}
+}
+
+// publish envía un evento al resto del clúster (no hace nada sin backplane)
+func (h *Hub) publish(event *BackplaneEvent) {
+	if h.backplane == nil {
+		return
+	}
+	if err := h.backplane.Publish(event); err != nil {
+		slog.Warn("error publicando en el backplane", "kind", event.Kind, "error", err)
+	}
+}
+
+// publishEvent publica un evento del chat para los demás nodos. Entre nodos los
+// eventos viajan siempre en JSON.
+func (h *Hub) publishEvent(kind, to string, event *wireEvent) {
+	if h.backplane == nil {
+		return
+	}
+	payload, err := event.encode(EncodingJSON)
+	if err != nil {
+		return
+	}
+	h.publish(&BackplaneEvent{Kind: kind, To: to, Payload: payload})
+}
+
+// handleRemote aplica un evento de otro nodo. Se ejecuta en el loop del hub.
+func (h *Hub) handleRemote(event *BackplaneEvent) {
+	h.metrics.BackplaneEvents.Inc(event.Kind)
+
+	// Los eventos del chat se decodifican una vez; su JSON se reenvía tal cual
+	var wire *wireEvent
+	if len(event.Payload) > 0 {
+		decoded, err := decodeEvent(event.Payload)
+		if err != nil {
+			slog.Warn("evento del backplane inválido", "kind", event.Kind, "node", event.Node, "error", err)
+			return
+		}
+		wire = newWireEventFromJSON(decoded, event.Payload)
+	}
+
+	switch event.Kind {
+	case BackplaneBroadcast:
+		// El mensaje entra en el historial de este nodo, que lo liberará al salir
+		// de él: necesita su propia referencia al adjunto
+		if msg, ok := wire.event.(*Message); ok && msg.Type == MessageTypeMessage {
+			h.retainAttachment(msg)
+		}
+
+		// Los webhooks ya los emitió el nodo de origen
+		h.deliverBroadcast(wire, false)
+
+	case BackplanePresence:
+		h.mu.Lock()
+		previous, known := h.remoteNodes[event.Node]
+		changed := !known || !samePresence(previous.users, event.Users)
+		if event.Leaving {
+			delete(h.remoteNodes, event.Node)
+			changed = known
+		} else {
+			h.remoteNodes[event.Node] = &remotePresence{users: event.Users, seen: time.Now()}
+		}
+		h.mu.Unlock()
+
+		// Los heartbeats sin cambios no generan una lista nueva
+		if changed {
+			h.broadcastUserList()
+		}
+
+	case BackplaneModeration:
+		h.deliverToModerators(wire)
+
+	case BackplaneDirect:
+		h.deliverDirect(&directMessage{to: event.To, event: wire})
+
+	default:
+		slog.Warn("evento del backplane desconocido", "kind", event.Kind, "node", event.Node)
+	}
+}
+
+// publishPresence publica los usuarios conectados a este nodo
+func (h *Hub) publishPresence() {
+	h.mu.RLock()
+	users := make([]PresenceUser, 0, len(h.clients))
+	for client := range h.clients {
+		user := PresenceUser{Username: client.username, Bot: client.bot != nil}
+		if status, exists := h.userHistory[client.username]; exists {
+			user.ConnectedAt = status.ConnectedAt
+		}
+		if client.bot != nil {
+			user.Commands = client.bot.Commands
+		}
+		users = append(users, user)
+	}
+	h.mu.RUnlock()
+
+	h.publish(&BackplaneEvent{Kind: BackplanePresence, Users: users})
+}
+
+// clusterHeartbeat publica la presencia, renueva los nombres reservados y olvida
+// los nodos que dejaron de publicar. Se ejecuta en el loop del hub; la renovación
+// va en otra goroutine para no esperar a Redis, y se salta si la anterior no acabó.
+func (h *Hub) clusterHeartbeat() {
+	h.publishPresence()
+
+	if h.refreshing.CompareAndSwap(false, true) {
+		usernames := h.GetConnectedUsers()
+		go func() {
+			defer h.refreshing.Store(false)
+			if err := h.backplane.RefreshUsernames(usernames); err != nil {
+				slog.Warn("error renovando nombres de usuario en el backplane", "error", err)
+			}
+		}()
+	}
+
+	expired := false
+	h.mu.Lock()
+	for node, presence := range h.remoteNodes {
+		if time.Since(presence.seen) > 3*presenceInterval {
+			delete(h.remoteNodes, node)
+			expired = true
+			slog.Warn("nodo sin presencia, se da por caído", "node", node)
+		}
+	}
+	h.mu.Unlock()
+
+	if expired {
+		h.broadcastUserList()
+	}
+}
+
+// mergeRemoteUsers añade a la lista de usuarios los conectados a otros nodos.
+// Debe llamarse con h.mu tomado.
+func (h *Hub) mergeRemoteUsers(users []*UserStatus) []*UserStatus {
+	if len(h.remoteNodes) == 0 {
+		return users
+	}
+
+	byName := make(map[string]*UserStatus, len(users))
+	for _, user := range users {
+		byName[user.Username] = user
+	}
+
+	now := time.Now()
+	for _, presence := range h.remoteNodes {
+		for _, remote := range presence.users {
+			user, exists := byName[remote.Username]
+			if exists && user.Connected {
+				continue
+			}
+			if !exists {
+				user = &UserStatus{Username: remote.Username}
+				byName[remote.Username] = user
+				users = append(users, user)
+			}
+			user.Connected = true
+			user.ConnectedAt = remote.ConnectedAt
+			user.LastSeen = now
+			user.Bot = remote.Bot
+		}
+	}
+	return users
+}
+
+// samePresence indica si dos publicaciones de presencia tienen los mismos usuarios
+func samePresence(a, b []PresenceUser) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	names := make(map[string]bool, len(a))
+	for _, user := range a {
+		names[user.Username] = true
+	}
+	for _, user := range b {
+		if !names[user.Username] {
+			return false
+		}
+	}
+	return true
+}
+
+// claimUsername reserva el nombre en el clúster para una conexión nueva. Se llama
+// desde serveWS y no desde el loop del hub porque espera a Redis. Las reservas se
+// cuentan por conexión: el nombre se libera con la última (releaseClaim).
+func (h *Hub) claimUsername(username string) bool {
+	h.claimsMu.Lock()
+	defer h.claimsMu.Unlock()
+
+	claimed, err := h.backplane.ClaimUsername(username)
+	if err != nil {
+		// Sin backplane no se puede garantizar que el nombre sea único
+		slog.Error("error reservando nombre de usuario en el backplane", "user", username, "error", err)
+		return false
+	}
+	if claimed {
+		h.claims[username]++
+	}
+	return claimed
+}
+
+// releaseClaim devuelve la reserva de la conexión y libera el nombre en el clúster
+// si ninguna otra conexión de este nodo lo usa. Espera a Redis: desde el loop del
+// hub se llama en otra goroutine.
+func (h *Hub) releaseClaim(client *Client) {
+	if !client.claimed {
+		return
+	}
+
+	h.claimsMu.Lock()
+	defer h.claimsMu.Unlock()
+
+	h.claims[client.username]--
+	if h.claims[client.username] > 0 {
+		return
+	}
+	delete(h.claims, client.username)
+
+	if err := h.backplane.ReleaseUsername(client.username); err != nil {
+		slog.Warn("error liberando nombre de usuario en el backplane", "user", client.username, "error", err)
+	}
+}
+
+// remoteBotsFor devuelve los bots de otros nodos que atienden el comando.
+// Debe llamarse con h.mu tomado.
+func (h *Hub) remoteBotsFor(command string) []string {
+	var bots []string
+	for _, presence := range h.remoteNodes {
+		for _, user := range presence.users {
+			if user.Bot && containsString(user.Commands, command) {
+				bots = append(bots, user.Username)
+			}
+		}
+	}
+	return bots
+}
+
+// MemoryBus conecta varios hubs del mismo proceso (pruebas y desarrollo)
+type MemoryBus struct {
+	nodes     map[string]*MemoryBackplane
+	usernames map[string]string // Nombre → nodo que lo reservó
+	mu        sync.Mutex
+}
+
+// NewMemoryBus crea un bus en memoria vacío
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		nodes:     make(map[string]*MemoryBackplane),
+		usernames: make(map[string]string),
+	}
+}
+
+// Join añade un nodo al bus
+func (b *MemoryBus) Join(node string) *MemoryBackplane {
+	backplane := &MemoryBackplane{bus: b, node: node}
+	b.mu.Lock()
+	b.nodes[node] = backplane
+	b.mu.Unlock()
+	return backplane
+}
+
+// MemoryBackplane es la vista de un nodo sobre un MemoryBus
+type MemoryBackplane struct {
+	bus     *MemoryBus
+	node    string
+	handler func(*BackplaneEvent)
+}
+
+// NodeID identifica al nodo
+func (m *MemoryBackplane) NodeID() string {
+	return m.node
+}
+
+// Publish entrega el evento a los demás nodos del bus
+func (m *MemoryBackplane) Publish(event *BackplaneEvent) error {
+	event.Node = m.node
+
+	m.bus.mu.Lock()
+	var handlers []func(*BackplaneEvent)
+	for node, backplane := range m.bus.nodes {
+		if node != m.node && backplane.handler != nil {
+			handlers = append(handlers, backplane.handler)
+		}
+	}
+	m.bus.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(event)
+	}
+	return nil
+}
+
+// Subscribe registra la función que recibe los eventos
+func (m *MemoryBackplane) Subscribe(handler func(*BackplaneEvent)) error {
+	m.bus.mu.Lock()
+	m.handler = handler
+	m.bus.mu.Unlock()
+	return nil
+}
+
+// ClaimUsername reserva el nombre si está libre o ya es de este nodo
+func (m *MemoryBackplane) ClaimUsername(username string) (bool, error) {
+	m.bus.mu.Lock()
+	defer m.bus.mu.Unlock()
+
+	if owner, exists := m.bus.usernames[username]; exists && owner != m.node {
+		return false, nil
+	}
+	m.bus.usernames[username] = m.node
+	return true, nil
+}
+
+// ReleaseUsername libera el nombre si lo reservó este nodo
+func (m *MemoryBackplane) ReleaseUsername(username string) error {
+	m.bus.mu.Lock()
+	defer m.bus.mu.Unlock()
+
+	if m.bus.usernames[username] == m.node {
+		delete(m.bus.usernames, username)
+	}
+	return nil
+}
+
+// RefreshUsernames no hace nada: en memoria las reservas no caducan
+func (m *MemoryBackplane) RefreshUsernames(usernames []string) error {
+	return nil
+}
+
+// Close saca al nodo del bus y libera sus nombres
+func (m *MemoryBackplane) Close() error {
+	m.bus.mu.Lock()
+	defer m.bus.mu.Unlock()
+
+	delete(m.bus.nodes, m.node)
+	for username, owner := range m.bus.usernames {
+		if owner == m.node {
+			delete(m.bus.usernames, username)
+		}
+	}
+	return nil
+}
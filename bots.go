@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Acciones que un bot puede enviar por su WebSocket
+const (
+	BotActionMessage   = "message"   // Mensaje normal al chat (acción por defecto)
+	BotActionReact     = "react"     // Reacción con emoji a un mensaje existente
+	BotActionEphemeral = "ephemeral" // Mensaje visible solo para un usuario
+)
+
+// Bot es una cuenta de bot que se autentica con un token de API en /ws
+type Bot struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Commands  []string  `json:"commands"`  // Comandos (/deploy, /standup...) que se le enrutan
+	TokenHash string    `json:"tokenHash"` // SHA-256 del token; el token solo se muestra al crearlo
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BotRegistry guarda las cuentas de bot indexadas por el hash de su token
+type BotRegistry struct {
+	bots      map[string]*Bot
+	storePath string
+	mu        sync.RWMutex
+}
+
+// NewBotRegistry crea el registro y carga los bots persistidos
+func NewBotRegistry(storePath string) *BotRegistry {
+	r := &BotRegistry{
+		bots:      make(map[string]*Bot),
+		storePath: storePath,
+	}
+
+	if err := r.load(); err != nil {
+		slog.Error("error cargando bots", "path", storePath, "error", err)
+	}
+	return r
+}
+
+// validateBotName valida el nombre de un bot. Es más permisivo que validateUsername
+// (admite espacios y emojis) porque los bots se identifican con una insignia.
+func validateBotName(name string) bool {
+	if strings.TrimSpace(name) != name || name == "" || utf8.RuneCountInString(name) > 32 {
+		return false
+	}
+
+	for _, r := range name {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeCommand elimina la barra inicial y pasa el comando a minúsculas
+func normalizeCommand(command string) string {
+	return strings.ToLower(strings.TrimPrefix(strings.TrimSpace(command), "/"))
+}
+
+// Create registra un bot nuevo y devuelve el token en claro (única vez que se ve)
+func (r *BotRegistry) Create(name string, commands []string) (*Bot, string, error) {
+	if !validateBotName(name) {
+		return nil, "", errors.New("nombre de bot inválido")
+	}
+
+	normalized := make([]string, 0, len(commands))
+	for _, command := range commands {
+		command = normalizeCommand(command)
+		if command == "" || strings.ContainsAny(command, " \t") {
+			return nil, "", errors.New("comando inválido: " + command)
+		}
+		normalized = append(normalized, command)
+	}
+
+	token := randomHex(24)
+	bot := &Bot{
+		ID:        randomHex(8),
+		Name:      name,
+		Commands:  normalized,
+		TokenHash: sha256Hex([]byte(token)),
+		CreatedAt: time.Now(),
+	}
+
+	r.mu.Lock()
+	r.bots[bot.TokenHash] = bot
+	err := r.saveLocked()
+	r.mu.Unlock()
+
+	if err != nil {
+		slog.Error("error persistiendo bots", "error", err)
+	}
+
+	slog.Info("bot creado", "bot", bot.Name, "id", bot.ID, "commands", bot.Commands)
+	return bot, token, nil
+}
+
+// Remove elimina un bot por su ID
+func (r *BotRegistry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for tokenHash, bot := range r.bots {
+		if bot.ID == id {
+			delete(r.bots, tokenHash)
+			if err := r.saveLocked(); err != nil {
+				slog.Error("error persistiendo bots", "error", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// List devuelve los bots registrados sin el hash del token
+func (r *BotRegistry) List() []Bot {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]Bot, 0, len(r.bots))
+	for _, bot := range r.bots {
+		botCopy := *bot
+		botCopy.TokenHash = ""
+		list = append(list, botCopy)
+	}
+	return list
+}
+
+// Authenticate busca el bot correspondiente a un token de API
+func (r *BotRegistry) Authenticate(token string) (*Bot, bool) {
+	if token == "" {
+		return nil, false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	bot, exists := r.bots[sha256Hex([]byte(token))]
+	return bot, exists
+}
+
+// load lee los bots persistidos
+func (r *BotRegistry) load() error {
+	if r.storePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.storePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var bots []*Bot
+	if err := json.Unmarshal(data, &bots); err != nil {
+		return err
+	}
+
+	for _, bot := range bots {
+		r.bots[bot.TokenHash] = bot
+	}
+	return nil
+}
+
+// saveLocked persiste los bots. Requiere r.mu tomado.
+func (r *BotRegistry) saveLocked() error {
+	if r.storePath == "" {
+		return nil
+	}
+
+	bots := make([]*Bot, 0, len(r.bots))
+	for _, bot := range r.bots {
+		bots = append(bots, bot)
+	}
+
+	data, err := json.MarshalIndent(bots, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.storePath), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.storePath, data, 0o600)
+}
+
+// CommandEvent se envía a los bots cuando un usuario escribe uno de sus comandos
+type CommandEvent struct {
+	Type      string    `json:"type"` // Siempre "command"
+	Command   string    `json:"command"`
+	Args      string    `json:"args"`
+	Username  string    `json:"username"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventType implementa Event
+func (e *CommandEvent) EventType() string { return EventTypeCommand }
+
+// ReactionEvent se difunde cuando alguien reacciona a un mensaje
+type ReactionEvent struct {
+	Type      string    `json:"type"` // Siempre "reaction"
+	MessageID string    `json:"messageId"`
+	Emoji     string    `json:"emoji"`
+	Username  string    `json:"username"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventType implementa Event
+func (e *ReactionEvent) EventType() string { return EventTypeReaction }
+
+// parseCommand separa "/deploy prod now" en ("deploy", "prod now")
+func parseCommand(content string) (string, string, bool) {
+	content = strings.TrimSpace(content)
+	if !strings.HasPrefix(content, "/") || len(content) < 2 {
+		return "", "", false
+	}
+
+	command, args, _ := strings.Cut(content[1:], " ")
+	return strings.ToLower(command), strings.TrimSpace(args), true
+}
+
+// serveBotsAdmin gestiona las cuentas de bot: GET lista, POST crea, DELETE ?id= elimina
+func serveBotsAdmin(registry *BotRegistry, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"bots": registry.List()})
+
+	case "POST":
+		var req struct {
+			Name     string   `json:"name"`
+			Commands []string `json:"commands"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+
+		bot, token, err := registry.Create(req.Name, req.Commands)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"id":       bot.ID,
+			"name":     bot.Name,
+			"commands": bot.Commands,
+			"token":    token,
+		})
+
+	case "DELETE":
+		if !registry.Remove(r.URL.Query().Get("id")) {
+			http.Error(w, "Bot no encontrado", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
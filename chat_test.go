@@ -1,11 +1,35 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -52,13 +76,9 @@ func TestMessageHistory(t *testing.T) {
 
 	// Crear mensaje de prueba
 	msg := NewMessage("testuser", "Mensaje de prueba")
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		t.Fatalf("Error serializando mensaje: %v", err)
-	}
 
 	// Enviar mensaje al hub
-	hub.broadcast <- msgBytes
+	hub.broadcast <- newWireEvent(msg)
 	time.Sleep(100 * time.Millisecond)
 
 	// Verificar que se agregó al historial
@@ -87,10 +107,6 @@ func TestImageMessage(t *testing.T) {
 
 	// Crear mensaje con imagen
 	msg := NewMessageWithImage("testuser", "Mira esta imagen", imageData)
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		t.Fatalf("Error serializando mensaje con imagen: %v", err)
-	}
 
 	// Verificar propiedades del mensaje
 	if !msg.HasImage {
@@ -106,7 +122,7 @@ func TestImageMessage(t *testing.T) {
 	}
 
 	// Enviar al hub y verificar historial
-	hub.broadcast <- msgBytes
+	hub.broadcast <- newWireEvent(msg)
 	time.Sleep(100 * time.Millisecond)
 
 	history := hub.GetMessageHistory()
@@ -135,17 +151,20 @@ func TestImageValidation(t *testing.T) {
 		t.Error("Una imagen válida fue rechazada")
 	}
 
-	// Test: Imagen muy grande
+	// Test: Imagen muy grande aunque declare un tamaño pequeño
 	largeImage := &ImageData{
-		Data: "data:image/png;base64,validdata",
+		Data: "data:image/png;base64," + strings.Repeat("A", 8*1024*1024), // 6MB > 5MB límite
 		Name: "large.png",
 		Type: "image/png",
-		Size: 10 * 1024 * 1024, // 10MB > 5MB límite
+		Size: 1000,
 	}
 
 	if client.isValidImage(largeImage) {
 		t.Error("Una imagen muy grande fue aceptada")
 	}
+	if size := imagePayloadSize(&ImageData{Data: "data:image/png;base64,aGVsbG8="}); size != 5 {
+		t.Errorf("El tamaño debería calcularse a partir del base64: se esperaban 5 bytes, se obtuvo %d", size)
+	}
 
 	// Test: Tipo MIME inválido
 	invalidTypeImage := &ImageData{
@@ -264,13 +283,9 @@ func TestMessageBroadcastWithHistory(t *testing.T) {
 
 	// Crear un mensaje de prueba
 	msg := NewMessage("testuser0", "Hola mundo")
-	msgBytes, err := json.Marshal(msg)
-	if err != nil {
-		t.Fatalf("Error serializando mensaje: %v", err)
-	}
 
 	// Enviar mensaje al hub para difusión
-	hub.broadcast <- msgBytes
+	hub.broadcast <- newWireEvent(msg)
 
 	// Dar tiempo para la difusión
 	time.Sleep(100 * time.Millisecond)
@@ -351,13 +366,11 @@ func TestConcurrentOperationsWithImages(t *testing.T) {
 					msg = NewMessage(username, content)
 				}
 
-				if msgBytes, err := json.Marshal(msg); err == nil {
-					select {
-					case hub.broadcast <- msgBytes:
-						// Mensaje enviado exitosamente
-					case <-time.After(100 * time.Millisecond):
-						t.Logf("Timeout enviando mensaje desde goroutine %d", goroutineID)
-					}
+				select {
+				case hub.broadcast <- newWireEvent(msg):
+					// Mensaje enviado exitosamente
+				case <-time.After(100 * time.Millisecond):
+					t.Logf("Timeout enviando mensaje desde goroutine %d", goroutineID)
 				}
 
 				time.Sleep(10 * time.Millisecond)
@@ -475,44 +488,2576 @@ func TestWebSocketUpgradeWithImage(t *testing.T) {
 	}
 }
 
-// BenchmarkMessageBroadcastWithImages benchmarks la difusión de mensajes con imágenes
+// startBenchmarkHub arranca un hub con clientes simulados repartidos en shards. Los
+// clientes se añaden sin pasar por el registro (que difunde la lista de usuarios a
+// todos). delivered recibe una señal cada vez que todos han recibido un mensaje.
+func startBenchmarkHub(b *testing.B, numClients, shards int) (*Hub, <-chan struct{}) {
+	cfg := DefaultConfig()
+	cfg.HubShards = shards
+	hub := NewHubWithConfig(cfg)
+	go hub.Run()
+
+	stop := make(chan struct{})
+	b.Cleanup(func() { close(stop) })
+
+	delivered := make(chan struct{}, 1)
+	var received atomic.Int64
+	for i := 0; i < numClients; i++ {
+		client := &Client{hub: hub, send: make(chan []byte, 256), username: fmt.Sprintf("bench%d", i)}
+		hub.mu.Lock()
+		hub.clients[client] = true
+		hub.mu.Unlock()
+		hub.addToShard(client)
+
+		go func() {
+			for {
+				select {
+				case _, ok := <-client.send:
+					if !ok {
+						return // Desconectado por buffer lleno
+					}
+					if received.Add(1)%int64(numClients) == 0 {
+						select {
+						case delivered <- struct{}{}:
+						default:
+						}
+					}
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	return hub, delivered
+}
+
+// BenchmarkMessageBroadcastWithImages mide cuánto tarda un mensaje con imagen en
+// llegar a todos los clientes según el número de shards (con uno solo, toda la
+// difusión va en una goroutine). La mejora depende de los núcleos (GOMAXPROCS).
 func BenchmarkMessageBroadcastWithImages(b *testing.B) {
+	for _, numClients := range []int{10, 1000, 10000} {
+		for _, shards := range []int{1, 4, 16} {
+			b.Run(fmt.Sprintf("clientes=%d/shards=%d", numClients, shards), func(b *testing.B) {
+				hub, delivered := startBenchmarkHub(b, numClients, shards)
+
+				// Crear mensaje con imagen para benchmark
+				imageData := &ImageData{
+					Data: "data:image/png;base64,benchmarkdata",
+					Name: "benchmark.png",
+					Type: "image/png",
+					Size: 1000,
+				}
+				msg := NewMessageWithImage("benchuser", "benchmark message", imageData)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					hub.broadcast <- newWireEvent(msg)
+					<-delivered
+				}
+			})
+		}
+	}
+}
+
+// TestShardedFanOut prueba que con varios shards cada cliente reciba cada mensaje
+// exactamente una vez y en orden, y que los clientes entren y salgan de los shards
+func TestShardedFanOut(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HubShards = 4
+	hub := NewHubWithConfig(cfg)
+	go hub.Run()
+
+	waitFor := func(what string, condition func() bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatalf("Tiempo agotado esperando %s", what)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	register := func(prefix string, count int) []*Client {
+		clients := make([]*Client, count)
+		for i := range clients {
+			clients[i] = &Client{hub: hub, send: make(chan []byte, 1024), username: fmt.Sprintf("%s%d", prefix, i)}
+			hub.register <- clients[i]
+		}
+		return clients
+	}
+
+	checkSizes := func(want ...int64) {
+		for i, shard := range hub.shards {
+			if size := shard.size.Load(); size != want[i] {
+				t.Errorf("Shard %d con %d clientes, se esperaban %d", i, size, want[i])
+			}
+		}
+	}
+
+	// Difunde una ronda de mensajes y comprueba que cada cliente los recibe todos,
+	// sin duplicados y en orden. El último mensaje de la ronda marca el final.
+	broadcastRound := func(round string, clients []*Client, count int) {
+		for i := 0; i <= count; i++ {
+			content := fmt.Sprintf("%s-%d", round, i)
+			if i == count {
+				content = round + "-fin"
+			}
+			hub.broadcast <- newWireEvent(NewMessage("emisor", content))
+		}
+
+		for _, client := range clients {
+			var received []string
+			timeout := time.After(2 * time.Second)
+			for done := false; !done; {
+				select {
+				case data, ok := <-client.send:
+					if !ok {
+						t.Fatalf("El canal de %s se cerró durante la ronda %s", client.username, round)
+					}
+					var msg Message
+					json.Unmarshal(data, &msg)
+					if msg.Type != MessageTypeMessage || !strings.HasPrefix(msg.Content, round+"-") {
+						continue
+					}
+					if msg.Content == round+"-fin" {
+						done = true
+						continue
+					}
+					received = append(received, msg.Content)
+				case <-timeout:
+					t.Fatalf("%s solo recibió %d mensajes de la ronda %s", client.username, len(received), round)
+				}
+			}
+
+			if len(received) != count {
+				t.Fatalf("%s recibió %d mensajes de la ronda %s, se esperaban %d", client.username, len(received), round, count)
+			}
+			for i, content := range received {
+				if want := fmt.Sprintf("%s-%d", round, i); content != want {
+					t.Fatalf("%s recibió %s en la posición %d, se esperaba %s", client.username, content, i, want)
+				}
+			}
+		}
+	}
+
+	// Los clientes nuevos se reparten entre los shards con menos clientes
+	clients := register("cliente", 12)
+	waitFor("el registro de 12 clientes", func() bool { return hub.GetClientCount() == 12 })
+	checkSizes(3, 3, 3, 3)
+	broadcastRound("a", clients, 100)
+
+	// Al darse de baja, su shard deja de entregarles mensajes y cierra su canal
+	var remaining, removed []*Client
+	for _, client := range clients {
+		if client.shard == hub.shards[0] {
+			removed = append(removed, client)
+		} else {
+			remaining = append(remaining, client)
+		}
+	}
+	for _, client := range removed {
+		hub.unregister <- client
+	}
+	for _, client := range removed {
+		waitFor("el cierre del canal de "+client.username, func() bool {
+			for {
+				select {
+				case _, ok := <-client.send:
+					if !ok {
+						return true
+					}
+				default:
+					return false
+				}
+			}
+		})
+	}
+	checkSizes(0, 3, 3, 3)
+
+	// Los que llegan después ocupan el hueco del shard vacío
+	added := register("nuevo", 3)
+	waitFor("el registro de 3 clientes nuevos", func() bool { return hub.GetClientCount() == 12 })
+	for _, client := range added {
+		if client.shard != hub.shards[0] {
+			t.Errorf("%s debería haber ido al shard vacío", client.username)
+		}
+	}
+	checkSizes(3, 3, 3, 3)
+	broadcastRound("b", append(remaining, added...), 100)
+}
+
+// TestAttachmentDeduplication prueba que imágenes repetidas se guarden una sola vez
+func TestAttachmentDeduplication(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(dir)
+	if err != nil {
+		t.Fatalf("Error creando almacén en disco: %v", err)
+	}
+	manager := NewAttachmentManager(store)
+
+	newImage := func() *ImageData {
+		return &ImageData{
+			Data: "data:image/png;base64,aG9sYSBtdW5kbw==",
+			Name: "meme.png",
+			Type: "image/png",
+			Size: 11,
+		}
+	}
+
+	first, second := newImage(), newImage()
+	if err := manager.StoreImage(first); err != nil {
+		t.Fatalf("Error guardando imagen: %v", err)
+	}
+	if err := manager.StoreImage(second); err != nil {
+		t.Fatalf("Error guardando imagen repetida: %v", err)
+	}
+
+	if first.Hash == "" || first.Hash != second.Hash {
+		t.Fatalf("Se esperaba el mismo hash para imágenes idénticas: '%s' vs '%s'", first.Hash, second.Hash)
+	}
+
+	if first.Data != attachmentURLPrefix+first.Hash {
+		t.Errorf("Se esperaba que el data URL se reemplazara por la ruta del adjunto, se obtuvo '%s'", first.Data)
+	}
+
+	if refs := manager.RefCount(first.Hash); refs != 2 {
+		t.Errorf("Se esperaban 2 referencias, se encontraron %d", refs)
+	}
+
+	data, contentType, err := manager.Open(first.Hash)
+	if err != nil || string(data) != "hola mundo" || contentType != "image/png" {
+		t.Errorf("Contenido inesperado: data='%s' type='%s' err=%v", data, contentType, err)
+	}
+
+	// Liberar referencias: el archivo solo desaparece con la última
+	manager.Release(first.Hash)
+	if _, err := store.Get(first.Hash); err != nil {
+		t.Errorf("El adjunto no debería borrarse mientras tenga referencias: %v", err)
+	}
+
+	manager.Release(first.Hash)
+	manager.Flush(context.Background())
+	if _, err := store.Get(first.Hash); err != ErrAttachmentNotFound {
+		t.Errorf("Se esperaba ErrAttachmentNotFound tras liberar todas las referencias, se obtuvo %v", err)
+	}
+
+	// El borrado no bloquea a quien libera (el loop del hub) aunque el backend sea
+	// lento, y no se lleva un adjunto que se vuelve a guardar mientras tanto
+	slow := &slowDeleteStore{AttachmentStore: store, unblock: make(chan struct{})}
+	slowManager := NewAttachmentManager(slow)
+	image := newImage()
+	slowManager.StoreImage(image)
+	released := make(chan struct{})
+	go func() {
+		slowManager.Release(image.Hash)
+		close(released)
+	}()
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("Release no debería esperar al borrado en el backend")
+	}
+	stored := make(chan error, 1)
+	go func() { stored <- slowManager.StoreImage(newImage()) }()
+	close(slow.unblock)
+	if err := <-stored; err != nil {
+		t.Fatalf("Error volviendo a guardar la imagen: %v", err)
+	}
+	slowManager.Flush(context.Background())
+	if _, err := store.Get(image.Hash); err != nil || slowManager.RefCount(image.Hash) != 1 {
+		t.Errorf("La imagen guardada de nuevo debería seguir en el backend: %v", err)
+	}
+
+	// Los SVG pueden llevar scripts: se sirven como descarga y en un sandbox
+	hub := NewHub()
+	hub.attachments = manager
+	for _, tc := range []struct {
+		image     *ImageData
+		sandboxed bool
+	}{
+		{&ImageData{Data: "data:image/png;base64,iVBORw0KGgo=", Type: "image/png"}, false},
+		{&ImageData{Data: "data:image/svg+xml;base64,PHN2Zz48c2NyaXB0PmFsZXJ0KDEpPC9zY3JpcHQ+PC9zdmc+", Type: "image/svg+xml"}, true},
+	} {
+		if err := manager.StoreImage(tc.image); err != nil {
+			t.Fatalf("Error guardando %s: %v", tc.image.Type, err)
+		}
+		recorder := httptest.NewRecorder()
+		serveAttachment(hub, recorder, httptest.NewRequest("GET", tc.image.Data, nil))
+		sandboxed := recorder.Header().Get("Content-Security-Policy") == "sandbox" &&
+			recorder.Header().Get("Content-Disposition") == "attachment"
+		if recorder.Code != http.StatusOK || sandboxed != tc.sandboxed {
+			t.Errorf("%s: código %d, sandbox=%v (se esperaba %v)", tc.image.Type, recorder.Code, sandboxed, tc.sandboxed)
+		}
+	}
+}
+
+// slowDeleteStore es un backend cuyos borrados esperan a unblock
+type slowDeleteStore struct {
+	AttachmentStore
+	unblock chan struct{}
+}
+
+func (s *slowDeleteStore) Delete(key string) error {
+	<-s.unblock
+	return s.AttachmentStore.Delete(key)
+}
+
+// TestAttachmentReleasedOnHistoryEviction prueba que la retención del historial libere adjuntos
+func TestAttachmentReleasedOnHistoryEviction(t *testing.T) {
+	hub := NewHub()
+	hub.maxHistorySize = 1
+	store, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creando almacén en disco: %v", err)
+	}
+	hub.SetAttachmentStore(store)
+
+	image := &ImageData{Data: "data:image/png;base64,AQID", Name: "a.png", Type: "image/png"}
+	if err := hub.attachments.StoreImage(image); err != nil {
+		t.Fatalf("Error guardando imagen: %v", err)
+	}
+
+	hub.addToMessageHistory(NewMessageWithImage("testuser", "", image), false)
+	if hub.attachments.RefCount(image.Hash) != 1 {
+		t.Fatalf("Se esperaba 1 referencia tras agregar al historial")
+	}
+
+	hub.addToMessageHistory(NewMessage("testuser", "texto"), false)
+	if refs := hub.attachments.RefCount(image.Hash); refs != 0 {
+		t.Errorf("Se esperaban 0 referencias tras salir del historial, se encontraron %d", refs)
+	}
+
+	// Un mensaje de otro nodo con el mismo adjunto suma su propia referencia: al
+	// desplazar del historial al mensaje local, el adjunto sigue en uso
+	local := &ImageData{Data: "data:image/png;base64,AQID", Name: "a.png", Type: "image/png"}
+	hub.attachments.StoreImage(local)
+	hub.addToMessageHistory(NewMessageWithImage("testuser", "", local), false)
+
+	remoteMsg := NewMessageWithImage("remoto", "", &ImageData{Data: local.Data, Name: "a.png", Type: "image/png", Hash: local.Hash})
+	payload, _ := json.Marshal(remoteMsg)
+	hub.handleRemote(&BackplaneEvent{Node: "otro", Kind: BackplaneBroadcast, Payload: payload})
+	hub.attachments.Flush(context.Background())
+	if refs := hub.attachments.RefCount(local.Hash); refs != 1 {
+		t.Errorf("Se esperaba 1 referencia (la del mensaje remoto), se encontraron %d", refs)
+	}
+	if _, err := store.Get(local.Hash); err != nil {
+		t.Errorf("El adjunto del mensaje remoto no debería borrarse: %v", err)
+	}
+
+	hub.addToMessageHistory(NewMessage("testuser", "texto"), false)
+	hub.attachments.Flush(context.Background())
+	if _, err := store.Get(local.Hash); err != ErrAttachmentNotFound {
+		t.Errorf("Sin referencias el adjunto debería borrarse, se obtuvo %v", err)
+	}
+}
+
+// TestS3StoreRoundTrip prueba el backend S3 contra un servidor local que simula el API
+func TestS3StoreRoundTrip(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+			http.Error(w, "firma ausente", http.StatusForbidden)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case "PUT":
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = body
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	store := NewS3Store(server.URL, "chat", "", "test", "secret")
+	if err := store.Put("abc123", []byte("contenido"), "image/png"); err != nil {
+		t.Fatalf("Error en Put: %v", err)
+	}
+
+	if _, ok := objects["/chat/abc123"]; !ok {
+		t.Fatalf("Se esperaba el objeto en /chat/abc123, objetos: %v", objects)
+	}
+
+	data, err := store.Get("abc123")
+	if err != nil || string(data) != "contenido" {
+		t.Errorf("Get devolvió '%s', err=%v", data, err)
+	}
+
+	if err := store.Delete("abc123"); err != nil {
+		t.Fatalf("Error en Delete: %v", err)
+	}
+
+	if _, err := store.Get("abc123"); err != ErrAttachmentNotFound {
+		t.Errorf("Se esperaba ErrAttachmentNotFound, se obtuvo %v", err)
+	}
+
+	// El bucket es compartido: liberar la última referencia de este nodo no borra nada
+	manager := NewAttachmentManager(store)
+	hash, err := manager.Store([]byte("compartido"), "image/png")
+	if err != nil {
+		t.Fatalf("Error guardando adjunto: %v", err)
+	}
+	manager.Release(hash)
+	manager.Flush(context.Background())
+	if _, err := store.Get(hash); err != nil {
+		t.Errorf("Un backend compartido no debería borrar objetos: %v", err)
+	}
+}
+
+// TestUploadQuota prueba la cuota de subida por usuario y por rol
+func TestUploadQuota(t *testing.T) {
+	quota := NewUploadQuota(time.Hour, 100)
+	quota.SetRoleLimit(RoleAdmin, 0)
+
+	now := time.Now()
+	quota.now = func() time.Time { return now }
+
+	if !quota.Reserve("ana", RoleUser, 60) {
+		t.Fatal("La primera subida debería estar dentro de la cuota")
+	}
+
+	if quota.Reserve("ana", RoleUser, 60) {
+		t.Error("Una subida que supera la cuota fue aceptada")
+	}
+
+	if !quota.Reserve("luis", RoleUser, 60) {
+		t.Error("La cuota de un usuario no debería afectar a otro")
+	}
+
+	if !quota.Reserve("root", RoleAdmin, 1000) {
+		t.Error("Un rol con límite 0 no debería tener cuota")
+	}
+
+	// Al avanzar más allá de la ventana los bytes antiguos dejan de contar
+	now = now.Add(time.Hour + time.Second)
+	if quota.Usage("ana") != 0 {
+		t.Errorf("Se esperaba uso 0 tras la ventana, se obtuvo %d", quota.Usage("ana"))
+	}
+
+	if !quota.Reserve("ana", RoleUser, 60) {
+		t.Error("La subida debería aceptarse tras expirar la ventana")
+	}
+
+	// Una subida que no llegó a publicarse se devuelve a la cuota
+	quota.Release("ana", 60)
+	if quota.Usage("ana") != 0 || !quota.Reserve("ana", RoleUser, 100) {
+		t.Errorf("Release debería devolver los bytes reservados: uso %d", quota.Usage("ana"))
+	}
+
+	// Se cobra el tamaño real de la imagen y se devuelve si un interceptor posterior la rechaza
+	hub := NewHub()
+	hub.uploadQuota = NewUploadQuota(time.Hour, 1000)
+	hub.pipeline.Use(NewInterceptorFunc("reject-all", func(ctx *MessageContext) error {
+		return Reject("TEST", "rechazado")
+	}))
+	client := &Client{hub: hub, username: "eva", role: RoleUser}
+	image := &ImageData{Data: "data:image/png;base64,aGVsbG8=", Name: "a.png", Type: "image/png", Size: 1}
+	msgCtx := &MessageContext{Client: client, Message: NewMessageWithImage("eva", "", image)}
+	if err := hub.pipeline.Process(msgCtx); err == nil || msgCtx.quotaBytes != 5 {
+		t.Errorf("Se esperaba el rechazo con 5 bytes reservados: %v, %d", err, msgCtx.quotaBytes)
+	}
+	msgCtx.releaseQuota()
+	if used := hub.uploadQuota.Usage("eva"); used != 0 {
+		t.Errorf("Un mensaje rechazado no debería consumir cuota: %d bytes", used)
+	}
+
+	limits, err := ParseRoleLimits("guest=10, admin=0")
+	if err != nil || limits[RoleGuest] != 10 || limits[RoleAdmin] != 0 {
+		t.Errorf("ParseRoleLimits devolvió %v, err=%v", limits, err)
+	}
+
+	if _, err := ParseRoleLimits("guest"); err == nil {
+		t.Error("Se esperaba error para un límite sin valor")
+	}
+}
+
+// TestWebhookDelivery prueba la entrega firmada, los reintentos y el dead-letter log
+func TestWebhookDelivery(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	received := make(chan WebhookPayload, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		if r.Header.Get("X-Chat-Signature") != "sha256="+SignWebhookBody("s3cr3t", body) {
+			http.Error(w, "firma inválida", http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		attempts++
+		failing := attempts == 1
+		mu.Unlock()
+
+		// El primer intento falla para forzar un reintento
+		if failing {
+			http.Error(w, "fallo temporal", http.StatusServiceUnavailable)
+			return
+		}
+
+		var payload WebhookPayload
+		json.Unmarshal(body, &payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	deadLetterPath := t.TempDir() + "/dead.jsonl"
+	dispatcher := NewWebhookDispatcher("", deadLetterPath)
+	dispatcher.backoff = 10 * time.Millisecond
+	go dispatcher.Run()
+
+	if _, err := dispatcher.Register(server.URL, "s3cr3t", []string{WebhookEventJoin}); err != nil {
+		t.Fatalf("Error registrando webhook: %v", err)
+	}
+
+	if _, err := dispatcher.Register(server.URL, "", []string{"desconocido"}); err == nil {
+		t.Error("Se esperaba error para un evento desconocido")
+	}
+
+	// Un evento al que no está suscrito no debe entregarse
+	dispatcher.Dispatch(WebhookEventLeave, NewSystemMessage("adiós"))
+	dispatcher.Dispatch(WebhookEventJoin, NewSystemMessage("hola"))
+
+	select {
+	case payload := <-received:
+		if payload.Event != WebhookEventJoin {
+			t.Errorf("Se esperaba evento 'join', se recibió '%s'", payload.Event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("El webhook no se entregó tras el reintento")
+	}
+
+	// Un endpoint que nunca responde bien acaba en el dead-letter log
+	dead, err := dispatcher.Register("http://127.0.0.1:1/nada", "", []string{WebhookEventMessage})
+	if err != nil {
+		t.Fatalf("Error registrando webhook: %v", err)
+	}
+	dispatcher.Dispatch(WebhookEventMessage, NewMessage("testuser", "hola"))
+
+	deadline := time.Now().Add(3 * time.Second)
+	for len(dispatcher.DeadLetters()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	letters := dispatcher.DeadLetters()
+	if len(letters) != 1 || letters[0].WebhookID != dead.ID || letters[0].Attempts != webhookMaxAttempts {
+		t.Fatalf("Dead-letter inesperado: %+v", letters)
+	}
+
+	if data, err := os.ReadFile(deadLetterPath); err != nil || !strings.Contains(string(data), dead.ID) {
+		t.Errorf("El dead-letter log no contiene la entrega fallida: %v", err)
+	}
+}
+
+// TestIncomingHook prueba la publicación de mensajes mediante un webhook entrante
+func TestIncomingHook(t *testing.T) {
 	hub := NewHub()
 	go hub.Run()
 
-	// Crear algunos clientes
-	numClients := 10
-	clients := make([]*Client, numClients)
+	registry := NewIncomingHookRegistry("")
+	hook, token, err := registry.Create("ci-bot")
+	if err != nil {
+		t.Fatalf("Error creando webhook entrante: %v", err)
+	}
 
-	for i := 0; i < numClients; i++ {
-		clients[i] = &Client{
-			hub:      hub,
-			send:     make(chan []byte, 256),
-			username: "benchuser" + string(rune(i+'0')),
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveIncomingHook(hub, registry, w, r)
+	}))
+	defer server.Close()
+
+	post := func(path, body string) int {
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error en POST: %v", err)
 		}
-		hub.register <- clients[i]
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post(incomingHookPrefix+"token-falso", `{"content":"hola"}`); code != http.StatusNotFound {
+		t.Errorf("Se esperaba 404 para un token desconocido, se obtuvo %d", code)
+	}
+
+	if code := post(incomingHookPrefix+token, `{"content":"hola","room":"otra"}`); code != http.StatusBadRequest {
+		t.Errorf("Se esperaba 400 para una sala desconocida, se obtuvo %d", code)
+	}
+
+	if code := post(incomingHookPrefix+token, `{"content":"Build #42 OK"}`); code != http.StatusAccepted {
+		t.Fatalf("Se esperaba 202, se obtuvo %d", code)
 	}
 
 	time.Sleep(100 * time.Millisecond)
 
-	// Crear mensaje con imagen para benchmark
-	imageData := &ImageData{
-		Data: "data:image/png;base64,benchmarkdata",
-		Name: "benchmark.png",
-		Type: "image/png",
-		Size: 1000,
+	history := hub.GetMessageHistory()
+	if len(history) != 1 {
+		t.Fatalf("Se esperaba 1 mensaje en el historial, se encontraron %d", len(history))
+	}
+
+	if history[0].Username != hook.Name || !history[0].Bot || history[0].Content != "Build #42 OK" {
+		t.Errorf("Mensaje inesperado en el historial: %+v", history[0])
 	}
 
-	msg := NewMessageWithImage("benchuser", "benchmark message", imageData)
-	msgBytes, _ := json.Marshal(msg)
+	// username solo firma dentro del espacio del hook y nunca como un usuario conocido
+	if code := post(incomingHookPrefix+token, `{"content":"desplegado","username":"deploy"}`); code != http.StatusAccepted {
+		t.Errorf("Se esperaba 202 con username, se obtuvo %d", code)
+	}
+	hub.register <- &Client{hub: hub, send: make(chan []byte, 16), username: "ana"}
+	_, anaToken, _ := registry.Create("ana")
+	for i := 0; i < 50 && hub.GetClientCount() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if code := post(incomingHookPrefix+anaToken, `{"content":"soy ana"}`); code != http.StatusConflict {
+		t.Errorf("Un hook no debería publicar como un usuario conectado: %d", code)
+	}
 
-	b.ResetTimer()
+	// Los mensajes pasan por la cadena de interceptores
+	hub.contentFilter, _ = NewContentFilterFromConfig(FilterConfig{Rules: []FilterRule{{Mode: FilterModeBlock, Words: []string{"prohibido"}}}})
+	if code := post(incomingHookPrefix+token, `{"content":"algo prohibido"}`); code != http.StatusUnprocessableEntity {
+		t.Errorf("El filtro de contenido debería rechazar el mensaje del webhook: %d", code)
+	}
 
-	for i := 0; i < b.N; i++ {
-		select {
-		case hub.broadcast <- msgBytes:
-		case <-time.After(10 * time.Millisecond):
-			// Timeout para evitar bloqueos
+	time.Sleep(100 * time.Millisecond)
+	history = hub.GetMessageHistory()
+	if len(history) != 2 || history[1].Username != hook.Name+"/deploy" {
+		t.Errorf("Se esperaba el mensaje firmado como %s/deploy: %+v", hook.Name, history)
+	}
+}
+
+// TestBotAPI prueba la autenticación de bots, el enrutado de comandos y los mensajes efímeros
+func TestBotAPI(t *testing.T) {
+	hub := NewHub()
+	hub.bots = NewBotRegistry("")
+	go hub.Run()
+
+	_, token, err := hub.bots.Create("Deploy Bot 🚀", []string{"/deploy"})
+	if err != nil {
+		t.Fatalf("Error creando bot: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	badDialer := websocket.Dialer{Subprotocols: []string{"bearer", "malo"}}
+	if _, _, err := badDialer.Dial(wsURL, nil); err == nil {
+		t.Fatal("Un token de bot inválido no debería conectar")
+	}
+
+	botDialer := websocket.Dialer{Subprotocols: []string{"bearer", token}}
+	botConn, _, err := botDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Error conectando bot: %v", err)
+	}
+	defer botConn.Close()
+
+	userConn, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=ana", nil)
+	if err != nil {
+		t.Fatalf("Error conectando usuario: %v", err)
+	}
+	defer userConn.Close()
+
+	// readUntil lee mensajes hasta encontrar uno del tipo indicado
+	readUntil := func(conn *websocket.Conn, msgType string) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("No se recibió mensaje de tipo '%s': %v", msgType, err)
+			}
+			if msg["type"] == msgType {
+				return msg
+			}
+		}
+	}
+
+	readUntil(userConn, "connectionSuccess")
+
+	// El comando llega al bot como evento estructurado y no se difunde
+	userConn.WriteJSON(map[string]interface{}{"content": "/deploy prod"})
+	command := readUntil(botConn, "command")
+	if command["command"] != "deploy" || command["args"] != "prod" || command["username"] != "ana" {
+		t.Errorf("Evento de comando inesperado: %v", command)
+	}
+
+	// El bot responde con un mensaje efímero solo para el usuario
+	botConn.WriteJSON(map[string]interface{}{"action": "ephemeral", "to": "ana", "content": "Desplegando..."})
+	ephemeral := readUntil(userConn, MessageTypeEphemeral)
+	if ephemeral["content"] != "Desplegando..." || ephemeral["bot"] != true {
+		t.Errorf("Mensaje efímero inesperado: %v", ephemeral)
+	}
+
+	// Los mensajes del bot llevan la insignia de bot
+	botConn.WriteJSON(map[string]interface{}{"content": "Deploy terminado"})
+	reply := readUntil(userConn, MessageTypeMessage)
+	if reply["username"] != "Deploy Bot 🚀" || reply["bot"] != true {
+		t.Errorf("Respuesta del bot inesperada: %v", reply)
+	}
+
+	// Reacción a un mensaje existente
+	botConn.WriteJSON(map[string]interface{}{"action": "react", "messageId": reply["id"], "emoji": "🎉"})
+	reaction := readUntil(userConn, "reaction")
+	if reaction["messageId"] != reply["id"] || reaction["emoji"] != "🎉" {
+		t.Errorf("Reacción inesperada: %v", reaction)
+	}
+
+	// Las acciones de bot no están disponibles para usuarios normales
+	userConn.WriteJSON(map[string]interface{}{"action": "react", "messageId": reply["id"], "emoji": "👍"})
+	if errMsg := readUntil(userConn, "error"); errMsg["code"] != "BOT_ONLY" {
+		t.Errorf("Se esperaba error BOT_ONLY, se obtuvo %v", errMsg)
+	}
+}
+
+// TestMessagePipeline prueba la cadena de interceptores: transformar, anotar, rechazar
+func TestMessagePipeline(t *testing.T) {
+	hub := NewHub()
+	client := &Client{hub: hub, send: make(chan []byte, 10), username: "testuser", role: RoleUser}
+
+	hub.pipeline.Use(NewInterceptorFunc("upper", func(ctx *MessageContext) error {
+		ctx.Message.Content = strings.ToUpper(ctx.Message.Content)
+		return nil
+	}))
+	hub.pipeline.Use(NewInterceptorFunc("no-spam", func(ctx *MessageContext) error {
+		if strings.Contains(ctx.Message.Content, "SPAM") {
+			return Reject("SPAM", "Mensaje rechazado")
+		}
+		return nil
+	}))
+
+	names := hub.pipeline.Names()
+	if names[len(names)-1] != "no-spam" {
+		t.Errorf("Los interceptores deberían ejecutarse en orden de registro: %v", names)
+	}
+
+	msg := NewMessage("testuser", "mira https://example.com/x")
+	if err := hub.pipeline.Process(&MessageContext{Client: client, Message: msg}); err != nil {
+		t.Fatalf("Error inesperado: %v", err)
+	}
+
+	if msg.Content != "MIRA HTTPS://EXAMPLE.COM/X" {
+		t.Errorf("El interceptor no transformó el contenido: '%s'", msg.Content)
+	}
+
+	links, _ := msg.Annotations["links"].([]string)
+	if len(links) != 1 || links[0] != "https://example.com/x" {
+		t.Errorf("Se esperaba la anotación de enlaces, se obtuvo %v", msg.Annotations)
+	}
+
+	var reject *RejectError
+	err := hub.pipeline.Process(&MessageContext{Client: client, Message: NewMessage("testuser", "spam")})
+	if !errors.As(err, &reject) || reject.Code != "SPAM" {
+		t.Errorf("Se esperaba rechazo con código SPAM, se obtuvo %v", err)
+	}
+
+	err = hub.pipeline.Process(&MessageContext{Client: client, Message: NewMessage("testuser", "   ")})
+	if !errors.Is(err, ErrMessageDropped) {
+		t.Errorf("Se esperaba ErrMessageDropped para un mensaje vacío, se obtuvo %v", err)
+	}
+
+	image := &ImageData{Data: "no-es-data-url", Name: "x.png", Type: "image/png", Size: 10}
+	err = hub.pipeline.Process(&MessageContext{Client: client, Message: NewMessageWithImage("testuser", "", image)})
+	if !errors.As(err, &reject) || reject.Code != "INVALID_IMAGE" {
+		t.Errorf("Se esperaba rechazo INVALID_IMAGE, se obtuvo %v", err)
+	}
+}
+
+// TestContentFilter prueba los modos del filtro, la notificación a moderadores y la recarga
+func TestContentFilter(t *testing.T) {
+	path := t.TempDir() + "/filter.json"
+	writeRules := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Error escribiendo reglas: %v", err)
+		}
+	}
+
+	writeRules(`{"rules": [
+		{"name": "insultos", "mode": "mask", "words": ["Tonto"]},
+		{"name": "prohibido", "mode": "block", "pattern": "compra\\s+ya"},
+		{"name": "revisar", "mode": "flag", "words": ["whatsapp"]}
+	]}`)
+
+	filter, err := NewContentFilter(path)
+	if err != nil {
+		t.Fatalf("Error cargando filtro: %v", err)
+	}
+
+	hub := NewHub()
+	hub.contentFilter = filter
+	go hub.Run()
+
+	moderator := &Client{hub: hub, send: make(chan []byte, 10), username: "mod", role: RoleModerator}
+	author := &Client{hub: hub, send: make(chan []byte, 10), username: "ana", role: RoleUser}
+	hub.mu.Lock()
+	hub.clients[moderator] = true
+	hub.clients[author] = true
+	hub.mu.Unlock()
+
+	// El filtro va antes de los comandos: los bots reciben los argumentos ya filtrados
+	names := strings.Join(hub.pipeline.Names(), ",")
+	if strings.Index(names, "content-filter") > strings.Index(names, "commands") {
+		t.Errorf("content-filter debería ir antes de commands: %s", names)
+	}
+
+	// mask: solo se enmascara la palabra completa, sin distinguir mayúsculas
+	msg := NewMessage("ana", "eres TONTO, tontorrón")
+	if err := hub.pipeline.Process(&MessageContext{Client: author, Message: msg}); err != nil {
+		t.Fatalf("Un mensaje enmascarado no debería rechazarse: %v", err)
+	}
+	if msg.Content != "eres *****, tontorrón" {
+		t.Errorf("Enmascarado inesperado: '%s'", msg.Content)
+	}
+
+	select {
+	case notice := <-moderator.send:
+		var event ModerationEvent
+		json.Unmarshal(notice, &event)
+		if event.Action != "filtered" || event.Mode != FilterModeMask || event.Content != "eres TONTO, tontorrón" {
+			t.Errorf("Aviso de moderación inesperado: %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("El moderador no recibió el aviso")
+	}
+
+	select {
+	case notice := <-author.send:
+		t.Errorf("El autor no debería recibir avisos de moderación: %s", notice)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// block
+	var reject *RejectError
+	err = hub.pipeline.Process(&MessageContext{Client: author, Message: NewMessage("ana", "Compra   YA aquí")})
+	if !errors.As(err, &reject) || reject.Code != "CONTENT_BLOCKED" {
+		t.Errorf("Se esperaba CONTENT_BLOCKED, se obtuvo %v", err)
+	}
+
+	// flag: el mensaje pasa intacto
+	flagged := NewMessage("ana", "escríbeme por WhatsApp")
+	if err := hub.pipeline.Process(&MessageContext{Client: author, Message: flagged}); err != nil || flagged.Content != "escríbeme por WhatsApp" {
+		t.Errorf("Un mensaje marcado debería pasar intacto: '%s' err=%v", flagged.Content, err)
+	}
+
+	// Recarga en caliente: un archivo inválido conserva las reglas anteriores
+	writeRules(`{"rules": [{"mode": "desconocido", "words": ["x"]}]}`)
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	if _, err := filter.Reload(); err == nil {
+		t.Error("Se esperaba error al recargar reglas inválidas")
+	}
+	if filter.Check("tonto").Mode != FilterModeMask {
+		t.Error("Las reglas anteriores deberían conservarse tras un archivo inválido")
+	}
+
+	writeRules(`{"rules": [{"mode": "block", "words": ["nuevo"]}]}`)
+	os.Chtimes(path, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+	if reloaded, err := filter.Reload(); !reloaded || err != nil {
+		t.Fatalf("Se esperaba recarga, reloaded=%v err=%v", reloaded, err)
+	}
+	if filter.Check("tonto").Mode != "" || filter.Check("algo nuevo").Mode != FilterModeBlock {
+		t.Error("Las reglas no se actualizaron tras la recarga")
+	}
+}
+
+// TestSpamDetection prueba duplicados casi idénticos, enlaces, menciones y silencio automático
+func TestSpamDetection(t *testing.T) {
+	hub := NewHub()
+	config := DefaultSpamConfig()
+	config.Action = SpamActionMute
+	config.MaxLinks = 2
+	config.MaxMentions = 2
+	hub.spamDetector = NewSpamDetector(config)
+
+	now := time.Now()
+	hub.spamDetector.now = func() time.Time { return now }
+
+	newClient := func(username, ip string) *Client {
+		client := &Client{hub: hub, send: make(chan []byte, 10), username: username, role: RoleUser, ip: ip}
+		hub.userHistory[username] = &UserStatus{Username: username, Connected: true}
+		return client
+	}
+
+	process := func(client *Client, content string) error {
+		return hub.pipeline.Process(&MessageContext{Client: client, Message: NewMessage(client.username, content)})
+	}
+
+	// Duplicados casi idénticos del mismo usuario
+	ana := newClient("ana", "10.0.0.1")
+	for _, content := range []string{"Compra ahora!!!", "compra   ahora"} {
+		now = now.Add(time.Second)
+		if err := process(ana, content); err != nil {
+			t.Fatalf("Mensaje '%s' rechazado antes del umbral: %v", content, err)
+		}
+	}
+
+	var reject *RejectError
+	if err := process(ana, "COMPRA AHORA."); !errors.As(err, &reject) || reject.Code != "MUTED" {
+		t.Fatalf("Se esperaba silencio automático por duplicados, se obtuvo %v", err)
+	}
+
+	// Mientras dure el silencio se rechaza cualquier mensaje
+	if err := process(ana, "algo totalmente distinto"); !errors.As(err, &reject) || reject.Code != "MUTED" {
+		t.Errorf("Un usuario silenciado no debería poder escribir: %v", err)
+	}
+
+	now = now.Add(config.MuteDuration + time.Second)
+	if err := process(ana, "ya puedo escribir"); err != nil {
+		t.Errorf("El silencio debería haber expirado: %v", err)
+	}
+
+	// Menciones masivas
+	hub.spamDetector.config.Action = SpamActionWarn
+	luis := newClient("luis", "10.0.0.2")
+	if err := process(luis, "@a @b @c hola"); !errors.As(err, &reject) || reject.Code != "SPAM_DETECTED" {
+		t.Errorf("Se esperaba SPAM_DETECTED por menciones masivas, se obtuvo %v", err)
+	}
+
+	// Ráfaga de enlaces en la ventana
+	eva := newClient("eva", "10.0.0.3")
+	process(eva, "mira https://a.example")
+	process(eva, "y https://b.example")
+	if err := process(eva, "y también https://c.example"); !errors.As(err, &reject) || reject.Code != "SPAM_DETECTED" {
+		t.Errorf("Se esperaba SPAM_DETECTED por ráfaga de enlaces, se obtuvo %v", err)
+	}
+
+	// Mismo mensaje desde distintas cuentas en la misma IP
+	hub.spamDetector.config.Action = SpamActionDrop
+	for i, username := range []string{"multi1", "multi2", "multi3"} {
+		err := process(newClient(username, "10.0.0.9"), "únete a mi canal")
+		if i < 2 && err != nil {
+			t.Fatalf("Mensaje %d rechazado antes del umbral: %v", i, err)
+		}
+		if i == 2 && !errors.Is(err, ErrMessageDropped) {
+			t.Errorf("Se esperaba descarte por duplicados desde la misma IP, se obtuvo %v", err)
+		}
+	}
+
+	// X-Forwarded-For solo cuenta si la conexión llega de un proxy de confianza
+	proxies, err := ParseTrustedProxies("10.1.0.0/16, 192.168.1.5")
+	if err != nil {
+		t.Fatalf("Error interpretando proxies: %v", err)
+	}
+	if _, err := ParseTrustedProxies("no-es-una-ip"); err == nil {
+		t.Error("Se esperaba error con un proxy inválido")
+	}
+	previous := trustedProxies
+	trustedProxies = proxies
+	defer func() { trustedProxies = previous }()
+
+	for _, tc := range []struct {
+		remoteAddr, forwarded, want string
+	}{
+		{"203.0.113.7:5000", "1.2.3.4", "203.0.113.7"},                 // cliente directo: se ignora la cabecera
+		{"10.1.0.3:5000", "", "10.1.0.3"},                              // proxy sin cabecera
+		{"10.1.0.3:5000", "6.6.6.6, 198.51.100.2", "198.51.100.2"},     // el primer salto lo inventa el cliente
+		{"10.1.0.3:5000", "198.51.100.2, 192.168.1.5", "198.51.100.2"}, // se saltan los proxies de confianza
+		{"10.1.0.3:5000", "198.51.100.2, basura", "10.1.0.3"},          // cabecera corrupta
+		{"192.168.1.5:5000", "10.1.0.8, 10.1.0.9", "192.168.1.5"},      // todo son proxies
+	} {
+		r := httptest.NewRequest("GET", "/ws", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := clientIP(r); got != tc.want {
+			t.Errorf("clientIP(%s, %q) = %s, se esperaba %s", tc.remoteAddr, tc.forwarded, got, tc.want)
+		}
+	}
+}
+
+// TestAccountsAndSessions prueba registro, login y la exigencia de token para nombres registrados
+func TestAccountsAndSessions(t *testing.T) {
+	accounts, err := NewAccountStore(t.TempDir() + "/accounts.json")
+	if err != nil {
+		t.Fatalf("Error creando almacén de cuentas: %v", err)
+	}
+	accounts.cost = 4 // bcrypt.MinCost para que el test sea rápido
+
+	hub := NewHub()
+	hub.auth = NewAuthService(accounts, NewTokenSigner([]byte("secreto"), time.Hour), true, "guest-")
+	go hub.Run()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/register", hub.auth.serveRegister)
+	mux.HandleFunc("/api/login", hub.auth.serveLogin)
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) { serveWS(hub, w, r) })
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	postCredentials := func(path, username, password string) (int, map[string]interface{}) {
+		body, _ := json.Marshal(map[string]string{"username": username, "password": password})
+		resp, err := http.Post(server.URL+path, "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatalf("Error en POST %s: %v", path, err)
+		}
+		defer resp.Body.Close()
+
+		var session map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&session)
+		return resp.StatusCode, session
+	}
+
+	if code, _ := postCredentials("/api/register", "ana", "corta"); code != http.StatusBadRequest {
+		t.Errorf("Se esperaba 400 para una contraseña corta, se obtuvo %d", code)
+	}
+
+	if code, _ := postCredentials("/api/register", "guest-ana", "contraseña-larga"); code != http.StatusBadRequest {
+		t.Errorf("Se esperaba 400 para un nombre con prefijo de invitado, se obtuvo %d", code)
+	}
+
+	code, session := postCredentials("/api/register", "ana", "contraseña-larga")
+	if code != http.StatusCreated || session["token"] == nil {
+		t.Fatalf("Registro fallido: %d %v", code, session)
+	}
+
+	if code, _ := postCredentials("/api/register", "ana", "otra-contraseña"); code != http.StatusConflict {
+		t.Errorf("Se esperaba 409 al registrar un nombre existente, se obtuvo %d", code)
+	}
+
+	if code, _ := postCredentials("/api/login", "ana", "incorrecta"); code != http.StatusUnauthorized {
+		t.Errorf("Se esperaba 401 con contraseña incorrecta, se obtuvo %d", code)
+	}
+
+	code, session = postCredentials("/api/login", "ana", "contraseña-larga")
+	if code != http.StatusOK {
+		t.Fatalf("Login fallido: %d", code)
+	}
+	token := session["token"].(string)
+
+	// El 401 no distingue entre usuario inexistente y contraseña incorrecta
+	for _, username := range []string{"ana", "nadie"} {
+		resp, err := http.Post(server.URL+"/api/login", "application/json",
+			strings.NewReader(`{"username": "`+username+`", "password": "incorrecta"}`))
+		if err != nil {
+			t.Fatalf("Error en login: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.TrimSpace(string(body)) != ErrInvalidCredentials.Error() {
+			t.Errorf("Se esperaba el mensaje genérico para '%s', se obtuvo %q", username, body)
+		}
+	}
+
+	// Límite de intentos por IP en registro y login
+	hub.auth.limiter = NewIPLimiter(2, time.Minute)
+	postCredentials("/api/login", "ana", "incorrecta")
+	postCredentials("/api/register", "eva", "contraseña-larga")
+	if code, _ := postCredentials("/api/login", "ana", "contraseña-larga"); code != http.StatusTooManyRequests {
+		t.Errorf("Se esperaba 429 al superar el límite de intentos, se obtuvo %d", code)
+	}
+	hub.auth.limiter = nil
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	// Suplantación: un nombre registrado no se puede usar sin token
+	if _, resp, err := websocket.DefaultDialer.Dial(wsURL+"?username=ana", nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatal("Un nombre registrado no debería poder usarse sin token")
+	}
+
+	tamperedDialer := websocket.Dialer{Subprotocols: []string{"bearer", token + "x"}}
+	_, resp, err := tamperedDialer.Dial(wsURL, nil)
+	if err == nil {
+		t.Fatal("Un token manipulado no debería aceptarse")
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "Token inválido" {
+		t.Errorf("El 401 no debería dar detalles del error, se obtuvo %q", body)
+	}
+
+	// El token en la URL se ignora: acabaría en logs y en el historial del navegador
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=ana&token="+token, nil); err == nil {
+		t.Fatal("No debería aceptarse el token en ?token=")
+	}
+
+	readSuccess := func(conn *websocket.Conn) string {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("No se recibió connectionSuccess: %v", err)
+			}
+			if msg["type"] == "connectionSuccess" {
+				return msg["username"].(string)
+			}
+		}
+	}
+
+	anaDialer := websocket.Dialer{Subprotocols: []string{"bearer", token}}
+	anaConn, _, err := anaDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Error conectando con token: %v", err)
+	}
+	defer anaConn.Close()
+	if username := readSuccess(anaConn); username != "ana" {
+		t.Errorf("Se esperaba conectar como 'ana', se obtuvo '%s'", username)
+	}
+
+	// Sin token y con un nombre libre se entra como invitado con prefijo
+	guestConn, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=luis", nil)
+	if err != nil {
+		t.Fatalf("Error conectando como invitado: %v", err)
+	}
+	defer guestConn.Close()
+	if username := readSuccess(guestConn); username != "guest-luis" {
+		t.Errorf("Se esperaba el nombre de invitado 'guest-luis', se obtuvo '%s'", username)
+	}
+
+	// Tokens expirados
+	expired := NewTokenSigner([]byte("secreto"), -time.Minute)
+	expiredToken, _ := expired.Sign("ana", RoleUser)
+	if _, err := hub.auth.signer.Verify(expiredToken); !errors.Is(err, ErrExpiredToken) {
+		t.Errorf("Se esperaba ErrExpiredToken, se obtuvo %v", err)
+	}
+}
+
+// signTestJWT firma un JWT con las claims indicadas (HS256 con secreto o RS256 con clave privada)
+func signTestJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		signature = hmacSHA256(k, signingInput)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("Error firmando JWT: %v", err)
+		}
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestSSOHandshake prueba la autenticación con JWT del SSO en el handshake de /ws
+func TestSSOHandshake(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generando clave RSA: %v", err)
+	}
+	publicDER, _ := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+
+	verifier, err := NewRSAVerifier(publicPEM)
+	if err != nil {
+		t.Fatalf("Error creando verificador RSA: %v", err)
+	}
+	verifier.Issuer = "https://sso.example.com"
+	verifier.ModeratorRoles = []string{"chat-moderators"}
+
+	hub := NewHub()
+	hub.sso = verifier
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":                "u-123",
+			"preferred_username": "marta",
+			"roles":              []string{"staff", "chat-moderators"},
+			"iss":                "https://sso.example.com",
+			"exp":                time.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	// Token válido enviado como subprotocolo (lo que puede hacer un navegador)
+	token := signTestJWT(t, JWTAlgRS256, privateKey, validClaims())
+	dialer := websocket.Dialer{Subprotocols: []string{"bearer", token}}
+	conn, resp, err := dialer.Dial(wsURL+"?username=otro", nil)
+	if err != nil {
+		t.Fatalf("Error conectando con JWT del SSO: %v", err)
+	}
+	defer conn.Close()
+
+	if resp.Header.Get("Sec-Websocket-Protocol") != "bearer" {
+		t.Errorf("El servidor debería confirmar el subprotocolo 'bearer', se obtuvo '%s'", resp.Header.Get("Sec-Websocket-Protocol"))
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var welcome map[string]interface{}
+	if err := conn.ReadJSON(&welcome); err != nil || welcome["username"] != "marta" {
+		t.Errorf("Se esperaba conectar como 'marta' (claim preferred_username), se obtuvo %v (%v)", welcome["username"], err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	hub.mu.RLock()
+	for client := range hub.clients {
+		if client.username == "marta" && client.role != RoleModerator {
+			t.Errorf("Se esperaba rol moderator a partir de las claims, se obtuvo '%s'", client.role)
+		}
+	}
+	hub.mu.RUnlock()
+
+	rejected := map[string]string{}
+
+	expired := validClaims()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	rejected["caducado"] = signTestJWT(t, JWTAlgRS256, privateKey, expired)
+
+	wrongIssuer := validClaims()
+	wrongIssuer["iss"] = "https://otro.example.com"
+	rejected["emisor incorrecto"] = signTestJWT(t, JWTAlgRS256, privateKey, wrongIssuer)
+
+	// Confusión de algoritmo: HS256 firmado con la clave pública como secreto
+	rejected["alg HS256"] = signTestJWT(t, JWTAlgHS256, publicPEM, validClaims())
+
+	for name, badToken := range rejected {
+		dialer := websocket.Dialer{Subprotocols: []string{"bearer", badToken}}
+		_, resp, err := dialer.Dial(wsURL, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Token %s: se esperaba 401 antes del upgrade", name)
+		}
+	}
+
+	// Token HMAC leído desde la cookie
+	hub.sso = NewHMACVerifier([]byte("secreto-sso"))
+	cookieToken := signTestJWT(t, JWTAlgHS256, []byte("secreto-sso"), map[string]interface{}{
+		"sub": "pablo",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	header := http.Header{"Cookie": {tokenCookieName + "=" + cookieToken}}
+	cookieConn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		t.Fatalf("Error conectando con token en cookie: %v", err)
+	}
+	defer cookieConn.Close()
+
+	cookieConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var cookieWelcome map[string]interface{}
+	if err := cookieConn.ReadJSON(&cookieWelcome); err != nil || cookieWelcome["username"] != "pablo" {
+		t.Errorf("Se esperaba conectar como 'pablo' (claim sub), se obtuvo %v (%v)", cookieWelcome["username"], err)
+	}
+}
+
+// TestOriginPolicy prueba la lista de orígenes permitidos para el WebSocket
+func TestOriginPolicy(t *testing.T) {
+	policy := NewOriginPolicy([]string{"https://portal.example.com", "*.intranet.example.com", "localhost:3000"})
+
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},                                  // Sin Origin: bots y scripts
+		{"http://chat.local:8080", true},            // Mismo origen
+		{"https://portal.example.com", true},        // Origen exacto
+		{"http://portal.example.com", false},        // Esquema distinto
+		{"https://wiki.intranet.example.com", true}, // Subdominio comodín
+		{"https://intranet.example.com", false},     // El comodín no incluye el dominio raíz
+		{"https://evil-intranet.example.com", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:4000", false},
+		{"https://evil.com", false},
+		{"null", false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "http://chat.local:8080/ws", nil)
+		if c.origin != "" {
+			r.Header.Set("Origin", c.origin)
+		}
+		if got := policy.Check(r); got != c.allowed {
+			t.Errorf("Origen '%s': se esperaba %v, se obtuvo %v", c.origin, c.allowed, got)
+		}
+	}
+
+	// Sin política solo se permite el mismo origen; con "*" cualquiera
+	r := httptest.NewRequest("GET", "http://chat.local:8080/ws", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	var none *OriginPolicy
+	if none.Check(r) {
+		t.Error("Sin política configurada no debería permitirse otro origen")
+	}
+	if !NewOriginPolicy([]string{"*"}).Check(r) {
+		t.Error("El modo permisivo debería aceptar cualquier origen")
+	}
+
+	// El handshake se rechaza con 403 antes de autenticar
+	hub := NewHub()
+	go hub.Run()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?username=ana"
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.com"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Error("Se esperaba 403 para un origen no permitido")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {server.URL}})
+	if err != nil {
+		t.Fatalf("El mismo origen debería aceptarse: %v", err)
+	}
+	conn.Close()
+}
+
+// writeTestCertificate genera un certificado autofirmado para localhost en los archivos indicados
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generando clave: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creando certificado: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
+
+// TestTLSCertificateReload prueba que el certificado se recarga al cambiar en disco
+func TestTLSCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/cert.pem", dir+"/key.pem"
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Error cargando certificado: %v", err)
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", newTLSConfig(certs))
+	if err != nil {
+		t.Fatalf("Error abriendo listener TLS: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	servedSerial := func() int64 {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("Error en el handshake TLS: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	if serial := servedSerial(); serial != 1 {
+		t.Fatalf("Se esperaba el certificado 1, se obtuvo %d", serial)
+	}
+
+	// Sin cambios en disco no se recarga
+	if reloaded, _ := certs.Reload(); reloaded {
+		t.Error("No debería recargarse si los archivos no cambiaron")
+	}
+
+	// Un par inválido conserva el certificado anterior
+	os.WriteFile(keyFile, []byte("basura"), 0o600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+	if _, err := certs.Reload(); err == nil {
+		t.Error("Se esperaba error al recargar una clave inválida")
+	}
+	if serial := servedSerial(); serial != 1 {
+		t.Errorf("Tras un par inválido debería seguir el certificado 1, se obtuvo %d", serial)
+	}
+
+	writeTestCertificate(t, certFile, keyFile, 2)
+	future = future.Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+	if reloaded, err := certs.Reload(); !reloaded || err != nil {
+		t.Fatalf("Se esperaba recargar el certificado nuevo: %v", err)
+	}
+	if serial := servedSerial(); serial != 2 {
+		t.Errorf("Se esperaba el certificado 2 tras recargar, se obtuvo %d", serial)
+	}
+
+	// Redirección HTTP→HTTPS
+	recorder := httptest.NewRecorder()
+	httpsRedirectHandler("8443").ServeHTTP(recorder, httptest.NewRequest("GET", "http://chat.example.com/ws?username=ana", nil))
+	if location := recorder.Header().Get("Location"); recorder.Code != http.StatusMovedPermanently || location != "https://chat.example.com:8443/ws?username=ana" {
+		t.Errorf("Redirección inesperada: %d %s", recorder.Code, location)
+	}
+
+	// El listener de redirección se apaga junto al servidor principal
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error reservando puerto: %v", err)
+	}
+	redirectAddr := free.Addr().String()
+	free.Close()
+
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_REDIRECT_ADDR", redirectAddr)
+	_, redirect := configureTLS("8443")
+	if redirect == nil {
+		t.Fatal("Se esperaba el servidor de redirección")
+	}
+
+	listening := func() bool {
+		conn, err := net.DialTimeout("tcp", redirectAddr, 100*time.Millisecond)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for !listening() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !listening() {
+		t.Fatal("El listener de redirección no arrancó")
+	}
+
+	hub := NewHub()
+	go hub.Run()
+	gracefulShutdown([]*http.Server{redirect}, hub, "", time.Second)
+	if listening() {
+		t.Error("El listener de redirección debería cerrarse al apagar")
+	}
+}
+
+// TestGracefulShutdown prueba el aviso, el cierre 1001 y la persistencia del historial al apagar
+func TestGracefulShutdown(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=ana", nil)
+	if err != nil {
+		t.Fatalf("Error conectando: %v", err)
+	}
+	defer conn.Close()
+
+	// Una conexión rechazada por nombre en uso recibe el error y el cierre enseguida,
+	// sin dejar una conexión abierta que retrase el apagado
+	duplicate, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=ana", nil)
+	if err != nil {
+		t.Fatalf("Error conectando el duplicado: %v", err)
+	}
+	defer duplicate.Close()
+	duplicate.SetReadDeadline(time.Now().Add(time.Second))
+	gotTaken := false
+	for {
+		var msg map[string]interface{}
+		if err := duplicate.ReadJSON(&msg); err != nil {
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("Se esperaba un cierre 1008 para el nombre en uso, se obtuvo: %v", err)
+			}
+			break
+		}
+		gotTaken = gotTaken || msg["code"] == "USERNAME_TAKEN"
+	}
+	if !gotTaken {
+		t.Error("La conexión duplicada no recibió USERNAME_TAKEN")
+	}
+
+	conn.WriteJSON(map[string]string{"content": "hola antes del reinicio"})
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- hub.Shutdown(ctx, "reiniciando") }()
+
+	// El cliente recibe el aviso y después un cierre 1001
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	gotNotice := false
+	for {
+		var msg map[string]interface{}
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Errorf("Se esperaba un cierre 1001, se obtuvo: %v", err)
+			}
+			break
+		}
+		if msg["type"] == MessageTypeSystem && msg["content"] == "reiniciando" {
+			gotNotice = true
+		}
+	}
+	if !gotNotice {
+		t.Error("El cliente no recibió el aviso de reinicio")
+	}
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Shutdown no terminó a tiempo: %v", err)
+	}
+
+	// Las conexiones nuevas se rechazan durante el apagado
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL+"?username=luis", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error("Se esperaba 503 para conexiones nuevas durante el apagado")
+	}
+
+	// El historial sobrevive al reinicio
+	path := t.TempDir() + "/history.json"
+	if err := hub.SaveHistory(path); err != nil {
+		t.Fatalf("Error guardando historial: %v", err)
+	}
+
+	restored := NewHub()
+	if err := restored.LoadHistory(path); err != nil {
+		t.Fatalf("Error restaurando historial: %v", err)
+	}
+	if len(restored.messageHistory) != 1 || restored.messageHistory[0].Content != "hola antes del reinicio" {
+		t.Errorf("Historial restaurado inesperado: %+v", restored.messageHistory)
+	}
+}
+
+// TestMetricsEndpoint prueba las métricas expuestas en formato Prometheus
+func TestMetricsEndpoint(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// Un handshake fallido y una conexión válida que envía un mensaje
+	websocket.DefaultDialer.Dial(wsURL+"?username=x", nil)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=ana", nil)
+	if err != nil {
+		t.Fatalf("Error conectando: %v", err)
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]string{"content": "hola"})
+	time.Sleep(100 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	serveMetrics(hub, recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+
+	expected := []string{
+		"# TYPE chat_connected_clients gauge",
+		"chat_connected_clients 1",
+		`chat_messages_total{type="message"} 1`,
+		`chat_messages_total{type="join"} 1`,
+		`chat_handshake_failures_total{reason="username_invalid"} 1`,
+		"# TYPE chat_hub_loop_latency_seconds histogram",
+		`chat_hub_loop_latency_seconds_bucket{event="broadcast",le="+Inf"}`,
+		`chat_hub_loop_latency_seconds_count{event="register"} 1`,
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Falta la línea '%s' en /metrics:\n%s", line, body)
+		}
+	}
+}
+
+// TestHealthEndpoints prueba /healthz y /readyz
+func TestHealthEndpoints(t *testing.T) {
+	hub := NewHub()
+	store, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creando almacén: %v", err)
+	}
+	hub.SetAttachmentStore(store)
+
+	check := func(handler func(*Hub, http.ResponseWriter, *http.Request)) (int, map[string]interface{}) {
+		recorder := httptest.NewRecorder()
+		handler(hub, recorder, httptest.NewRequest("GET", "/", nil))
+
+		var body map[string]interface{}
+		json.Unmarshal(recorder.Body.Bytes(), &body)
+		return recorder.Code, body
+	}
+
+	// Sin el loop del hub en marcha /healthz debe fallar (no responde al ping)
+	if code, body := check(serveHealthz); code != http.StatusServiceUnavailable {
+		t.Errorf("Se esperaba 503 con el hub parado, se obtuvo %d: %v", code, body)
+	}
+
+	go hub.Run()
+
+	if code, body := check(serveHealthz); code != http.StatusOK || body["hub"] != "ok" {
+		t.Errorf("Se esperaba /healthz 200, se obtuvo %d: %v", code, body)
+	}
+
+	code, body := check(serveReadyz)
+	if code != http.StatusOK {
+		t.Errorf("Se esperaba /readyz 200, se obtuvo %d: %v", code, body)
+	}
+	if checks, _ := body["checks"].(map[string]interface{}); checks["attachments"] != "ok" {
+		t.Errorf("Se esperaba comprobar el almacén de adjuntos: %v", body)
+	}
+
+	// Durante el apagado deja de estar listo
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	hub.Shutdown(ctx, "reiniciando")
+
+	if code, _ := check(serveReadyz); code != http.StatusServiceUnavailable {
+		t.Errorf("Se esperaba /readyz 503 durante el apagado, se obtuvo %d", code)
+	}
+}
+
+// TestStructuredLogging prueba el formato JSON, el interruptor de privacidad y el ID de petición
+func TestStructuredLogging(t *testing.T) {
+	var buf strings.Builder
+	previous := slog.Default()
+	slog.SetDefault(slog.New(newLogHandler(&buf, "json", "debug")))
+	defer slog.SetDefault(previous)
+
+	defer func(original bool) { logMessageContent = original }(logMessageContent)
+
+	logMessageContent = false
+	slog.Info("mensaje de texto", contentAttr("contraseña secreta"))
+	logMessageContent = true
+	slog.Info("mensaje de texto", contentAttr("hola"))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Se esperaban 2 líneas de log, se obtuvieron %d: %s", len(lines), buf.String())
+	}
+
+	var private, public map[string]interface{}
+	json.Unmarshal([]byte(lines[0]), &private)
+	json.Unmarshal([]byte(lines[1]), &public)
+
+	if _, leaked := private["content"]; leaked || private["contentLength"] != float64(len("contraseña secreta")) {
+		t.Errorf("Con la privacidad activa solo debería registrarse la longitud: %s", lines[0])
+	}
+	if public["content"] != "hola" {
+		t.Errorf("Con LOG_MESSAGE_CONTENT=true debería registrarse el texto: %s", lines[1])
+	}
+
+	// Nivel configurable: con warn no salen los info
+	buf.Reset()
+	slog.SetDefault(slog.New(newLogHandler(&buf, "text", "warn")))
+	slog.Info("no debería aparecer")
+	if buf.Len() != 0 {
+		t.Errorf("Con LOG_LEVEL=warn no deberían registrarse mensajes info: %s", buf.String())
+	}
+
+	// Cada petición recibe un X-Request-ID y un logger que lo incluye
+	buf.Reset()
+	slog.SetDefault(slog.New(newLogHandler(&buf, "json", "info")))
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestLogger(r).Info("dentro de la petición")
+	}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+
+	requestID := recorder.Header().Get(requestIDHeader)
+	if requestID == "" || !strings.Contains(buf.String(), `"requestId":"`+requestID+`"`) {
+		t.Errorf("El log debería incluir el ID de petición '%s': %s", requestID, buf.String())
+	}
+}
+
+// TestConfiguration prueba la carga de configuración: archivo, entorno, flags y validación
+func TestConfiguration(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("La configuración por defecto debería ser válida: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "chat.yaml")
+	os.WriteFile(path, []byte("writeWait: 5s\nmaxImageSize: 1048576\nmaxHistorySize: 10\nallowedImageTypes: [image/png]\nclientSendBuffer: 8\n"), 0o600)
+
+	// Prioridad: flags > entorno > archivo > valores por defecto
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("MAX_HISTORY_SIZE", "20")
+	t.Setenv("PONG_WAIT", "30s")
+	cfg, err := LoadConfig([]string{"-pong-wait", "45s"})
+	if err != nil {
+		t.Fatalf("Error cargando configuración: %v", err)
+	}
+	if cfg.WriteWait != 5*time.Second || cfg.MaxImageSize != 1048576 || cfg.ClientSendBuffer != 8 {
+		t.Errorf("No se aplicó el archivo: %+v", cfg)
+	}
+	if cfg.MaxHistorySize != 20 {
+		t.Errorf("La variable de entorno debería sobrescribir el archivo, se obtuvo %d", cfg.MaxHistorySize)
+	}
+	if cfg.PongWait != 45*time.Second || cfg.PingPeriod() != 40500*time.Millisecond {
+		t.Errorf("El flag debería sobrescribir el entorno, se obtuvo %v", cfg.PongWait)
+	}
+	if cfg.MaxMessageSize != DefaultConfig().MaxMessageSize {
+		t.Errorf("Los ajustes no configurados deberían mantener su valor por defecto")
+	}
+
+	// Los límites se aplican al hub y a la validación de imágenes
+	hub := NewHubWithConfig(cfg)
+	client := &Client{hub: hub, username: "ana"}
+	if hub.maxHistorySize != 20 || cap(hub.broadcast) != cfg.BroadcastBuffer {
+		t.Errorf("El hub no usa la configuración: historial %d, buffer %d", hub.maxHistorySize, cap(hub.broadcast))
+	}
+	if client.isValidImage(&ImageData{Data: "data:image/gif;base64,x", Name: "a.gif", Type: "image/gif", Size: 10}) {
+		t.Error("image/gif no está en allowedImageTypes y debería rechazarse")
+	}
+	if client.isValidImage(&ImageData{Data: "data:image/png;base64," + strings.Repeat("A", 4*1024*1024), Name: "a.png", Type: "image/png", Size: 10}) {
+		t.Error("Una imagen mayor que maxImageSize debería rechazarse")
+	}
+
+	// Valores inválidos: errores de formato, validación y campos desconocidos
+	t.Setenv("PONG_WAIT", "")
+	if _, err := LoadConfig([]string{"-write-wait", "pronto"}); err == nil {
+		t.Error("Una duración inválida debería fallar")
+	}
+	if _, err := LoadConfig([]string{"-max-image-size", "20000000"}); err == nil {
+		t.Error("maxImageSize mayor que maxMessageSize debería fallar la validación")
+	}
+	os.WriteFile(path, []byte(`{"maxHistorySise": 10}`), 0o600)
+	if _, err := LoadConfig(nil); err == nil || !strings.Contains(err.Error(), "maxHistorySise") {
+		t.Errorf("Un campo desconocido debería fallar, se obtuvo %v", err)
+	}
+
+	// El endpoint de administración muestra la configuración efectiva
+	recorder := httptest.NewRecorder()
+	serveConfigAdmin(cfg, recorder, httptest.NewRequest("GET", "/api/admin/config", nil))
+	var body map[string]interface{}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	if recorder.Code != http.StatusOK || body["pongWait"] != "45s" || body["source"] != path {
+		t.Errorf("Respuesta inesperada de /api/admin/config: %d %v", recorder.Code, body)
+	}
+}
+
+// startFakeRedis arranca un servidor que imita a Redis para los comandos que usa
+// RedisBackplane (PING, AUTH, SELECT, EVAL de sus scripts, PUBLISH, SUBSCRIBE)
+func startFakeRedis(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error arrancando Redis de prueba: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	type subscriber struct {
+		conn net.Conn
+		mu   *sync.Mutex
+	}
+	var (
+		mu          sync.Mutex
+		keys        = map[string]string{}
+		expires     = map[string]time.Time{}
+		subscribers = map[string][]subscriber{}
+	)
+
+	bulk := func(value string) string { return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value) }
+	get := func(key string) (string, bool) {
+		if deadline, ok := expires[key]; ok && time.Now().After(deadline) {
+			delete(keys, key)
+			delete(expires, key)
+		}
+		value, ok := keys[key]
+		return value, ok
+	}
+
+	handle := func(conn net.Conn) {
+		defer conn.Close()
+		reader := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+		writeMu := &sync.Mutex{}
+		write := func(reply string) {
+			writeMu.Lock()
+			io.WriteString(conn, reply)
+			writeMu.Unlock()
+		}
+
+		for {
+			request, err := reader.read()
+			if err != nil {
+				return
+			}
+			items, _ := request.([]interface{})
+			args := make([]string, len(items))
+			for i, item := range items {
+				args[i], _ = item.(string)
+			}
+			if len(args) == 0 {
+				continue
+			}
+
+			mu.Lock()
+			switch strings.ToUpper(args[0]) {
+			case "PING":
+				write("+PONG\r\n")
+			case "AUTH", "SELECT":
+				write("+OK\r\n")
+			case "EVAL":
+				// Los scripts de reservas de nombres, reproducidos en Go
+				numKeys, _ := strconv.Atoi(args[2])
+				keyArgs, scriptArgs := args[3:3+numKeys], args[3+numKeys:]
+				switch args[1] {
+				case claimUsernameScript, refreshUsernamesScript:
+					ms, _ := strconv.Atoi(scriptArgs[1])
+					var taken []string
+					for _, key := range keyArgs {
+						owner, exists := get(key)
+						if exists && owner != scriptArgs[0] {
+							taken = append(taken, key)
+							continue
+						}
+						keys[key] = scriptArgs[0]
+						expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+					}
+					if args[1] == claimUsernameScript {
+						if len(taken) == 0 {
+							write(":1\r\n")
+						} else {
+							write(":0\r\n")
+						}
+						break
+					}
+					reply := fmt.Sprintf("*%d\r\n", len(taken))
+					for _, key := range taken {
+						reply += bulk(key)
+					}
+					write(reply)
+				case releaseUsernameScript:
+					if owner, exists := get(keyArgs[0]); exists && owner == scriptArgs[0] {
+						delete(keys, keyArgs[0])
+						delete(expires, keyArgs[0])
+						write(":1\r\n")
+					} else {
+						write(":0\r\n")
+					}
+				default:
+					write("-ERR script no soportado\r\n")
+				}
+			case "SUBSCRIBE":
+				subscribers[args[1]] = append(subscribers[args[1]], subscriber{conn, writeMu})
+				write("*3\r\n" + bulk("subscribe") + bulk(args[1]) + ":1\r\n")
+			case "PUBLISH":
+				for _, sub := range subscribers[args[1]] {
+					sub.mu.Lock()
+					io.WriteString(sub.conn, "*3\r\n"+bulk("message")+bulk(args[1])+bulk(args[2]))
+					sub.mu.Unlock()
+				}
+				write(fmt.Sprintf(":%d\r\n", len(subscribers[args[1]])))
+			default:
+				write("-ERR comando no soportado\r\n")
+			}
+			mu.Unlock()
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return "redis://:secreto@" + listener.Addr().String() + "/1"
+}
+
+// TestClusterBackplane prueba dos nodos conectados por el backplane en memoria y por Redis
+func TestClusterBackplane(t *testing.T) {
+	readUntil := func(conn *websocket.Conn, msgType string, match func(map[string]interface{}) bool) map[string]interface{} {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("No se recibió mensaje de tipo '%s': %v", msgType, err)
+			}
+			if msg["type"] == msgType && (match == nil || match(msg)) {
+				return msg
+			}
+		}
+	}
+
+	runCluster := func(t *testing.T, backplaneA, backplaneB Backplane) {
+		startNode := func(backplane Backplane) (*Hub, string) {
+			hub := NewHub()
+			if err := hub.SetBackplane(backplane); err != nil {
+				t.Fatalf("Error suscribiendo al backplane: %v", err)
+			}
+			go hub.Run()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				serveWS(hub, w, r)
+			}))
+			t.Cleanup(server.Close)
+			return hub, "ws" + strings.TrimPrefix(server.URL, "http")
+		}
+		hubA, urlA := startNode(backplaneA)
+		hubB, urlB := startNode(backplaneB)
+
+		connect := func(wsURL, username string) *websocket.Conn {
+			conn, _, err := websocket.DefaultDialer.Dial(wsURL+"?username="+username, nil)
+			if err != nil {
+				t.Fatalf("Error conectando %s: %v", username, err)
+			}
+			t.Cleanup(func() { conn.Close() })
+			return conn
+		}
+
+		ana := connect(urlA, "ana")
+		readUntil(ana, "connectionSuccess", nil)
+
+		// El nombre está reservado en todo el clúster
+		duplicate := connect(urlB, "ana")
+		if errMsg := readUntil(duplicate, "error", nil); errMsg["code"] != "USERNAME_TAKEN" {
+			t.Errorf("Se esperaba USERNAME_TAKEN en el otro nodo, se obtuvo %v", errMsg)
+		}
+
+		beto := connect(urlB, "beto")
+		readUntil(beto, "connectionSuccess", nil)
+
+		// La presencia de otros nodos aparece en la lista de usuarios
+		readUntil(beto, "userList", func(msg map[string]interface{}) bool {
+			users, _ := msg["users"].([]interface{})
+			for _, user := range users {
+				if u, _ := user.(map[string]interface{}); u["username"] == "ana" && u["connected"] == true {
+					return true
+				}
+			}
+			return false
+		})
+
+		// Los mensajes llegan a los clientes de todos los nodos
+		ana.WriteJSON(map[string]interface{}{"content": "hola desde A"})
+		msg := readUntil(beto, MessageTypeMessage, nil)
+		if msg["content"] != "hola desde A" || msg["username"] != "ana" {
+			t.Errorf("Mensaje inesperado en el nodo B: %v", msg)
+		}
+
+		// Los avisos de moderación llegan a los moderadores de otros nodos
+		moderator := &Client{hub: hubB, send: make(chan []byte, 32), username: "mod", role: RoleModerator}
+		hubB.register <- moderator
+		time.Sleep(50 * time.Millisecond)
+		hubA.notifyModerators(&ModerationEvent{Type: "moderation", Action: "filtered", Username: "ana", Timestamp: time.Now()})
+		deadline := time.After(2 * time.Second)
+		for received := false; !received; {
+			select {
+			case data := <-moderator.send:
+				received = strings.Contains(string(data), `"type":"moderation"`)
+			case <-deadline:
+				t.Fatal("El moderador del nodo B no recibió el aviso de moderación")
+			}
+		}
+
+		// Al desconectarse, el nombre vuelve a estar libre en todo el clúster
+		ana.Close()
+		for i := 0; i < 50 && hubA.GetClientCount() > 0; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		again := connect(urlB, "ana")
+		readUntil(again, "connectionSuccess", nil)
+	}
+
+	t.Run("memoria", func(t *testing.T) {
+		bus := NewMemoryBus()
+		runCluster(t, bus.Join("a"), bus.Join("b"))
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		redisURL := startFakeRedis(t)
+		backplanes := make([]Backplane, 2)
+		for i, node := range []string{"a", "b"} {
+			backplane, err := NewRedisBackplane(redisURL, node, "chat-test")
+			if err != nil {
+				t.Fatalf("Error conectando a Redis de prueba: %v", err)
+			}
+			t.Cleanup(func() { backplane.Close() })
+			backplanes[i] = backplane
+		}
+		runCluster(t, backplanes[0], backplanes[1])
+
+		// Liberar solo borra la reserva propia (compare-and-delete atómico)
+		a, b := backplanes[0], backplanes[1]
+		if claimed, err := a.ClaimUsername("zoe"); !claimed || err != nil {
+			t.Fatalf("El nodo A debería reservar 'zoe': %v", err)
+		}
+		b.ReleaseUsername("zoe")
+		if claimed, _ := b.ClaimUsername("zoe"); claimed {
+			t.Error("El nodo B no debería poder liberar ni reservar el nombre del nodo A")
+		}
+
+		// La renovación recupera las reservas propias y respeta las ajenas
+		if err := b.RefreshUsernames([]string{"zoe", "lia"}); err != nil {
+			t.Fatalf("Error renovando nombres: %v", err)
+		}
+		if claimed, _ := a.ClaimUsername("lia"); claimed {
+			t.Error("La renovación del nodo B debería haber reservado 'lia'")
+		}
+		if claimed, _ := a.ClaimUsername("zoe"); !claimed {
+			t.Error("La renovación del nodo B no debería quitar 'zoe' al nodo A")
+		}
+		a.ReleaseUsername("zoe")
+		if claimed, _ := b.ClaimUsername("zoe"); !claimed {
+			t.Error("Tras liberarlo el nodo A, 'zoe' debería quedar libre")
+		}
+	})
+}
+
+// TestTypedEvents prueba que los eventos viajen tipados por el hub, se serialicen
+// una vez por codificación y que el esquema se pueda consultar
+func TestTypedEvents(t *testing.T) {
+	// Cada codificación se genera una sola vez y se comparte entre clientes
+	wire := newWireEvent(NewMessage("ana", "hola"))
+	first, err := wire.encode(EncodingJSON)
+	second, _ := wire.encode(EncodingJSON)
+	if err != nil || &first[0] != &second[0] {
+		t.Errorf("El JSON de un evento debería generarse una sola vez (err=%v)", err)
+	}
+
+	// Los eventos de otros nodos se reconstruyen con su tipo Go
+	for _, event := range []Event{
+		NewMessage("ana", "hola"),
+		NewErrorEvent("SPAM", "no"),
+		&ReactionEvent{Type: EventTypeReaction, MessageID: "m1", Emoji: "👍", Username: "bot"},
+		&UserListEvent{Type: EventTypeUserList, Users: []*UserStatus{{Username: "ana", Connected: true}}},
+	} {
+		data, _ := encodeEvent(event, EncodingJSON)
+		decoded, err := decodeEvent(data)
+		if err != nil || reflect.TypeOf(decoded) != reflect.TypeOf(event) || decoded.EventType() != event.EventType() {
+			t.Errorf("Evento %s decodificado como %T (err=%v)", event.EventType(), decoded, err)
+		}
+	}
+	if _, err := decodeEvent([]byte(`{"type":"desconocido"}`)); err == nil {
+		t.Error("Un tipo de evento desconocido debería ser un error")
+	}
+
+	// Las reacciones se difunden pero no entran en el historial
+	hub := NewHub()
+	go hub.Run()
+	client := &Client{hub: hub, send: make(chan []byte, 16), username: "ana"}
+	hub.register <- client
+
+	connected := readClientEvent(t, client, EventTypeConnectionSuccess)
+	protocol, _ := connected["protocol"].(map[string]interface{})
+	if protocol["version"] != float64(ProtocolVersion) || protocol["encoding"] != "json" {
+		t.Errorf("connectionSuccess debería indicar la versión del protocolo: %v", connected)
+	}
+
+	hub.queueBroadcast(&ReactionEvent{Type: EventTypeReaction, MessageID: "m1", Emoji: "👍", Username: "bot"}, nil)
+	readClientEvent(t, client, EventTypeReaction)
+	if len(hub.GetMessageHistory()) != 0 {
+		t.Error("Las reacciones no deberían guardarse en el historial")
+	}
+
+	// El esquema describe todos los eventos a partir de sus structs
+	recorder := httptest.NewRecorder()
+	serveProtocol(recorder, httptest.NewRequest("GET", "/api/protocol", nil))
+	var schema struct {
+		Version int                               `json:"version"`
+		Events  map[string]map[string]interface{} `json:"events"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &schema)
+	if schema.Version != ProtocolVersion || len(schema.Events) != len(eventTypes) {
+		t.Fatalf("Esquema inesperado: %s", recorder.Body.String())
+	}
+	if schema.Events[MessageTypeMessage]["timestamp"] != "timestamp" || schema.Events[EventTypeError]["code"] != "string" {
+		t.Errorf("Campos inesperados en el esquema de message/error: %v", schema.Events)
+	}
+}
+
+// readClientEvent lee del canal send del cliente hasta recibir un evento del tipo indicado
+func readClientEvent(t *testing.T, client *Client, eventType string) map[string]interface{} {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case data := <-client.send:
+			var event map[string]interface{}
+			json.Unmarshal(data, &event)
+			if event["type"] == eventType {
+				return event
+			}
+		case <-deadline:
+			t.Fatalf("No se recibió ningún evento %s", eventType)
+			return nil
+		}
+	}
+}
+
+// TestSlowConsumerPolicy prueba las dos políticas para clientes que no leen su buffer
+func TestSlowConsumerPolicy(t *testing.T) {
+	startHub := func(policy string) (*Hub, *Client) {
+		cfg := DefaultConfig()
+		cfg.ClientSendBuffer = 4
+		cfg.SlowConsumerPolicy = policy
+		hub := NewHubWithConfig(cfg)
+		go hub.Run()
+
+		// connectionSuccess, userList y join ya ocupan tres huecos del buffer
+		client := &Client{hub: hub, send: make(chan []byte, cfg.ClientSendBuffer), username: "lento"}
+		hub.register <- client
+		for i := 0; i < 50 && hub.GetClientCount() == 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		for i := 1; i <= 10; i++ {
+			hub.broadcast <- newWireEvent(NewMessage("ana", fmt.Sprintf("m%d", i)))
+		}
+		return hub, client
+	}
+	waitFor := func(t *testing.T, counter *CounterVec, label string, want float64) {
+		for i := 0; i < 100 && counter.Value(label) < want; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := counter.Value(label); got != want {
+			t.Fatalf("%s{%s}: se esperaba %v, se obtuvo %v", counter.name, label, want, got)
+		}
+	}
+
+	t.Run("disconnect", func(t *testing.T) {
+		hub, client := startHub(SlowConsumerDisconnect)
+		waitFor(t, hub.metrics.SlowConsumers, "evicted", 1)
+
+		// Lo pendiente se descarta y el canal se cierra con 1008
+		if _, ok := <-client.send; ok {
+			t.Error("El buffer de un cliente desconectado debería vaciarse y cerrarse")
+		}
+		if client.closeCode != websocket.ClosePolicyViolation || client.closeReason != slowConsumerCloseReason {
+			t.Errorf("Cierre inesperado: %d %q", client.closeCode, client.closeReason)
+		}
+
+		// Los errores y la baja posteriores no vuelven a escribir ni a cerrar send
+		client.sendError("TEST", "tarde")
+		hub.unregister <- client
+		for i := 0; i < 50 && hub.GetClientCount() > 0; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if hub.GetClientCount() != 0 || hub.GetUserHistory()["lento"].Connected {
+			t.Error("El cliente desconectado debería darse de baja como cualquier otro")
+		}
+	})
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		hub, client := startHub(SlowConsumerDropOldest)
+		waitFor(t, hub.metrics.SlowConsumers, "dropped_oldest", 9)
+
+		// Quedan los cuatro mensajes más recientes, en orden
+		for i := 7; i <= 10; i++ {
+			var msg Message
+			json.Unmarshal(<-client.send, &msg)
+			if msg.Content != fmt.Sprintf("m%d", i) {
+				t.Errorf("Se esperaba m%d, se obtuvo %q", i, msg.Content)
+			}
+		}
+		if hub.GetClientCount() != 1 || hub.metrics.MessagesDropped.Value("slow_consumer") != 9 {
+			t.Errorf("El cliente debería seguir conectado con 9 mensajes descartados: %d clientes, %v descartes",
+				hub.GetClientCount(), hub.metrics.MessagesDropped.Value("slow_consumer"))
+		}
+	})
+
+	if _, err := LoadConfig([]string{"-slow-consumer-policy", "ignore"}); err == nil {
+		t.Error("Una política desconocida debería fallar la validación")
+	}
+}
+
+// TestDeliveryAcks prueba las confirmaciones de los mensajes enviados con clientMsgId
+func TestDeliveryAcks(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "?username=ana"
+
+	connect := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+		if err != nil {
+			t.Fatalf("Error conectando: %v", err)
+		}
+		readUntilType(t, conn, EventTypeConnectionSuccess)
+		return conn
+	}
+	conn := connect()
+
+	// El ack llega después del propio mensaje y lleva su ID
+	conn.WriteJSON(map[string]interface{}{"content": "hola", "clientMsgId": "c1"})
+	echo := readUntilType(t, conn, MessageTypeMessage)
+	ack := readUntilType(t, conn, EventTypeAck)
+	if ack["clientMsgId"] != "c1" || ack["messageId"] != echo["id"] || ack["duplicate"] != nil {
+		t.Errorf("Ack inesperado: %v (mensaje %v)", ack, echo["id"])
+	}
+
+	// Un reintento se confirma sin duplicar el mensaje
+	conn.WriteJSON(map[string]interface{}{"content": "hola", "clientMsgId": "c1"})
+	retry := readUntilType(t, conn, EventTypeAck)
+	if retry["messageId"] != echo["id"] || retry["duplicate"] != true {
+		t.Errorf("El reintento debería confirmarse como duplicado: %v", retry)
+	}
+	if history := hub.GetMessageHistory(); len(history) != 1 {
+		t.Errorf("El reintento no debería guardarse otra vez: %d mensajes", len(history))
+	}
+
+	// Sin cuenta, quien se conecte después con el mismo nombre no hereda los clientMsgId
+	conn.Close()
+	for i := 0; i < 50 && hub.GetClientCount() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn = connect()
+	defer conn.Close()
+	conn.WriteJSON(map[string]interface{}{"content": "hola", "clientMsgId": "c1"})
+	readUntilType(t, conn, MessageTypeMessage)
+	if ack := readUntilType(t, conn, EventTypeAck); ack["duplicate"] != nil || ack["messageId"] == echo["id"] {
+		t.Errorf("Una conexión nueva sin cuenta no debería heredar los clientMsgId: %v", ack)
+	}
+	hub.clientMsgIDs.mu.Lock()
+	sessions := len(hub.clientMsgIDs.sessions)
+	hub.clientMsgIDs.mu.Unlock()
+	if sessions != 1 {
+		t.Errorf("La sesión de la conexión cerrada debería olvidarse: %d sesiones", sessions)
+	}
+
+	// Los rechazos llegan como nack y el mismo clientMsgId puede reintentarse
+	conn.WriteJSON(map[string]interface{}{"content": "", "hasImage": true, "clientMsgId": "c2",
+		"image": map[string]interface{}{"data": "no-es-data-url", "name": "x.png", "type": "image/png", "size": 10}})
+	if nack := readUntilType(t, conn, EventTypeNack); nack["clientMsgId"] != "c2" || nack["code"] != "INVALID_IMAGE" {
+		t.Errorf("Nack inesperado: %v", nack)
+	}
+	conn.WriteJSON(map[string]interface{}{"content": "   ", "clientMsgId": "c3"})
+	if nack := readUntilType(t, conn, EventTypeNack); nack["clientMsgId"] != "c3" || nack["code"] != "DROPPED" {
+		t.Errorf("Un mensaje descartado debería recibir nack DROPPED: %v", nack)
+	}
+	conn.WriteJSON(map[string]interface{}{"content": "ahora sí", "clientMsgId": "c2"})
+	if ack := readUntilType(t, conn, EventTypeAck); ack["clientMsgId"] != "c2" || ack["duplicate"] != nil {
+		t.Errorf("Un clientMsgId rechazado debería poder reintentarse: %v", ack)
+	}
+
+	conn.WriteJSON(map[string]interface{}{"content": "x", "clientMsgId": strings.Repeat("a", maxClientMsgIDLength+1)})
+	if errMsg := readUntilType(t, conn, EventTypeError); errMsg["code"] != "INVALID_CLIENT_MSG_ID" {
+		t.Errorf("Un clientMsgId demasiado largo debería rechazarse: %v", errMsg)
+	}
+
+	// Las cuentas conservan los clientMsgId tras reconectar hasta que caducan
+	ids := newClientMsgIDs()
+	now := time.Now()
+	ids.now = func() time.Time { return now }
+	session := ids.NewSession("bob", true)
+	ids.Remember(session, "c1", "m1")
+	ids.Close(session, true)
+	if messageID, seen := ids.Lookup(ids.NewSession("bob", true), "c1"); !seen || messageID != "m1" {
+		t.Errorf("La cuenta debería conservar sus clientMsgId al reconectar: %q, %v", messageID, seen)
+	}
+	now = now.Add(clientMsgIDRetention)
+	if _, seen := ids.Lookup(session, "c1"); seen {
+		t.Error("Los clientMsgId de una cuenta desconectada deberían caducar")
+	}
+	guest := ids.NewSession("guest-eva", false)
+	ids.Remember(guest, "c1", "m2")
+	ids.Close(guest, false)
+	if _, seen := ids.Lookup(ids.NewSession("guest-eva", false), "c1"); seen {
+		t.Error("Un invitado nuevo no debería heredar los clientMsgId de otro")
+	}
+	if len(ids.sessions) != 0 {
+		t.Errorf("No deberían quedar sesiones: %d", len(ids.sessions))
+	}
+}
+
+// TestOfflineQueue prueba que las menciones a usuarios desconectados se entregan en
+// su siguiente conexión
+func TestOfflineQueue(t *testing.T) {
+	// Límite por usuario y caducidad
+	queue := NewOfflineQueue(2, time.Hour)
+	now := time.Now()
+	queue.now = func() time.Time { return now }
+	queue.Push("bob", NewMessage("ana", "m1"))
+	queue.Push("eva", NewMessage("ana", "para eva"))
+	now = now.Add(2 * time.Hour)
+	if expired, dropped := queue.Push("bob", NewMessage("ana", "m2")); len(expired) != 2 || len(dropped) != 0 {
+		t.Errorf("m1 y el de eva deberían haber caducado: %d caducados, %d descartados", len(expired), len(dropped))
+	}
+	queue.Push("bob", NewMessage("ana", "m3"))
+	if _, dropped := queue.Push("bob", NewMessage("ana", "m4")); len(dropped) != 1 || dropped[0].Content != "m2" {
+		t.Errorf("Al superar el límite debería descartarse el más antiguo: %v", dropped)
+	}
+	if messages, _ := queue.Drain("bob"); len(messages) != 2 || messages[0].Content != "m3" || messages[1].Content != "m4" {
+		t.Errorf("Se esperaban m3 y m4, se obtuvo %v", messages)
+	}
+	if messages, _ := queue.Drain("bob"); len(messages) != 0 {
+		t.Errorf("Drain debería vaciar la cola: %d mensajes", len(messages))
+	}
+
+	// Solo se guardan mensajes para cuentas registradas
+	accounts, err := NewAccountStore(t.TempDir() + "/accounts.json")
+	if err != nil {
+		t.Fatalf("Error creando almacén de cuentas: %v", err)
+	}
+	accounts.cost = 4
+	for _, username := range []string{"bob", "eva"} {
+		if _, err := accounts.Register(username, "contraseña-larga"); err != nil {
+			t.Fatalf("Error registrando %s: %v", username, err)
+		}
+	}
+	store, err := NewDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("Error creando almacén en disco: %v", err)
+	}
+
+	hub := NewHub()
+	hub.auth = NewAuthService(accounts, NewTokenSigner([]byte("secreto"), time.Hour), true, "guest-")
+	hub.SetAttachmentStore(store)
+	image := &ImageData{Data: "data:image/png;base64,AQID", Name: "a.png", Type: "image/png"}
+	if err := hub.attachments.StoreImage(image); err != nil {
+		t.Fatalf("Error guardando imagen: %v", err)
+	}
+
+	// El mensaje en cola retiene su adjunto hasta caducar
+	offlineNow := time.Now()
+	hub.offline.now = func() time.Time { return offlineNow }
+	if !hub.queueOffline("eva", NewMessageWithImage("ana", "foto", image)) {
+		t.Fatal("Se esperaba guardar el mensaje para eva")
+	}
+	if refs := hub.attachments.RefCount(image.Hash); refs != 2 {
+		t.Errorf("Se esperaban 2 referencias con el mensaje en cola, se encontraron %d", refs)
+	}
+	offlineNow = offlineNow.Add(hub.config.OfflineQueueTTL + time.Minute)
+	hub.queueOffline("bob", NewMessage("ana", "otro"))
+	hub.offline.Drain("bob")
+	if refs := hub.attachments.RefCount(image.Hash); refs != 1 {
+		t.Errorf("El mensaje caducado debería liberar su adjunto: %d referencias", refs)
+	}
+	hub.offline.now = time.Now
+
+	// Las menciones que llegan de otro nodo ya las guardó el nodo de origen
+	payload, _ := json.Marshal(NewMessage("remoto", "hola @bob"))
+	hub.handleRemote(&BackplaneEvent{Node: "otro", Kind: BackplaneBroadcast, Payload: payload})
+	if queued := hub.metrics.OfflineMessages.Value("queued"); queued != 2 {
+		t.Errorf("Una mención remota no debería guardarse: %v mensajes guardados", queued)
+	}
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	token, _ := hub.auth.signer.Sign("bob", RoleUser)
+	bobDialer := websocket.Dialer{Subprotocols: []string{"bearer", token}}
+
+	for _, dial := range []func() (*websocket.Conn, *http.Response, error){
+		func() (*websocket.Conn, *http.Response, error) { return bobDialer.Dial(wsURL, nil) },
+		func() (*websocket.Conn, *http.Response, error) {
+			return websocket.DefaultDialer.Dial(wsURL+"?username=luis", nil)
+		},
+	} {
+		conn, _, err := dial()
+		if err != nil {
+			t.Fatalf("Error conectando: %v", err)
+		}
+		readUntilType(t, conn, EventTypeConnectionSuccess)
+		conn.Close()
+	}
+	for i := 0; i < 50 && hub.GetClientCount() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Solo se guarda para bob: guest-luis es un invitado, @nadie no existe y los
+	// mensajes efímeros de los bots no se guardan
+	queued := hub.metrics.OfflineMessages.Value("queued")
+	refs := hub.attachments.RefCount(image.Hash)
+	hub.sendDirect("bob", newWireEvent(NewEphemeralMessage("bot", "solo para ti")))
+	hub.broadcast <- newWireEvent(NewMessageWithImage("ana", "hola @bob, @guest-luis y @nadie", image))
+	for i := 0; i < 50 && hub.metrics.OfflineMessages.Value("queued") < queued+1; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := hub.metrics.OfflineMessages.Value("queued") - queued; got != 1 {
+		t.Fatalf("Se esperaba 1 mensaje guardado, se obtuvo %v", got)
+	}
+	if got := hub.attachments.RefCount(image.Hash); got != refs+1 {
+		t.Errorf("El mensaje en cola debería retener su adjunto: %d referencias, se esperaban %d", got, refs+1)
+	}
+
+	conn, _, err := bobDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Error reconectando: %v", err)
+	}
+	defer conn.Close()
+	if notice := readUntilType(t, conn, MessageTypeSystem); !strings.Contains(notice["content"].(string), "1 mensajes") {
+		t.Errorf("Aviso inesperado: %v", notice["content"])
+	}
+	if mention := readUntilType(t, conn, MessageTypeMessage); mention["content"] != "hola @bob, @guest-luis y @nadie" {
+		t.Errorf("Mención inesperada: %v", mention["content"])
+	}
+	if delivered := hub.metrics.OfflineMessages.Value("delivered"); delivered != 1 {
+		t.Errorf("Se esperaba 1 mensaje entregado, se obtuvo %v", delivered)
+	}
+	if got := hub.attachments.RefCount(image.Hash); got != refs {
+		t.Errorf("Tras entregarlo la cola debería liberar su referencia: %d referencias, se esperaban %d", got, refs)
+	}
+}
+
+// TestCompression prueba permessage-deflate: se comprimen los mensajes grandes y se
+// mide lo que ocupan en el cable
+func TestCompression(t *testing.T) {
+	receive := func(t *testing.T, cfg *Config) *Metrics {
+		hub := NewHubWithConfig(cfg)
+		go hub.Run()
+
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			serveWS(hub, w, r)
+		}))
+		defer server.Close()
+
+		dialer := websocket.Dialer{EnableCompression: true}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"?username=ana", nil)
+		if err != nil {
+			t.Fatalf("Error conectando: %v", err)
+		}
+		defer conn.Close()
+		readUntilType(t, conn, EventTypeConnectionSuccess)
+
+		content := strings.Repeat("hola a todos ", 200)
+		hub.broadcast <- newWireEvent(NewMessage("bob", content))
+		if msg := readUntilType(t, conn, MessageTypeMessage); msg["content"] != content {
+			t.Errorf("El mensaje comprimido debería llegar intacto")
+		}
+		return hub.metrics
+	}
+
+	t.Run("habilitada", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.CompressionThreshold = 1024
+		metrics := receive(t, cfg)
+		payload, wire := metrics.CompressedBytes.Value("payload"), metrics.CompressedBytes.Value("wire")
+		if payload == 0 || wire == 0 || wire >= payload/4 {
+			t.Errorf("El mensaje repetitivo debería comprimirse: %v bytes → %v en el cable", payload, wire)
+		}
+
+		// Los mensajes por debajo del umbral (connectionSuccess, userList...) no se comprimen
+		var recorder bytes.Buffer
+		metrics.CompressionRatio.write(&recorder)
+		if !strings.Contains(recorder.String(), "chat_ws_compression_ratio_count 1") {
+			t.Errorf("Solo el mensaje grande debería comprimirse:\n%s", recorder.String())
+		}
+	})
+
+	t.Run("deshabilitada", func(t *testing.T) {
+		cfg := DefaultConfig()
+		cfg.CompressionLevel = 0
+		if metrics := receive(t, cfg); metrics.CompressedBytes.Value("payload") != 0 {
+			t.Error("Con compressionLevel 0 no debería comprimirse nada")
+		}
+	})
+
+	if _, err := LoadConfig([]string{"-compression-level", "10"}); err == nil {
+		t.Error("Un nivel de compresión fuera de rango debería fallar la validación")
+	}
+}
+
+// TestBinaryProtocol prueba la codificación MessagePack negociada con Sec-WebSocket-Protocol
+func TestBinaryProtocol(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveWS(hub, w, r)
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dialer := websocket.Dialer{Subprotocols: []string{"msgpack"}}
+	binaryConn, _, err := dialer.Dial(wsURL+"?username=ana", nil)
+	if err != nil {
+		t.Fatalf("Error conectando: %v", err)
+	}
+	defer binaryConn.Close()
+	if binaryConn.Subprotocol() != "msgpack" {
+		t.Errorf("El servidor debería confirmar el subprotocolo msgpack, confirmó %q", binaryConn.Subprotocol())
+	}
+
+	readBinary := func(eventType string) map[string]interface{} {
+		t.Helper()
+		binaryConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			frameType, data, err := binaryConn.ReadMessage()
+			if err != nil {
+				t.Fatalf("No se recibió ningún evento %s: %v", eventType, err)
+			}
+			if frameType != websocket.BinaryMessage {
+				t.Fatalf("Se esperaba un frame binario, se recibió el tipo %d", frameType)
+			}
+			var event map[string]interface{}
+			if err := unmarshalMsgpack(data, &event); err != nil {
+				t.Fatalf("MessagePack inválido: %v", err)
+			}
+			if event["type"] == eventType {
+				return event
+			}
+		}
+	}
+	welcome := readBinary(EventTypeConnectionSuccess)
+	if protocol, _ := welcome["protocol"].(map[string]interface{}); protocol["encoding"] != "msgpack" {
+		t.Errorf("connectionSuccess debería indicar la codificación msgpack: %v", welcome["protocol"])
+	}
+
+	// Los clientes JSON siguen recibiendo texto
+	jsonConn, _, err := websocket.DefaultDialer.Dial(wsURL+"?username=bob", nil)
+	if err != nil {
+		t.Fatalf("Error conectando: %v", err)
+	}
+	defer jsonConn.Close()
+	readUntilType(t, jsonConn, EventTypeConnectionSuccess)
+
+	// La imagen viaja como bytes en MessagePack y como data URL en JSON
+	image := []byte("\x89PNG\r\n\x1a\n datos de la imagen")
+	frame, err := marshalMsgpack(map[string]interface{}{
+		"content": "foto", "hasImage": true,
+		"image": map[string]interface{}{"data": image, "name": "foto.png", "type": "image/png", "size": len(image)},
+	})
+	if err != nil {
+		t.Fatalf("Error serializando: %v", err)
+	}
+	binaryConn.WriteMessage(websocket.BinaryMessage, frame)
+
+	received := readBinary(MessageTypeMessage)
+	img, _ := received["image"].(map[string]interface{})
+	if data, _ := img["data"].([]byte); !bytes.Equal(data, image) {
+		t.Errorf("La imagen debería llegar como bytes en MessagePack: %v", received["image"])
+	}
+	if _, isTime := received["timestamp"].(time.Time); !isTime {
+		t.Errorf("timestamp debería ser un timestamp de MessagePack: %T", received["timestamp"])
+	}
+	echo := readUntilType(t, jsonConn, MessageTypeMessage)
+	wantURL := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+	if img, _ := echo["image"].(map[string]interface{}); img["data"] != wantURL {
+		t.Errorf("Los clientes JSON deberían recibir el data URL: %v", echo["image"])
+	}
+}
+
+// readUntilType lee de la conexión hasta recibir un evento del tipo indicado
+func readUntilType(t *testing.T, conn *websocket.Conn, eventType string) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var event map[string]interface{}
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("No se recibió ningún evento %s: %v", eventType, err)
+		}
+		if event["type"] == eventType {
+			return event
 		}
 	}
 }
@@ -2,26 +2,24 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"strings"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Roles de usuario (determinan, entre otras cosas, la cuota de subida)
 const (
-	// Tiempo máximo de espera para escribir un mensaje al cliente
-	writeWait = 10 * time.Second
-
-	// Tiempo máximo de espera para leer el siguiente pong del cliente
-	pongWait = 60 * time.Second
-
-	// Enviar pings al cliente con este período. Debe ser menor que pongWait
-	pingPeriod = (pongWait * 9) / 10
-
-	// Tamaño máximo del mensaje permitido del cliente (aumentado para imágenes)
-	maxMessageSize = 10 * 1024 * 1024 // 10MB para soportar imágenes
+	RoleGuest     = "guest"
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+	RoleBot       = "bot"
 )
 
 var (
@@ -42,6 +40,60 @@ type Client struct {
 
 	// Nombre de usuario del cliente
 	username string
+
+	// Rol del usuario (RoleGuest, RoleUser, RoleModerator, RoleAdmin, RoleBot)
+	role string
+
+	// Cuenta de bot autenticada con token (nil para usuarios normales)
+	bot *Bot
+
+	// IP de origen de la conexión (para detección de spam)
+	ip string
+
+	// Código y motivo del frame de cierre que envía writePump cuando el hub
+	// cierra send (0 = cierre sin código)
+	closeCode   int
+	closeReason string
+
+	// Shard que entrega los mensajes al cliente y cierra send
+	shard *hubShard
+
+	// Reserva del nombre en el clúster, hecha en serveWS antes del registro:
+	// claimed si se reservó, nameTaken si lo usa otro nodo
+	claimed   bool
+	nameTaken bool
+
+	// Sesión con la que se recuerdan sus clientMsgId: el nombre en las cuentas
+	// autenticadas (persistentAcks) y la conexión en invitados y nombres sin cuenta
+	ackSession     string
+	persistentAcks bool
+
+	// Codificación en la que recibe los eventos (JSON salvo que negocie otra)
+	encoding Encoding
+
+	// Compresión negociada (permessage-deflate) y conexión que cuenta los bytes
+	// enviados, para medir lo que se ahorra
+	compress bool
+	wire     *countingConn
+
+	// Logger con el identificador de conexión y el usuario
+	logger *slog.Logger
+}
+
+// config devuelve los límites del hub (los valores por defecto si el cliente no tiene hub)
+func (c *Client) config() *Config {
+	if c.hub == nil || c.hub.config == nil {
+		return DefaultConfig()
+	}
+	return c.hub.config
+}
+
+// log devuelve el logger de la conexión
+func (c *Client) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default().With("user", c.username)
+	}
+	return c.logger
 }
 
 // IncomingMessage representa un mensaje entrante del cliente
@@ -49,118 +101,222 @@ type IncomingMessage struct {
 	Content  string     `json:"content"`
 	HasImage bool       `json:"hasImage"`
 	Image    *ImageData `json:"image,omitempty"`
+
+	// Campos de la API de bots
+	Action    string `json:"action,omitempty"`    // "message" (por defecto), "react", "ephemeral"
+	To        string `json:"to,omitempty"`        // Destinatario de un mensaje efímero
+	MessageID string `json:"messageId,omitempty"` // Mensaje al que se reacciona
+	Emoji     string `json:"emoji,omitempty"`
+
+	// Identificador elegido por el cliente: el servidor responde con ack o nack y
+	// reconoce los reintentos para no duplicar el mensaje
+	ClientMsgID string `json:"clientMsgId,omitempty"`
 }
 
 // readPump bombea mensajes desde la conexión WebSocket al hub
 func (c *Client) readPump() {
 	defer func() {
+		// readPump es el único que anota los clientMsgId de la conexión
+		c.hub.clientMsgIDs.Close(c.ackSession, c.persistentAcks)
 		c.hub.unregister <- c
 		c.conn.Close()
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
+	cfg := c.config()
+	c.conn.SetReadLimit(cfg.MaxMessageSize)
 
-	if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-		log.Printf("Error estableciendo deadline de lectura para '%s': %v", c.username, err)
+	if err := c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait)); err != nil {
+		c.log().Error("error estableciendo deadline de lectura", "error", err)
 		return
 	}
 
 	c.conn.SetPongHandler(func(string) error {
-		if err := c.conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
-			log.Printf("Error estableciendo deadline en pong handler para '%s': %v", c.username, err)
+		if err := c.conn.SetReadDeadline(time.Now().Add(cfg.PongWait)); err != nil {
+			c.log().Error("error estableciendo deadline en pong handler", "error", err)
 		}
 		return nil
 	})
 
 	for {
-		_, messageBytes, err := c.conn.ReadMessage()
+		frameType, messageBytes, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Error inesperado de WebSocket para '%s': %v", c.username, err)
+				c.log().Warn("cierre inesperado de WebSocket", "error", err)
 			} else {
-				log.Printf("Cliente '%s' cerró conexión: %v", c.username, err)
+				c.log().Debug("cliente cerró la conexión", "error", err)
 			}
 			break
 		}
 
-		messageBytes = bytes.TrimSpace(bytes.Replace(messageBytes, newline, space, -1))
-
-		// Intentar parsear el mensaje como JSON
 		var incomingMsg IncomingMessage
-		if err := json.Unmarshal(messageBytes, &incomingMsg); err != nil {
-			log.Printf("Error parseando mensaje JSON de cliente '%s': %v", c.username, err)
+		if err := decodeIncoming(frameType, messageBytes, &incomingMsg); err != nil {
+			c.log().Warn("mensaje inválido", "binary", frameType == websocket.BinaryMessage, "error", err)
 			continue
 		}
 
-		// ⭐ VALIDACIONES DE SEGURIDAD PARA IMÁGENES
-		if incomingMsg.HasImage && incomingMsg.Image != nil {
-			// Validar que sea una imagen válida
-			if !c.isValidImage(incomingMsg.Image) {
-				log.Printf("⚠️ Imagen inválida recibida de '%s'", c.username)
-				c.sendErrorMessage("Imagen inválida. Solo se permiten imágenes de hasta 5MB.")
-				continue
-			}
-			log.Printf("🖼️ Imagen válida recibida de '%s': %s (%d bytes)",
-				c.username, incomingMsg.Image.Name, incomingMsg.Image.Size)
+		// ⭐ ACCIONES DE BOTS (reacciones y mensajes efímeros)
+		if incomingMsg.Action != "" && incomingMsg.Action != BotActionMessage {
+			c.handleBotAction(&incomingMsg)
+			continue
 		}
 
-		// Validar contenido de texto si no hay imagen
-		if !incomingMsg.HasImage && strings.TrimSpace(incomingMsg.Content) == "" {
-			log.Printf("⚠️ Mensaje vacío recibido de '%s'", c.username)
+		// ⭐ CONFIRMACIONES: un reintento de un mensaje ya aceptado solo se vuelve a confirmar
+		clientMsgID := incomingMsg.ClientMsgID
+		if len(clientMsgID) > maxClientMsgIDLength {
+			c.sendError("INVALID_CLIENT_MSG_ID", fmt.Sprintf("clientMsgId admite hasta %d caracteres.", maxClientMsgIDLength))
 			continue
 		}
+		if clientMsgID != "" {
+			if messageID, seen := c.hub.clientMsgIDs.Lookup(c.ackSession, clientMsgID); seen {
+				c.log().Debug("reintento de un mensaje ya aceptado", "clientMsgId", clientMsgID, "messageId", messageID)
+				c.sendEvent(&AckEvent{Type: EventTypeAck, ClientMsgID: clientMsgID, MessageID: messageID, Duplicate: true})
+				continue
+			}
+		}
 
 		// Crear mensaje completo con metadata
 		var msg *Message
 		if incomingMsg.HasImage && incomingMsg.Image != nil {
+			c.hub.metrics.ImageBytesReceived.Add("", float64(imagePayloadSize(incomingMsg.Image)))
 			msg = NewMessageWithImage(c.username, incomingMsg.Content, incomingMsg.Image)
-			log.Printf("💬🖼️ Mensaje con imagen de '%s': texto='%s', imagen='%s'",
-				c.username, incomingMsg.Content, incomingMsg.Image.Name)
 		} else {
 			msg = NewMessage(c.username, incomingMsg.Content)
-			log.Printf("💬 Mensaje de texto de '%s': '%s'", c.username, incomingMsg.Content)
 		}
-
-		// Serializar mensaje completo
-		messageJSON, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("Error serializando mensaje de '%s': %v", c.username, err)
+		msg.Bot = c.bot != nil
+
+		// ⭐ CADENA DE INTERCEPTORES: validación, cuotas, comandos, filtros...
+		msgCtx := &MessageContext{Client: c, Message: msg}
+		if err := c.hub.pipeline.Process(msgCtx); err != nil {
+			msgCtx.releaseQuota()
+			var reject *RejectError
+			switch {
+			case errors.As(err, &reject):
+				c.hub.metrics.MessagesDropped.Inc("rejected")
+				c.reject(clientMsgID, reject.Code, reject.Reason)
+			case errors.Is(err, ErrMessageDropped):
+				c.hub.metrics.MessagesDropped.Inc("filtered")
+				if clientMsgID != "" {
+					c.reject(clientMsgID, "DROPPED", "El mensaje no se publicó.")
+				}
+			case errors.Is(err, ErrMessageHandled) && clientMsgID != "":
+				// Lo atendió un bot: no hay mensaje que guardar
+				c.hub.clientMsgIDs.Remember(c.ackSession, clientMsgID, "")
+				c.sendEvent(&AckEvent{Type: EventTypeAck, ClientMsgID: clientMsgID})
+			}
 			continue
 		}
 
-		// Enviar al hub para difusión
-		select {
-		case c.hub.broadcast <- messageJSON:
-			log.Printf("📤 Mensaje de '%s' enviado al hub para difusión", c.username)
-		default:
-			log.Printf("⚠️ Hub ocupado, mensaje de '%s' descartado", c.username)
+		if msg.HasImage {
+			c.log().Debug("mensaje con imagen", "messageId", msg.ID, contentAttr(msg.Content),
+				"imageType", msg.Image.Type, "imageBytes", msg.Image.Size)
+
+			// ⭐ Guardar la imagen en el almacén deduplicado en lugar de repetir el base64
+			if c.hub.attachments != nil {
+				if err := c.hub.attachments.StoreImage(msg.Image); err != nil {
+					c.log().Error("error guardando imagen", "error", err)
+					msgCtx.releaseQuota()
+					c.reject(clientMsgID, "INVALID_IMAGE", "No se pudo guardar la imagen.")
+					continue
+				}
+			}
+		} else {
+			c.log().Debug("mensaje de texto", "messageId", msg.ID, contentAttr(msg.Content))
+		}
+
+		// Enviar al hub para difusión; se serializa al entregarlo y el hub
+		// confirma el mensaje cuando lo guarda
+		var ack *pendingAck
+		if clientMsgID != "" {
+			ack = &pendingAck{client: c, clientMsgID: clientMsgID}
+			c.hub.clientMsgIDs.Remember(c.ackSession, clientMsgID, msg.ID)
+		}
+		if !c.hub.queueBroadcast(msg, ack) {
+			c.log().Warn("hub ocupado, mensaje descartado", "messageId", msg.ID)
+			c.hub.metrics.MessagesDropped.Inc("hub_busy")
+			c.hub.releaseAttachment(msg)
+			msgCtx.releaseQuota()
+			if clientMsgID != "" {
+				c.hub.clientMsgIDs.Forget(c.ackSession, clientMsgID)
+			}
+			c.reject(clientMsgID, "HUB_BUSY", "Servidor ocupado, vuelve a intentarlo.")
 		}
 	}
 }
 
-// isValidImage valida que los datos de imagen sean seguros
-func (c *Client) isValidImage(image *ImageData) bool {
-	// Validar tamaño máximo (5MB)
-	const maxImageSize = 5 * 1024 * 1024
-	if image.Size > maxImageSize {
-		return false
+// decodeIncoming decodifica un mensaje del cliente: los frames de texto son JSON y
+// los binarios MessagePack
+func decodeIncoming(frameType int, data []byte, msg *IncomingMessage) error {
+	if frameType == websocket.BinaryMessage {
+		return unmarshalMsgpack(data, msg)
 	}
+	data = bytes.TrimSpace(bytes.Replace(data, newline, space, -1))
+	return json.Unmarshal(data, msg)
+}
 
-	// Validar que sea un tipo MIME de imagen válido
-	validTypes := []string{
-		"image/jpeg", "image/jpg", "image/png", "image/gif",
-		"image/webp", "image/bmp", "image/svg+xml",
+// handleBotAction procesa las acciones exclusivas de bots
+func (c *Client) handleBotAction(incomingMsg *IncomingMessage) {
+	if c.bot == nil {
+		c.log().Warn("acción de bot rechazada: el cliente no es un bot", "action", incomingMsg.Action)
+		c.sendError("BOT_ONLY", "Esta acción solo está disponible para bots.")
+		return
 	}
 
-	isValidType := false
-	for _, validType := range validTypes {
-		if image.Type == validType {
-			isValidType = true
-			break
+	switch incomingMsg.Action {
+	case BotActionReact:
+		if incomingMsg.MessageID == "" || incomingMsg.Emoji == "" || len(incomingMsg.Emoji) > 32 {
+			c.sendError("INVALID_ACTION", "Reacción inválida: se requieren messageId y emoji.")
+			return
+		}
+
+		reaction := &ReactionEvent{
+			Type:      EventTypeReaction,
+			MessageID: incomingMsg.MessageID,
+			Emoji:     incomingMsg.Emoji,
+			Username:  c.username,
+			Timestamp: time.Now(),
+		}
+		if !c.hub.queueBroadcast(reaction, nil) {
+			c.log().Warn("hub ocupado, reacción descartada", "messageId", incomingMsg.MessageID)
+		}
+
+	case BotActionEphemeral:
+		if incomingMsg.To == "" || strings.TrimSpace(incomingMsg.Content) == "" {
+			c.sendError("INVALID_ACTION", "Mensaje efímero inválido: se requieren to y content.")
+			return
+		}
+
+		ephemeral := NewEphemeralMessage(c.username, incomingMsg.Content)
+		c.hub.sendDirect(incomingMsg.To, newWireEvent(ephemeral))
+
+	default:
+		c.sendError("INVALID_ACTION", "Acción desconocida: "+incomingMsg.Action)
+	}
+}
+
+// handlesCommand indica si el cliente es un bot que atiende el comando
+func (c *Client) handlesCommand(command string) bool {
+	if c.bot == nil {
+		return false
+	}
+	for _, handled := range c.bot.Commands {
+		if handled == command {
+			return true
 		}
 	}
+	return false
+}
 
-	if !isValidType {
+// isValidImage valida que los datos de imagen sean seguros
+func (c *Client) isValidImage(image *ImageData) bool {
+	cfg := c.config()
+
+	// Validar tamaño máximo (5MB por defecto) con los bytes reales, no con los declarados
+	if imagePayloadSize(image) > cfg.MaxImageSize {
+		return false
+	}
+
+	// Validar que sea un tipo MIME de imagen permitido
+	if !cfg.AllowsImageType(image.Type) {
 		return false
 	}
 
@@ -177,27 +333,65 @@ func (c *Client) isValidImage(image *ImageData) bool {
 	return true
 }
 
-// sendErrorMessage envía un mensaje de error al cliente
-func (c *Client) sendErrorMessage(errorText string) {
-	errorMsg := map[string]interface{}{
-		"type":    "error",
-		"message": errorText,
-		"code":    "INVALID_IMAGE",
+// imagePayloadSize calcula los bytes reales de la imagen a partir de su data URL
+// (0 si no lo es), sin fiarse del tamaño que declara el cliente
+func imagePayloadSize(image *ImageData) int64 {
+	_, payload, found := strings.Cut(image.Data, ",")
+	if !found {
+		return 0
 	}
+	return int64(base64.RawStdEncoding.DecodedLen(len(strings.TrimRight(payload, "="))))
+}
 
-	if msgBytes, err := json.Marshal(errorMsg); err == nil {
-		select {
-		case c.send <- msgBytes:
-			log.Printf("📤 Mensaje de error enviado a '%s'", c.username)
-		default:
-			log.Printf("❌ No se pudo enviar mensaje de error a '%s'", c.username)
-		}
+// sendError envía un mensaje de error con el código indicado al cliente
+func (c *Client) sendError(code, errorText string) {
+	if c.sendEvent(NewErrorEvent(code, errorText)) {
+		c.log().Debug("error enviado al cliente", "code", code)
+	} else {
+		c.log().Warn("no se pudo enviar el error al cliente", "code", code)
+	}
+}
+
+// reject avisa de que un mensaje no se aceptó: con un nack si el cliente lo envió
+// con clientMsgId y con un error si no
+func (c *Client) reject(clientMsgID, code, reason string) {
+	if clientMsgID == "" {
+		c.sendError(code, reason)
+		return
+	}
+	if !c.sendEvent(&NackEvent{Type: EventTypeNack, ClientMsgID: clientMsgID, Code: code, Reason: reason}) {
+		c.log().Warn("no se pudo enviar el nack al cliente", "clientMsgId", clientMsgID, "code", code)
+	}
+}
+
+// sendEvent envía un evento solo a esta conexión (no bloquea). Pasa por el hub
+// porque solo el shard del cliente escribe en send.
+func (c *Client) sendEvent(event Event) bool {
+	select {
+	case c.hub.direct <- &directMessage{to: c.username, client: c, event: newWireEvent(event)}:
+		return true
+	default:
+		c.hub.metrics.MessagesDropped.Inc("direct_queue_full")
+		return false
+	}
+}
+
+// writeClose envía el frame de cierre, con código y motivo si el hub los indicó
+// (p. ej. 1001 cuando se apaga el servidor)
+func (c *Client) writeClose() {
+	closeMessage := []byte{}
+	if c.closeCode != 0 {
+		closeMessage = websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+	}
+	if err := c.conn.WriteMessage(websocket.CloseMessage, closeMessage); err != nil {
+		c.log().Debug("error enviando frame de cierre", "error", err)
 	}
 }
 
 // writePump bombea mensajes desde el hub hacia la conexión WebSocket
 func (c *Client) writePump() {
-	ticker := time.NewTicker(pingPeriod)
+	cfg := c.config()
+	ticker := time.NewTicker(cfg.PingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
@@ -206,22 +400,20 @@ func (c *Client) writePump() {
 	for {
 		select {
 		case message, ok := <-c.send:
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("Error estableciendo deadline de escritura para '%s': %v", c.username, err)
+			if err := c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait)); err != nil {
+				c.log().Error("error estableciendo deadline de escritura", "error", err)
 				return
 			}
 
 			if !ok {
 				// El hub cerró el canal
-				if err := c.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-					log.Printf("Error enviando mensaje de cierre para '%s': %v", c.username, err)
-				}
+				c.writeClose()
 				return
 			}
 
 			// ⭐ ENVÍO OPTIMIZADO: Un mensaje por WebSocket frame
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				log.Printf("Error escribiendo mensaje para '%s': %v", c.username, err)
+			if err := c.writeMessage(c.encoding.frameType(), message); err != nil {
+				c.log().Debug("error escribiendo mensaje", "error", err)
 				return
 			}
 
@@ -229,14 +421,20 @@ func (c *Client) writePump() {
 		additionalMessages:
 			for {
 				select {
-				case nextMessage := <-c.send:
+				case nextMessage, ok := <-c.send:
+					if !ok {
+						// El canal se cerró con mensajes aún en buffer (p. ej. aviso de apagado)
+						c.writeClose()
+						return
+					}
+
 					// Enviar cada mensaje adicional como frame separado
-					if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-						log.Printf("Error estableciendo deadline para mensaje adicional: %v", err)
+					if err := c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait)); err != nil {
+						c.log().Error("error estableciendo deadline de escritura", "error", err)
 						return
 					}
-					if err := c.conn.WriteMessage(websocket.TextMessage, nextMessage); err != nil {
-						log.Printf("Error enviando mensaje adicional para '%s': %v", c.username, err)
+					if err := c.writeMessage(c.encoding.frameType(), nextMessage); err != nil {
+						c.log().Debug("error escribiendo mensaje", "error", err)
 						return
 					}
 				default:
@@ -247,13 +445,13 @@ func (c *Client) writePump() {
 
 		case <-ticker.C:
 			// Enviar ping
-			if err := c.conn.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
-				log.Printf("Error estableciendo deadline para ping para '%s': %v", c.username, err)
+			if err := c.conn.SetWriteDeadline(time.Now().Add(cfg.WriteWait)); err != nil {
+				c.log().Error("error estableciendo deadline de ping", "error", err)
 				return
 			}
 
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				log.Printf("Error enviando ping para '%s': %v", c.username, err)
+				c.log().Debug("error enviando ping", "error", err)
 				return
 			}
 		}
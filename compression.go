@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Compresión por mensaje (permessage-deflate). Los navegadores la ofrecen siempre;
+// el servidor la acepta si compressionLevel > 0 y solo comprime los mensajes a partir
+// de compressionThreshold bytes, porque en los pequeños el coste no compensa.
+
+// countingConn cuenta los bytes que salen por la conexión: con compresión son los
+// frames ya comprimidos, lo que permite medir cuánto se ahorra realmente
+type countingConn struct {
+	net.Conn
+	written atomic.Int64
+}
+
+// Write escribe en la conexión y suma los bytes enviados
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+// countingResponseWriter entrega al upgrader una conexión que cuenta los bytes enviados
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+// Hijack toma la conexión de la respuesta y la envuelve en un countingConn
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("la respuesta no admite Hijack")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, bufio.NewReadWriter(brw.Reader, bufio.NewWriterSize(w.conn, brw.Writer.Size())), nil
+}
+
+// offersCompression indica si el cliente ofreció permessage-deflate en el handshake
+func offersCompression(r *http.Request) bool {
+	for _, header := range r.Header.Values("Sec-WebSocket-Extensions") {
+		for _, extension := range strings.Split(header, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeMessage envía un mensaje al cliente. Si la conexión negoció la compresión,
+// comprime los que superan el umbral y registra cuánto ocuparon en el cable.
+func (c *Client) writeMessage(messageType int, message []byte) error {
+	if !c.compress {
+		return c.conn.WriteMessage(messageType, message)
+	}
+
+	compressed := len(message) >= c.config().CompressionThreshold
+	c.conn.EnableWriteCompression(compressed)
+	before := c.wire.written.Load()
+	if err := c.conn.WriteMessage(messageType, message); err != nil {
+		return err
+	}
+
+	if compressed {
+		wire := c.wire.written.Load() - before
+		metrics := c.hub.metrics
+		metrics.CompressedBytes.Add("payload", float64(len(message)))
+		metrics.CompressedBytes.Add("wire", float64(wire))
+		metrics.CompressionRatio.Observe("", float64(wire)/float64(len(message)))
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config reúne los ajustes del servidor que cambian entre despliegues. Se resuelve
+// en este orden (cada paso sobrescribe al anterior): valores por defecto, archivo
+// YAML/JSON, variables de entorno y flags de línea de comandos.
+type Config struct {
+	// Puerto HTTP (PORT en Railway)
+	Port string `yaml:"port"`
+
+	// Tiempo máximo para escribir un mensaje al cliente
+	WriteWait time.Duration `yaml:"writeWait"`
+
+	// Tiempo máximo de espera del siguiente pong; los pings se envían cada 9/10
+	PongWait time.Duration `yaml:"pongWait"`
+
+	// Tamaño máximo de un mensaje WebSocket del cliente (incluye imágenes en base64)
+	MaxMessageSize int64 `yaml:"maxMessageSize"`
+
+	// Tamaño máximo de una imagen y tipos MIME aceptados
+	MaxImageSize      int64    `yaml:"maxImageSize"`
+	AllowedImageTypes []string `yaml:"allowedImageTypes"`
+
+	// Mensajes que se guardan en el historial
+	MaxHistorySize int `yaml:"maxHistorySize"`
+
+	// Tamaño de los buffers de los canales del hub y del envío de cada cliente
+	BroadcastBuffer  int `yaml:"broadcastBuffer"`
+	RegisterBuffer   int `yaml:"registerBuffer"` // register y unregister
+	DirectBuffer     int `yaml:"directBuffer"`
+	ClientSendBuffer int `yaml:"clientSendBuffer"`
+
+	// Qué hacer con un cliente cuyo buffer de envío se llena (SlowConsumerDisconnect
+	// o SlowConsumerDropOldest)
+	SlowConsumerPolicy string `yaml:"slowConsumerPolicy"`
+
+	// Goroutines que reparten la difusión entre los clientes
+	HubShards int `yaml:"hubShards"`
+
+	// Menciones guardadas por usuario desconectado (0 = no se guardan) y cuánto
+	// tiempo se conservan
+	OfflineQueueSize int           `yaml:"offlineQueueSize"`
+	OfflineQueueTTL  time.Duration `yaml:"offlineQueueTTL"`
+
+	// Compresión por mensaje (permessage-deflate): nivel de flate de 1 (más rápido)
+	// a 9 (más compacto), 0 = deshabilitada, y bytes a partir de los que se comprime
+	CompressionLevel     int `yaml:"compressionLevel"`
+	CompressionThreshold int `yaml:"compressionThreshold"`
+
+	// Archivo del que se leyó la configuración ("" = ninguno)
+	source string
+}
+
+// DefaultConfig devuelve los valores con los que el chat funcionaba hasta ahora
+func DefaultConfig() *Config {
+	return &Config{
+		Port:           "8080",
+		WriteWait:      10 * time.Second,
+		PongWait:       60 * time.Second,
+		MaxMessageSize: 10 * 1024 * 1024, // 10MB para soportar imágenes
+		MaxImageSize:   5 * 1024 * 1024,
+		AllowedImageTypes: []string{
+			"image/jpeg", "image/jpg", "image/png", "image/gif",
+			"image/webp", "image/bmp", "image/svg+xml",
+		},
+		MaxHistorySize:       50,
+		BroadcastBuffer:      1000,
+		RegisterBuffer:       100,
+		DirectBuffer:         100,
+		ClientSendBuffer:     256,
+		SlowConsumerPolicy:   SlowConsumerDisconnect,
+		HubShards:            runtime.GOMAXPROCS(0),
+		OfflineQueueSize:     50,
+		OfflineQueueTTL:      24 * time.Hour,
+		CompressionLevel:     flate.BestSpeed,
+		CompressionThreshold: 256,
+	}
+}
+
+// PingPeriod es el intervalo de pings al cliente. Debe ser menor que PongWait.
+func (c *Config) PingPeriod() time.Duration {
+	return (c.PongWait * 9) / 10
+}
+
+// AllowsImageType indica si el tipo MIME está en la lista de imágenes aceptadas
+func (c *Config) AllowsImageType(mimeType string) bool {
+	return containsString(c.AllowedImageTypes, mimeType)
+}
+
+// configSetting es un ajuste que puede cambiarse con una variable de entorno o un flag
+type configSetting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// configSettings enumera los ajustes de Config con su variable de entorno y su flag
+var configSettings = []configSetting{
+	{"port", "PORT", "puerto HTTP", func(c *Config, v string) error { c.Port = v; return nil }},
+	{"write-wait", "WRITE_WAIT", "tiempo máximo de escritura (p. ej. 10s)", durationSetting(func(c *Config) *time.Duration { return &c.WriteWait })},
+	{"pong-wait", "PONG_WAIT", "tiempo máximo de espera del pong (p. ej. 60s)", durationSetting(func(c *Config) *time.Duration { return &c.PongWait })},
+	{"max-message-size", "MAX_MESSAGE_SIZE", "bytes máximos de un mensaje WebSocket", intSetting(func(c *Config) *int64 { return &c.MaxMessageSize })},
+	{"max-image-size", "MAX_IMAGE_SIZE", "bytes máximos de una imagen", intSetting(func(c *Config) *int64 { return &c.MaxImageSize })},
+	{"allowed-image-types", "ALLOWED_IMAGE_TYPES", "tipos MIME de imagen separados por comas", func(c *Config, v string) error {
+		c.AllowedImageTypes = stringList(v)
+		return nil
+	}},
+	{"max-history-size", "MAX_HISTORY_SIZE", "mensajes guardados en el historial", intSetting(func(c *Config) *int { return &c.MaxHistorySize })},
+	{"broadcast-buffer", "BROADCAST_BUFFER", "buffer del canal de difusión del hub", intSetting(func(c *Config) *int { return &c.BroadcastBuffer })},
+	{"register-buffer", "REGISTER_BUFFER", "buffer de los canales de registro del hub", intSetting(func(c *Config) *int { return &c.RegisterBuffer })},
+	{"direct-buffer", "DIRECT_BUFFER", "buffer del canal de mensajes directos", intSetting(func(c *Config) *int { return &c.DirectBuffer })},
+	{"client-send-buffer", "CLIENT_SEND_BUFFER", "mensajes pendientes por cliente", intSetting(func(c *Config) *int { return &c.ClientSendBuffer })},
+	{"slow-consumer-policy", "SLOW_CONSUMER_POLICY", "clientes con el buffer lleno: disconnect o drop-oldest", func(c *Config, v string) error {
+		c.SlowConsumerPolicy = v
+		return nil
+	}},
+	{"hub-shards", "HUB_SHARDS", "goroutines que reparten la difusión", intSetting(func(c *Config) *int { return &c.HubShards })},
+	{"offline-queue-size", "OFFLINE_QUEUE_SIZE", "mensajes guardados por usuario desconectado (0 = ninguno)", intSetting(func(c *Config) *int { return &c.OfflineQueueSize })},
+	{"offline-queue-ttl", "OFFLINE_QUEUE_TTL", "caducidad de los mensajes guardados (p. ej. 24h)", durationSetting(func(c *Config) *time.Duration { return &c.OfflineQueueTTL })},
+	{"compression-level", "COMPRESSION_LEVEL", "nivel de compresión permessage-deflate de 1 a 9 (0 = sin compresión)", intSetting(func(c *Config) *int { return &c.CompressionLevel })},
+	{"compression-threshold", "COMPRESSION_THRESHOLD", "bytes a partir de los que se comprime un mensaje", intSetting(func(c *Config) *int { return &c.CompressionThreshold })},
+}
+
+// durationSetting crea el setter de un ajuste de tipo duración
+func durationSetting(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*field(c) = parsed
+		return nil
+	}
+}
+
+// intSetting crea el setter de un ajuste entero
+func intSetting[T int | int64](field func(*Config) *T) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		*field(c) = T(parsed)
+		return nil
+	}
+}
+
+// LoadConfig resuelve la configuración efectiva a partir de los argumentos de línea
+// de comandos. El archivo se indica con -config o CONFIG_FILE; si no existe ninguno
+// se usan los valores por defecto.
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("realtime-chat", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "archivo de configuración YAML o JSON")
+
+	// Los flags se aplican al final para que tengan prioridad sobre el archivo y el entorno
+	type flagValue struct {
+		setting configSetting
+		value   string
+	}
+	var flagged []flagValue
+	for _, setting := range configSettings {
+		fs.Func(setting.flag, setting.usage+" ($"+setting.env+")", func(value string) error {
+			flagged = append(flagged, flagValue{setting, value})
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultConfig()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return nil, fmt.Errorf("archivo de configuración %s: %w", *configPath, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value := os.Getenv(setting.env); value != "" {
+			if err := setting.set(cfg, value); err != nil {
+				return nil, fmt.Errorf("%s=%q inválido: %w", setting.env, value, err)
+			}
+		}
+	}
+
+	for _, f := range flagged {
+		if err := f.setting.set(cfg, f.value); err != nil {
+			return nil, fmt.Errorf("-%s=%q inválido: %w", f.setting.flag, f.value, err)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadFile lee un archivo YAML o JSON (JSON es YAML válido). Los campos desconocidos
+// son un error para que una errata no pase desapercibida.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	c.source = path
+	return nil
+}
+
+// Validate comprueba que los ajustes sean coherentes y devuelve todos los problemas a la vez
+func (c *Config) Validate() error {
+	var problems []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port < 65536, "port %q no es un puerto válido", c.Port)
+	check(c.WriteWait > 0, "writeWait debe ser positivo")
+	check(c.PongWait >= time.Second, "pongWait debe ser de al menos 1s")
+	check(c.MaxImageSize > 0, "maxImageSize debe ser positivo")
+	// Las imágenes viajan en base64 dentro del JSON: ocupan 4/3 de su tamaño
+	check(c.MaxMessageSize >= c.MaxImageSize*4/3+4096,
+		"maxMessageSize (%d) no admite una imagen de maxImageSize (%d) codificada en base64", c.MaxMessageSize, c.MaxImageSize)
+	check(len(c.AllowedImageTypes) > 0, "allowedImageTypes no puede estar vacío")
+	for _, mimeType := range c.AllowedImageTypes {
+		check(strings.HasPrefix(mimeType, "image/"), "allowedImageTypes: %q no es un tipo de imagen", mimeType)
+	}
+	check(c.MaxHistorySize > 0, "maxHistorySize debe ser positivo")
+	check(c.BroadcastBuffer > 0, "broadcastBuffer debe ser positivo")
+	check(c.RegisterBuffer > 0, "registerBuffer debe ser positivo")
+	check(c.DirectBuffer > 0, "directBuffer debe ser positivo")
+	check(c.ClientSendBuffer > 0, "clientSendBuffer debe ser positivo")
+	check(c.SlowConsumerPolicy == SlowConsumerDisconnect || c.SlowConsumerPolicy == SlowConsumerDropOldest,
+		"slowConsumerPolicy %q no es %s ni %s", c.SlowConsumerPolicy, SlowConsumerDisconnect, SlowConsumerDropOldest)
+	check(c.HubShards > 0, "hubShards debe ser positivo")
+	check(c.OfflineQueueSize >= 0, "offlineQueueSize no puede ser negativo")
+	check(c.OfflineQueueTTL > 0, "offlineQueueTTL debe ser positivo")
+	check(c.CompressionLevel >= 0 && c.CompressionLevel <= flate.BestCompression,
+		"compressionLevel debe estar entre 0 y %d", flate.BestCompression)
+	check(c.CompressionThreshold >= 0, "compressionThreshold no puede ser negativo")
+
+	return errors.Join(problems...)
+}
+
+// serveConfigAdmin muestra la configuración efectiva: GET /api/admin/config
+func serveConfigAdmin(cfg *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"source":               cfg.source,
+		"port":                 cfg.Port,
+		"writeWait":            cfg.WriteWait.String(),
+		"pongWait":             cfg.PongWait.String(),
+		"pingPeriod":           cfg.PingPeriod().String(),
+		"maxMessageSize":       cfg.MaxMessageSize,
+		"maxImageSize":         cfg.MaxImageSize,
+		"allowedImageTypes":    cfg.AllowedImageTypes,
+		"maxHistorySize":       cfg.MaxHistorySize,
+		"broadcastBuffer":      cfg.BroadcastBuffer,
+		"registerBuffer":       cfg.RegisterBuffer,
+		"directBuffer":         cfg.DirectBuffer,
+		"clientSendBuffer":     cfg.ClientSendBuffer,
+		"slowConsumerPolicy":   cfg.SlowConsumerPolicy,
+		"hubShards":            cfg.HubShards,
+		"offlineQueueSize":     cfg.OfflineQueueSize,
+		"offlineQueueTTL":      cfg.OfflineQueueTTL.String(),
+		"compressionLevel":     cfg.CompressionLevel,
+		"compressionThreshold": cfg.CompressionThreshold,
+	})
+}
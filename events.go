@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion es la versión del esquema de los eventos que reciben los clientes.
+// Sube con los cambios incompatibles (un campo que desaparece o cambia de
+// significado); añadir campos o tipos de evento nuevos no la cambia.
+const ProtocolVersion = 1
+
+// Tipos de evento que no son mensajes de chat (los de Message están en message.go)
+const (
+	EventTypeError             = "error"
+	EventTypeConnectionSuccess = "connectionSuccess"
+	EventTypeUserList          = "userList"
+	EventTypeReaction          = "reaction"
+	EventTypeCommand           = "command"
+	EventTypeModeration        = "moderation"
+)
+
+// Event es un evento que el servidor envía a los clientes. Recorre el hub con su
+// tipo Go y solo se serializa al entregarlo, una vez por codificación.
+type Event interface {
+	// EventType es el campo "type" con el que el cliente distingue el evento
+	EventType() string
+}
+
+// ErrorEvent avisa al cliente de que se rechazó su mensaje o su conexión
+type ErrorEvent struct {
+	Type    string `json:"type"` // Siempre "error"
+	Message string `json:"message"`
+	Code    string `json:"code"`
+}
+
+// NewErrorEvent crea un evento de error con el código indicado
+func NewErrorEvent(code, message string) *ErrorEvent {
+	return &ErrorEvent{Type: EventTypeError, Message: message, Code: code}
+}
+
+// EventType implementa Event
+func (e *ErrorEvent) EventType() string { return EventTypeError }
+
+// ConnectionSuccessEvent confirma al cliente que quedó registrado
+type ConnectionSuccessEvent struct {
+	Type     string       `json:"type"` // Siempre "connectionSuccess"
+	Message  string       `json:"message"`
+	Username string       `json:"username"`
+	Protocol ProtocolInfo `json:"protocol"`
+	Limits   ClientLimits `json:"limits"`
+}
+
+// EventType implementa Event
+func (e *ConnectionSuccessEvent) EventType() string { return EventTypeConnectionSuccess }
+
+// ProtocolInfo indica al cliente qué versión del esquema y qué codificación recibe
+type ProtocolInfo struct {
+	Version  int    `json:"version"`
+	Encoding string `json:"encoding"`
+}
+
+// ClientLimits son los límites que el cliente debe respetar al enviar imágenes
+type ClientLimits struct {
+	MaxImageSize      int64    `json:"maxImageSize"`
+	AllowedImageTypes []string `json:"allowedImageTypes"`
+}
+
+// UserListEvent es la lista de usuarios que se difunde cada vez que alguien entra o sale
+type UserListEvent struct {
+	Type  string        `json:"type"` // Siempre "userList"
+	Users []*UserStatus `json:"users"`
+}
+
+// EventType implementa Event
+func (e *UserListEvent) EventType() string { return EventTypeUserList }
+
+// eventTypes crea el struct de cada tipo de evento. Sirve para decodificar los
+// eventos que llegan de otros nodos y para describir el protocolo en /api/protocol.
+var eventTypes = map[string]func() Event{
+	MessageTypeMessage:         func() Event { return new(Message) },
+	MessageTypeSystem:          func() Event { return new(Message) },
+	MessageTypeJoin:            func() Event { return new(Message) },
+	MessageTypeLeave:           func() Event { return new(Message) },
+	MessageTypeEphemeral:       func() Event { return new(Message) },
+	EventTypeError:             func() Event { return new(ErrorEvent) },
+	EventTypeConnectionSuccess: func() Event { return new(ConnectionSuccessEvent) },
+	EventTypeUserList:          func() Event { return new(UserListEvent) },
+	EventTypeReaction:          func() Event { return new(ReactionEvent) },
+	EventTypeCommand:           func() Event { return new(CommandEvent) },
+	EventTypeModeration:        func() Event { return new(ModerationEvent) },
+	EventTypeAck:               func() Event { return new(AckEvent) },
+	EventTypeNack:              func() Event { return new(NackEvent) },
+}
+
+// decodeEvent reconstruye un evento a partir de su JSON según su campo "type"
+func decodeEvent(data []byte) (Event, error) {
+	var header struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, err
+	}
+
+	newEvent, ok := eventTypes[header.Type]
+	if !ok {
+		return nil, fmt.Errorf("tipo de evento desconocido: %q", header.Type)
+	}
+	event := newEvent()
+	if err := json.Unmarshal(data, event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Encoding es el formato en que un cliente recibe los eventos. JSON es el formato por
+// defecto; el cliente puede pedir otro con el subprotocolo del mismo nombre
+// (Sec-WebSocket-Protocol).
+type Encoding int
+
+const (
+	EncodingJSON    Encoding = iota
+	EncodingMsgPack          // MessagePack en frames binarios
+	numEncodings
+)
+
+// encodingNames son los nombres de las codificaciones en el protocolo
+var encodingNames = [numEncodings]string{
+	EncodingJSON:    "json",
+	EncodingMsgPack: "msgpack",
+}
+
+// String devuelve el nombre de la codificación
+func (e Encoding) String() string {
+	return encodingNames[e]
+}
+
+// frameType es el tipo de frame WebSocket en el que viajan los eventos
+func (e Encoding) frameType() int {
+	if e == EncodingMsgPack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// encodingByName busca una codificación por su nombre
+func encodingByName(name string) (Encoding, bool) {
+	for encoding, encodingName := range encodingNames {
+		if encodingName == name {
+			return Encoding(encoding), true
+		}
+	}
+	return EncodingJSON, false
+}
+
+// encodeEvent serializa un evento en la codificación indicada
+func encodeEvent(event Event, encoding Encoding) ([]byte, error) {
+	switch encoding {
+	case EncodingJSON:
+		return json.Marshal(event)
+	case EncodingMsgPack:
+		return marshalMsgpack(event)
+	default:
+		return nil, fmt.Errorf("codificación desconocida: %d", encoding)
+	}
+}
+
+// wireEvent es un evento camino de los clientes. Cada codificación se calcula una
+// sola vez, cuando la necesita el primer cliente (o el backplane), y se comparte.
+type wireEvent struct {
+	event Event
+
+	// Autor que espera la confirmación (ack) cuando el mensaje se guarde (nil = nadie)
+	ack *pendingAck
+
+	frames [numEncodings]struct {
+		once sync.Once
+		data []byte
+		err  error
+	}
+}
+
+// newWireEvent prepara un evento para entregarlo
+func newWireEvent(event Event) *wireEvent {
+	return &wireEvent{event: event}
+}
+
+// newWireEventFromJSON prepara un evento que ya llegó serializado (p. ej. de otro
+// nodo) reutilizando ese JSON en lugar de volver a generarlo
+func newWireEventFromJSON(event Event, data []byte) *wireEvent {
+	w := newWireEvent(event)
+	frame := &w.frames[EncodingJSON]
+	frame.once.Do(func() { frame.data = data })
+	return w
+}
+
+// encode devuelve el evento serializado en la codificación indicada. Los errores se
+// registran una sola vez aunque el evento vaya a miles de clientes.
+func (w *wireEvent) encode(encoding Encoding) ([]byte, error) {
+	frame := &w.frames[encoding]
+	frame.once.Do(func() {
+		frame.data, frame.err = encodeEvent(w.event, encoding)
+		if frame.err != nil {
+			slog.Error("error serializando evento", "type", w.event.EventType(), "encoding", encoding.String(), "error", frame.err)
+		}
+	})
+	return frame.data, frame.err
+}
+
+// serveProtocol describe el esquema de los eventos: GET /api/protocol. Se genera a
+// partir de los structs, así que siempre coincide con lo que envía el servidor.
+func serveProtocol(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	events := make(map[string]interface{}, len(eventTypes))
+	for eventType, newEvent := range eventTypes {
+		events[eventType] = describeType(reflect.TypeOf(newEvent()))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version":   ProtocolVersion,
+		"encodings": encodingNames[:],
+		"events":    events,
+		"client": map[string]interface{}{
+			"message": describeType(reflect.TypeOf(IncomingMessage{})),
+		},
+	})
+}
+
+// describeType describe un tipo Go tal como aparece en el JSON: los structs como
+// objeto con sus campos, los slices como lista de un elemento y el resto por nombre
+func describeType(t reflect.Type) interface{} {
+	if t == reflect.TypeOf(time.Time{}) {
+		return "timestamp"
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return describeType(t.Elem())
+	case reflect.Struct:
+		fields := make(map[string]interface{}, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			fields[name] = describeType(field.Type)
+		}
+		return fields
+	case reflect.Slice, reflect.Array:
+		return []interface{}{describeType(t.Elem())}
+	case reflect.Map, reflect.Interface:
+		return "object"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	default:
+		return "any"
+	}
+}
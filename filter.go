@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Modos de actuación del filtro de contenido
+const (
+	FilterModeBlock = "block" // Rechaza el mensaje
+	FilterModeMask  = "mask"  // Reemplaza las coincidencias por asteriscos
+	FilterModeFlag  = "flag"  // Deja pasar el mensaje pero avisa a los moderadores
+)
+
+// filterModeSeverity ordena los modos: si varias reglas coinciden gana la más severa
+var filterModeSeverity = map[string]int{
+	FilterModeFlag:  1,
+	FilterModeMask:  2,
+	FilterModeBlock: 3,
+}
+
+// FilterRule es una regla del archivo de configuración: una lista de palabras
+// (sin distinguir mayúsculas, palabra completa) y/o una expresión regular
+type FilterRule struct {
+	Name    string   `json:"name"`
+	Mode    string   `json:"mode"`
+	Words   []string `json:"words,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+}
+
+// FilterConfig es el formato del archivo de configuración del filtro
+type FilterConfig struct {
+	Rules []FilterRule `json:"rules"`
+}
+
+// compiledRule es una regla lista para aplicarse
+type compiledRule struct {
+	name    string
+	mode    string
+	words   map[string]bool
+	pattern *regexp.Regexp
+}
+
+// FilterResult describe qué encontró el filtro en un texto
+type FilterResult struct {
+	Mode    string   // Modo más severo entre las reglas que coincidieron ("" si ninguna)
+	Rules   []string // Reglas que coincidieron
+	Matches []string // Fragmentos que coincidieron
+	Masked  string   // Texto con las coincidencias de reglas "mask" y "block" enmascaradas
+}
+
+// wordPattern separa el texto en palabras (letras y dígitos Unicode)
+var wordPattern = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// ContentFilter aplica listas de palabras y expresiones regulares al contenido.
+// Las reglas se cargan de un archivo JSON y se recargan cuando cambia.
+type ContentFilter struct {
+	path    string
+	rules   []*compiledRule
+	modTime time.Time
+	mu      sync.RWMutex
+}
+
+// NewContentFilter crea un filtro y carga las reglas del archivo indicado.
+// Si el archivo no existe el filtro queda vacío hasta que se cree.
+func NewContentFilter(path string) (*ContentFilter, error) {
+	f := &ContentFilter{path: path}
+	if _, err := f.Reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return f, nil
+}
+
+// NewContentFilterFromConfig crea un filtro en memoria (sin archivo ni recarga)
+func NewContentFilterFromConfig(config FilterConfig) (*ContentFilter, error) {
+	rules, err := compileFilterRules(config)
+	if err != nil {
+		return nil, err
+	}
+	return &ContentFilter{rules: rules}, nil
+}
+
+// compileFilterRules valida y compila las reglas de la configuración
+func compileFilterRules(config FilterConfig) ([]*compiledRule, error) {
+	rules := make([]*compiledRule, 0, len(config.Rules))
+	for i, rule := range config.Rules {
+		if _, ok := filterModeSeverity[rule.Mode]; !ok {
+			return nil, fmt.Errorf("regla %d: modo desconocido '%s'", i, rule.Mode)
+		}
+
+		compiled := &compiledRule{name: rule.Name, mode: rule.Mode, words: make(map[string]bool)}
+		if compiled.name == "" {
+			compiled.name = fmt.Sprintf("regla-%d", i)
+		}
+
+		for _, word := range rule.Words {
+			if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+				compiled.words[word] = true
+			}
+		}
+
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile("(?i)" + rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("regla '%s': expresión regular inválida: %w", compiled.name, err)
+			}
+			compiled.pattern = pattern
+		}
+
+		if len(compiled.words) == 0 && compiled.pattern == nil {
+			return nil, fmt.Errorf("regla '%s': se requieren words o pattern", compiled.name)
+		}
+		rules = append(rules, compiled)
+	}
+	return rules, nil
+}
+
+// Reload vuelve a leer el archivo si cambió. Devuelve true si se recargaron las reglas.
+// Si el archivo nuevo es inválido se conservan las reglas anteriores.
+func (f *ContentFilter) Reload() (bool, error) {
+	if f.path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.RLock()
+	unchanged := info.ModTime().Equal(f.modTime)
+	f.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	var config FilterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return false, fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	rules, err := compileFilterRules(config)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.modTime = info.ModTime()
+	f.mu.Unlock()
+
+	slog.Info("filtro de contenido cargado", "rules", len(rules), "path", f.path)
+	return true, nil
+}
+
+// Watch recarga las reglas periódicamente cuando cambia el archivo
+func (f *ContentFilter) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := f.Reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error("error recargando filtro de contenido", "error", err)
+		}
+	}
+}
+
+// Check aplica todas las reglas al texto
+func (f *ContentFilter) Check(text string) FilterResult {
+	f.mu.RLock()
+	rules := f.rules
+	f.mu.RUnlock()
+
+	result := FilterResult{Masked: text}
+	if text == "" || len(rules) == 0 {
+		return result
+	}
+
+	// Rangos [inicio, fin) a enmascarar
+	var spans [][]int
+
+	for _, rule := range rules {
+		var ruleSpans [][]int
+
+		if len(rule.words) > 0 {
+			for _, span := range wordPattern.FindAllStringIndex(text, -1) {
+				if rule.words[strings.ToLower(text[span[0]:span[1]])] {
+					ruleSpans = append(ruleSpans, span)
+				}
+			}
+		}
+		if rule.pattern != nil {
+			ruleSpans = append(ruleSpans, rule.pattern.FindAllStringIndex(text, -1)...)
+		}
+
+		if len(ruleSpans) == 0 {
+			continue
+		}
+
+		result.Rules = append(result.Rules, rule.name)
+		for _, span := range ruleSpans {
+			result.Matches = append(result.Matches, text[span[0]:span[1]])
+		}
+		if filterModeSeverity[rule.mode] > filterModeSeverity[result.Mode] {
+			result.Mode = rule.mode
+		}
+		if rule.mode != FilterModeFlag {
+			spans = append(spans, ruleSpans...)
+		}
+	}
+
+	if len(spans) > 0 {
+		result.Masked = maskSpans(text, spans)
+	}
+	return result
+}
+
+// maskSpans reemplaza cada rango por tantos asteriscos como caracteres tenga
+func maskSpans(text string, spans [][]int) string {
+	masked := make([]bool, len(text))
+	for _, span := range spans {
+		for i := span[0]; i < span[1]; i++ {
+			masked[i] = true
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if masked[i] {
+			b.WriteByte('*')
+		} else {
+			b.WriteRune(r)
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// filterContent es el interceptor que aplica el filtro al texto y a los pies de imagen
+func filterContent(ctx *MessageContext) error {
+	filter := ctx.Client.hub.contentFilter
+	if filter == nil {
+		return nil
+	}
+
+	result := filter.Check(ctx.Message.Content)
+	if result.Mode == "" {
+		return nil
+	}
+
+	original := ctx.Message.Content
+	ctx.Client.hub.notifyModerators(&ModerationEvent{
+		Type:      EventTypeModeration,
+		Action:    "filtered",
+		Mode:      result.Mode,
+		Username:  ctx.Client.username,
+		MessageID: ctx.Message.ID,
+		Content:   original,
+		Rules:     result.Rules,
+		Matches:   result.Matches,
+		Timestamp: time.Now(),
+	})
+
+	switch result.Mode {
+	case FilterModeBlock:
+		return Reject("CONTENT_BLOCKED", "Tu mensaje contiene palabras no permitidas.")
+	case FilterModeMask:
+		ctx.Message.Content = result.Masked
+		ctx.Annotate("filtered", true)
+	}
+
+	// FilterModeFlag: el mensaje pasa intacto; solo los moderadores lo saben
+	return nil
+}
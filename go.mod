@@ -3,3 +3,11 @@ module realtime-chat
 go 1.24.4
 
 require github.com/gorilla/websocket v1.5.3
+
+require golang.org/x/crypto v0.42.0
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require github.com/vmihailenco/msgpack/v5 v5.4.1
+
+require github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
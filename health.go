@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Plazo máximo de cada comprobación de salud
+const healthCheckTimeout = 2 * time.Second
+
+// Ping hace un viaje de ida y vuelta por el loop de Hub.Run y devuelve cuánto tardó.
+// Si el loop está bloqueado, falla al vencer ctx.
+func (h *Hub) Ping(ctx context.Context) (time.Duration, error) {
+	start := time.Now()
+	done := make(chan struct{})
+
+	select {
+	case h.ping <- done:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// serveHealthz indica si el proceso está vivo y el hub responde: GET /healthz
+func serveHealthz(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	status := http.StatusOK
+	details := map[string]interface{}{
+		"status":     "ok",
+		"uptime":     time.Since(hub.metrics.startedAt).Round(time.Second).String(),
+		"clients":    hub.GetClientCount(),
+		"goroutines": runtime.NumGoroutine(),
+	}
+
+	latency, err := hub.Ping(ctx)
+	if err != nil {
+		status = http.StatusServiceUnavailable
+		details["status"] = "error"
+		details["hub"] = "el loop del hub no responde: " + err.Error()
+	} else {
+		details["hub"] = "ok"
+		details["hubLatencyMs"] = float64(latency.Microseconds()) / 1000
+	}
+
+	writeJSON(w, status, details)
+}
+
+// serveReadyz indica si el servidor puede recibir tráfico: GET /readyz.
+// Falla durante el apagado, si el hub no responde o si el almacén de adjuntos o el
+// backplane no son accesibles.
+func serveReadyz(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	ready := true
+	checks := map[string]string{}
+
+	if hub.Draining() {
+		ready = false
+		checks["shutdown"] = "el servidor se está apagando"
+	} else {
+		checks["shutdown"] = "ok"
+	}
+
+	if _, err := hub.Ping(ctx); err != nil {
+		ready = false
+		checks["hub"] = err.Error()
+	} else {
+		checks["hub"] = "ok"
+	}
+
+	if hub.attachments != nil {
+		if pinger, ok := hub.attachments.store.(StorePinger); ok {
+			if err := pingWithContext(ctx, pinger); err != nil {
+				ready = false
+				checks["attachments"] = err.Error()
+			} else {
+				checks["attachments"] = "ok"
+			}
+		}
+	}
+
+	if pinger, ok := hub.backplane.(StorePinger); ok {
+		if err := pingWithContext(ctx, pinger); err != nil {
+			ready = false
+			checks["backplane"] = err.Error()
+		} else {
+			checks["backplane"] = "ok"
+		}
+	}
+
+	status := http.StatusOK
+	result := "ready"
+	if !ready {
+		status = http.StatusServiceUnavailable
+		result = "not_ready"
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"status": result,
+		"checks": checks,
+	})
+}
+
+// pingWithContext ejecuta la comprobación del almacén respetando el plazo de ctx
+func pingWithContext(ctx context.Context, pinger StorePinger) error {
+	result := make(chan error, 1)
+	go func() { result <- pinger.Ping() }()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
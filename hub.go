@@ -1,18 +1,41 @@
 package main
 
 import (
-	"encoding/json"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Cuota de subida por defecto: 50MB por usuario cada hora
+const (
+	defaultUploadQuotaBytes  = 50 * 1024 * 1024
+	defaultUploadQuotaWindow = time.Hour
 )
 
+// Motivo del cierre 1008 que recibe una conexión con un nombre de usuario en uso
+const usernameTakenCloseReason = "nombre de usuario en uso"
+
 // UserStatus representa el estado de un usuario
 type UserStatus struct {
 	Username    string    `json:"username"`
 	Connected   bool      `json:"connected"`
 	LastSeen    time.Time `json:"lastSeen"`
 	ConnectedAt time.Time `json:"connectedAt"`
+	Bot         bool      `json:"bot,omitempty"`
+
+	// Estado anti-spam (no se envía a los clientes)
+	recentMessages []spamRecord
+	mutedUntil     time.Time
+}
+
+// directMessage es un evento dirigido a un único usuario o a una sola conexión
+type directMessage struct {
+	to     string
+	client *Client // Conexión concreta (nil = todas las conexiones de to)
+	event  *wireEvent
 }
 
 // Hub mantiene el conjunto de clientes activos y difunde mensajes a los clientes
@@ -27,8 +50,71 @@ type Hub struct {
 	messageHistory []*Message
 	maxHistorySize int
 
-	// Mensajes entrantes de los clientes para difundir
-	broadcast chan []byte
+	// Almacén de adjuntos deduplicado (nil = imágenes en línea como data URL)
+	attachments *AttachmentManager
+
+	// Cuota de bytes subidos por usuario (nil = sin cuotas)
+	uploadQuota *UploadQuota
+
+	// Webhooks salientes para eventos del chat (nil = deshabilitados)
+	webhooks *WebhookDispatcher
+
+	// Cuentas de bot que pueden autenticarse en /ws (nil = sin bots)
+	bots *BotRegistry
+
+	// Cuentas con contraseña y sesiones (nil = cualquiera puede usar cualquier nombre libre)
+	auth *AuthService
+
+	// Verificador de los JWT del gateway de SSO (nil = sin SSO)
+	sso *JWTVerifier
+
+	// Orígenes que pueden abrir un WebSocket (nil = solo el mismo origen)
+	origins *OriginPolicy
+
+	// Cadena de interceptores que procesa cada mensaje antes de difundirlo
+	pipeline *MessagePipeline
+
+	// Filtro de palabras/expresiones (nil = sin filtro)
+	contentFilter *ContentFilter
+
+	// Detector de spam (nil = deshabilitado)
+	spamDetector *SpamDetector
+
+	// clientMsgId aceptados de cada sesión, para no duplicar los reintentos
+	clientMsgIDs *clientMsgIDs
+
+	// Menciones para usuarios desconectados (nil = no se guardan)
+	offline *OfflineQueue
+
+	// Apagado ordenado: solicitudes al loop, marca de drenado y conexiones activas
+	shutdown    chan *shutdownRequest
+	draining    atomic.Bool
+	connections sync.WaitGroup
+
+	// Comprobaciones de que el loop responde (/healthz)
+	ping chan chan struct{}
+
+	// Métricas expuestas en /metrics
+	metrics *Metrics
+
+	// Ajustes de tiempos, límites y buffers
+	config *Config
+
+	// Clúster: backplane (nil = un solo nodo), eventos de otros nodos y su presencia
+	backplane   Backplane
+	remote      chan *BackplaneEvent
+	remoteNodes map[string]*remotePresence
+	refreshing  atomic.Bool // Renovación de nombres en curso
+
+	// Conexiones de este nodo con el nombre reservado en el clúster
+	claims   map[string]int
+	claimsMu sync.Mutex
+
+	// Eventos para difundir a todos los clientes (mensajes de chat, reacciones)
+	broadcast chan *wireEvent
+
+	// Goroutines que entregan los mensajes a los clientes (cada cliente en un shard)
+	shards []*hubShard
 
 	// Solicitudes de registro de nuevos clientes
 	register chan *Client
@@ -36,93 +122,159 @@ type Hub struct {
 	// Solicitudes de cancelación de registro de clientes
 	unregister chan *Client
 
+	// Mensajes dirigidos a un único usuario (efímeros, comandos para bots)
+	direct chan *directMessage
+
 	// Mutex para proteger acceso concurrente al mapa de clientes y historial
 	mu sync.RWMutex
 }
 
-// NewHub crea una nueva instancia del hub de chat
+// NewHub crea una nueva instancia del hub de chat con la configuración por defecto
 func NewHub() *Hub {
-	return &Hub{
-		broadcast:      make(chan []byte, 1000), // Buffer para evitar bloqueos
-		register:       make(chan *Client, 100),
-		unregister:     make(chan *Client, 100),
+	return NewHubWithConfig(DefaultConfig())
+}
+
+// NewHubWithConfig crea el hub con los límites y buffers de cfg
+func NewHubWithConfig(cfg *Config) *Hub {
+	h := &Hub{
+		broadcast:      make(chan *wireEvent, cfg.BroadcastBuffer), // Buffer para evitar bloqueos
+		register:       make(chan *Client, cfg.RegisterBuffer),
+		unregister:     make(chan *Client, cfg.RegisterBuffer),
+		direct:         make(chan *directMessage, cfg.DirectBuffer),
+		remote:         make(chan *BackplaneEvent, cfg.BroadcastBuffer),
+		shutdown:       make(chan *shutdownRequest),
+		ping:           make(chan chan struct{}),
 		clients:        make(map[*Client]bool),
 		userHistory:    make(map[string]*UserStatus),
 		messageHistory: make([]*Message, 0), // ⭐ AÑADIDO
-		maxHistorySize: 50,                  // ⭐ AÑADIDO
+		maxHistorySize: cfg.MaxHistorySize,  // ⭐ AÑADIDO
+		uploadQuota:    NewUploadQuota(defaultUploadQuotaWindow, defaultUploadQuotaBytes),
+		pipeline:       NewDefaultPipeline(),
+		spamDetector:   NewSpamDetector(DefaultSpamConfig()),
+		clientMsgIDs:   newClientMsgIDs(),
+		metrics:        NewMetrics(),
+		config:         cfg,
+	}
+
+	if cfg.OfflineQueueSize > 0 {
+		h.offline = NewOfflineQueue(cfg.OfflineQueueSize, cfg.OfflineQueueTTL)
 	}
+
+	h.shards = make([]*hubShard, cfg.HubShards)
+	for i := range h.shards {
+		h.shards[i] = newHubShard(h, cfg.BroadcastBuffer)
+	}
+	return h
 }
 
 // Run inicia el loop principal del hub
 func (h *Hub) Run() {
-	log.Println("🚀 Hub iniciado, esperando conexiones...")
+	slog.Info("hub iniciado", "shards", len(h.shards))
+	h.startShards()
+
+	// En un clúster se publica la presencia periódicamente (nil = nunca)
+	var heartbeat <-chan time.Time
+	if h.backplane != nil {
+		ticker := time.NewTicker(presenceInterval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
 
 	for {
 		select {
 		case client := <-h.register:
+			start := time.Now()
 			h.registerClient(client)
+			h.metrics.observeLoop("register", start)
 
 		case client := <-h.unregister:
+			start := time.Now()
 			h.unregisterClient(client)
+			h.metrics.observeLoop("unregister", start)
+
+		case event := <-h.broadcast:
+			start := time.Now()
+			h.deliverBroadcast(event, true)
+			h.publishEvent(BackplaneBroadcast, "", event)
+			h.metrics.observeLoop("broadcast", start)
+
+		case dm := <-h.direct:
+			start := time.Now()
+			if !h.deliverDirect(dm) {
+				// El destinatario puede estar conectado a otro nodo
+				h.publishEvent(BackplaneDirect, dm.to, dm.event)
+			}
+			h.metrics.observeLoop("direct", start)
 
-		case message := <-h.broadcast:
-			h.broadcastMessage(message)
+		case event := <-h.remote:
+			start := time.Now()
+			h.handleRemote(event)
+			h.metrics.observeLoop("remote", start)
+
+		case <-heartbeat:
+			h.clusterHeartbeat()
+
+		case req := <-h.shutdown:
+			req.done <- h.disconnectAll(req.notice)
+
+		case done := <-h.ping:
+			close(done)
 		}
 	}
 }
 
-// isUsernameAvailable verifica si un nombre de usuario está disponible
+// isUsernameAvailable verifica si un nombre de usuario está libre en este nodo. En
+// un clúster serveWS ya lo reservó en el backplane antes de registrar al cliente.
 func (h *Hub) isUsernameAvailable(username string) bool {
 	h.mu.RLock()
-	defer h.mu.RUnlock()
+	inUse := false
 
 	// Verificar si hay algún cliente conectado con ese nombre EXACTO
 	for client := range h.clients {
 		if client.username == username {
-			return false
+			inUse = true
+			break
 		}
 	}
 
 	// También verificar en el historial si está conectado actualmente
 	if userStatus, exists := h.userHistory[username]; exists && userStatus.Connected {
-		return false
+		inUse = true
 	}
+	h.mu.RUnlock()
 
-	return true
+	return !inUse
 }
 
 // registerClient registra un nuevo cliente en el hub
 func (h *Hub) registerClient(client *Client) {
-	// ⭐ VALIDACIÓN: Verificar si el nombre de usuario ya está en uso
-	if !h.isUsernameAvailable(client.username) {
-		log.Printf("❌ Intento de conexión con nombre duplicado: '%s'", client.username)
-
-		// Enviar mensaje de error al cliente
-		errorMsg := map[string]interface{}{
-			"type":    "error",
-			"message": "El nombre de usuario '" + client.username + "' ya está en uso. Por favor, elige otro nombre.",
-			"code":    "USERNAME_TAKEN",
-		}
+	// Durante el apagado no se admiten clientes nuevos
+	if h.draining.Load() {
+		go h.releaseClaim(client)
+		h.closeClient(client, websocket.CloseGoingAway, shutdownCloseReason)
+		return
+	}
 
-		if msgBytes, err := json.Marshal(errorMsg); err == nil {
-			select {
-			case client.send <- msgBytes:
-				log.Printf("📤 Mensaje de error enviado a cliente con nombre duplicado")
-			default:
-				log.Printf("❌ No se pudo enviar mensaje de error al cliente")
-			}
-		}
+	// ⭐ VALIDACIÓN: Verificar si el nombre de usuario ya está en uso (en otro nodo
+	// si no se pudo reservar en el clúster)
+	if client.nameTaken || !h.isUsernameAvailable(client.username) {
+		go h.releaseClaim(client)
+		client.log().Info("conexión rechazada: nombre de usuario en uso")
 
-		// Cerrar la conexión después de un breve delay para que el mensaje llegue
-		go func() {
-			time.Sleep(100 * time.Millisecond)
-			client.conn.Close()
-		}()
+		// Enviar mensaje de error al cliente (aún no tiene shard: se escribe desde aquí)
+		h.sendToClient(client, newWireEvent(NewErrorEvent("USERNAME_TAKEN",
+			"El nombre de usuario '"+client.username+"' ya está en uso. Por favor, elige otro nombre.")))
+
+		// Cerrar su canal como en el apagado: writePump envía el error y el cierre
+		// y termina, en lugar de esperar a que falle un ping
+		h.closeClient(client, websocket.ClosePolicyViolation, usernameTakenCloseReason)
 
 		return // ⭐ IMPORTANTE: No registrar el cliente
 	}
 
 	// Si llegamos aquí, el nombre está disponible
+	h.addToShard(client)
+
 	h.mu.Lock()
 	h.clients[client] = true
 
@@ -132,58 +284,59 @@ func (h *Hub) registerClient(client *Client) {
 		userStatus.Connected = true
 		userStatus.ConnectedAt = now
 		userStatus.LastSeen = now
+		userStatus.Bot = client.bot != nil
 	} else {
 		h.userHistory[client.username] = &UserStatus{
 			Username:    client.username,
 			Connected:   true,
 			ConnectedAt: now,
 			LastSeen:    now,
+			Bot:         client.bot != nil,
 		}
 	}
 
 	clientCount := len(h.clients)
 	h.mu.Unlock()
 
-	log.Printf("✅ Cliente '%s' conectado exitosamente. Total de clientes: %d", client.username, clientCount)
+	client.log().Info("cliente conectado", "clients", clientCount)
 
 	// ⭐ Enviar mensaje de éxito al cliente
-	successMsg := map[string]interface{}{
-		"type":     "connectionSuccess",
-		"message":  "Conectado exitosamente como " + client.username,
-		"username": client.username,
-	}
-
-	if msgBytes, err := json.Marshal(successMsg); err == nil {
-		select {
-		case client.send <- msgBytes:
-		default:
-		}
-	}
+	h.sendToClient(client, newWireEvent(&ConnectionSuccessEvent{
+		Type:     EventTypeConnectionSuccess,
+		Message:  "Conectado exitosamente como " + client.username,
+		Username: client.username,
+		Protocol: ProtocolInfo{Version: ProtocolVersion, Encoding: client.encoding.String()},
+		Limits: ClientLimits{
+			MaxImageSize:      h.config.MaxImageSize,
+			AllowedImageTypes: h.config.AllowedImageTypes,
+		},
+	}))
 
 	// ⭐ IMPORTANTE: NO enviar historial a nuevos usuarios
-	// Solo reciben mensajes desde el momento que se conectan
+	// Solo reciben mensajes desde el momento que se conectan, más las menciones
+	// que recibieron mientras estaban desconectados
+	h.deliverOffline(client)
 
 	// Enviar lista de usuarios actualizada
 	h.broadcastUserList()
+	h.publishPresence()
 
 	// Enviar mensaje de sistema
 	joinMsg := NewSystemMessage(client.username + " se ha unido al chat")
 	joinMsg.Type = MessageTypeJoin
 
-	if msgBytes, err := json.Marshal(joinMsg); err == nil {
-		h.broadcastMessage(msgBytes)
-	} else {
-		log.Printf("Error serializando mensaje de conexión: %v", err)
-	}
+	join := newWireEvent(joinMsg)
+	h.deliverBroadcast(join, true)
+	h.publishEvent(BackplaneBroadcast, "", join)
+	h.emitWebhook(WebhookEventJoin, joinMsg)
 }
 
 // unregisterClient cancela el registro de un cliente del hub
 func (h *Hub) unregisterClient(client *Client) {
 	h.mu.Lock()
 	if _, ok := h.clients[client]; ok {
-		// Eliminar cliente del mapa y cerrar su canal de envío
+		// Eliminar cliente del mapa
 		delete(h.clients, client)
-		close(client.send)
 
 		// Actualizar estado del usuario a desconectado
 		if userStatus, exists := h.userHistory[client.username]; exists {
@@ -194,77 +347,199 @@ func (h *Hub) unregisterClient(client *Client) {
 		clientCount := len(h.clients)
 		h.mu.Unlock()
 
-		log.Printf("🔌 Cliente '%s' desconectado. Total de clientes: %d", client.username, clientCount)
+		// Su shard cierra el canal de envío. Fuera del mutex: si la cola del shard
+		// está llena el envío espera, y no debe bloquear a quien lea el estado del hub
+		h.removeFromShard(client, 0, "")
+
+		client.log().Info("cliente desconectado", "clients", clientCount)
+		go h.releaseClaim(client)
 
 		// Enviar lista de usuarios actualizada
 		h.broadcastUserList()
+		h.publishPresence()
 
 		// Enviar mensaje de sistema
 		leaveMsg := NewSystemMessage(client.username + " ha salido del chat")
 		leaveMsg.Type = MessageTypeLeave
 
-		if msgBytes, err := json.Marshal(leaveMsg); err == nil {
-			h.broadcastMessage(msgBytes)
-		} else {
-			log.Printf("Error serializando mensaje de desconexión: %v", err)
-		}
+		leave := newWireEvent(leaveMsg)
+		h.deliverBroadcast(leave, true)
+		h.publishEvent(BackplaneBroadcast, "", leave)
+		h.emitWebhook(WebhookEventLeave, leaveMsg)
 	} else {
 		h.mu.Unlock()
 	}
 }
 
-// broadcastMessage envía un mensaje a todos los clientes conectados
-func (h *Hub) broadcastMessage(message []byte) {
-	// ⭐ AGREGAR MENSAJE AL HISTORIAL PARA MANTENER CONVERSACIÓN
-	h.addToMessageHistory(message)
+// queueBroadcast encola un evento para difundirlo (no bloquea). Devuelve false si
+// el hub está ocupado. ack indica a quién confirmar el mensaje una vez guardado.
+func (h *Hub) queueBroadcast(event Event, ack *pendingAck) bool {
+	wire := newWireEvent(event)
+	wire.ack = ack
 
-	h.mu.RLock()
-	clients := make([]*Client, 0, len(h.clients))
-	for client := range h.clients {
-		clients = append(clients, client)
+	// En un clúster el JSON se genera aquí y no en el loop del hub, que lo publica
+	if h.backplane != nil {
+		wire.encode(EncodingJSON)
 	}
-	h.mu.RUnlock()
 
-	// Debug: mostrar qué se está enviando
-	log.Printf("📤 Enviando mensaje a %d clientes", len(clients))
+	select {
+	case h.broadcast <- wire:
+		return true
+	default:
+		return false
+	}
+}
 
-	// Enviar mensaje a cada cliente
-	for _, client := range clients {
-		select {
-		case client.send <- message:
-			// Mensaje enviado exitosamente
-		default:
-			// El canal del cliente está lleno o cerrado
-			h.mu.Lock()
-			delete(h.clients, client)
-			h.mu.Unlock()
-			close(client.send)
-			log.Printf("Cliente '%s' eliminado por canal bloqueado", client.username)
+// deliverBroadcast guarda los mensajes de chat en el historial y reparte el evento
+// entre los shards. notify indica si se emiten los webhooks y se guardan las
+// menciones para usuarios desconectados (solo en el nodo de origen).
+func (h *Hub) deliverBroadcast(event *wireEvent, notify bool) {
+	h.metrics.MessagesTotal.Inc(event.event.EventType())
+
+	// ⭐ AGREGAR MENSAJE AL HISTORIAL PARA MANTENER CONVERSACIÓN
+	msg, isMessage := event.event.(*Message)
+	if isMessage {
+		h.addToMessageHistory(msg, notify)
+		// Las menciones las guarda solo el nodo de origen: cada nodo tiene su
+		// propia cola y todos reciben el mensaje por el backplane
+		if notify {
+			h.queueMentions(msg)
 		}
 	}
-}
 
-// ⭐ NUEVO: addToMessageHistory agrega un mensaje al historial
-func (h *Hub) addToMessageHistory(messageBytes []byte) {
-	var msg Message
-	if err := json.Unmarshal(messageBytes, &msg); err != nil {
-		log.Printf("❌ Error parseando mensaje para historial: %v", err)
-		return
+	slog.Debug("difundiendo evento", "type", event.event.EventType(), "shards", len(h.shards))
+	h.fanOut(event)
+
+	// El autor recibe la confirmación después de su propio mensaje
+	if isMessage && event.ack != nil {
+		h.sendAck(event.ack, msg.ID)
 	}
+}
 
+// ⭐ NUEVO: addToMessageHistory agrega un mensaje al historial y, si notify, lo
+// envía a los webhooks
+func (h *Hub) addToMessageHistory(msg *Message, notify bool) {
 	// Solo agregar mensajes de chat al historial (no mensajes del sistema de conexión/desconexión)
 	if msg.Type == MessageTypeMessage {
 		h.mu.Lock()
-		h.messageHistory = append(h.messageHistory, &msg)
+		h.messageHistory = append(h.messageHistory, msg)
 
 		// Mantener solo los últimos N mensajes
+		var evicted *Message
 		if len(h.messageHistory) > h.maxHistorySize {
 			// Eliminar el mensaje más antiguo
+			evicted = h.messageHistory[0]
 			h.messageHistory = h.messageHistory[1:]
 		}
 		h.mu.Unlock()
 
-		log.Printf("📜 Mensaje agregado al historial. Total: %d mensajes", len(h.messageHistory))
+		// Liberar la referencia al adjunto del mensaje que sale del historial
+		if evicted != nil {
+			h.releaseAttachment(evicted)
+		}
+
+		slog.Debug("mensaje agregado al historial", "messageId", msg.ID, "user", msg.Username)
+
+		// Los mensajes de chat que quedan en el historial son los que se notifican
+		if notify {
+			h.emitWebhook(WebhookEventMessage, msg)
+		}
+	}
+}
+
+// SetAttachmentStore activa el almacenamiento deduplicado de adjuntos
+func (h *Hub) SetAttachmentStore(store AttachmentStore) {
+	h.attachments = NewAttachmentManager(store)
+}
+
+// retainAttachment suma una referencia al adjunto de un mensaje, si tiene
+func (h *Hub) retainAttachment(msg *Message) {
+	if h.attachments != nil && msg.HasImage && msg.Image != nil && msg.Image.Hash != "" {
+		h.attachments.Retain(msg.Image.Hash, msg.Image.Type, msg.Image.Size)
+	}
+}
+
+// releaseAttachment libera la referencia al adjunto de un mensaje, si tiene
+func (h *Hub) releaseAttachment(msg *Message) {
+	if h.attachments != nil && msg.HasImage && msg.Image != nil && msg.Image.Hash != "" {
+		h.attachments.Release(msg.Image.Hash)
+	}
+}
+
+// sendDirect encola un evento para un único usuario (no bloquea)
+func (h *Hub) sendDirect(username string, event *wireEvent) bool {
+	select {
+	case h.direct <- &directMessage{to: username, event: event}:
+		return true
+	default:
+		slog.Warn("hub ocupado, mensaje directo descartado", "to", username)
+		h.metrics.MessagesDropped.Inc("direct_queue_full")
+		return false
+	}
+}
+
+// deliverDirect entrega un mensaje directo desde el loop del hub. Devuelve false
+// si el destinatario no está conectado a este nodo.
+func (h *Hub) deliverDirect(dm *directMessage) bool {
+	h.mu.RLock()
+	var recipients []*Client
+	if dm.client != nil {
+		// Si la conexión ya se dio de baja el evento se descarta
+		if _, ok := h.clients[dm.client]; ok {
+			recipients = append(recipients, dm.client)
+		}
+	} else {
+		for client := range h.clients {
+			if client.username == dm.to {
+				recipients = append(recipients, client)
+			}
+		}
+	}
+	h.mu.RUnlock()
+
+	// Fuera del mutex: si la cola del shard está llena el envío espera
+	for _, client := range recipients {
+		h.sendToClient(client, dm.event)
+		h.metrics.MessagesTotal.Inc("direct")
+	}
+	return len(recipients) > 0 || dm.client != nil
+}
+
+// routeCommand envía el comando a los bots conectados que lo atienden.
+// Devuelve false si ningún bot lo atiende (se trata como mensaje normal).
+func (h *Hub) routeCommand(from *Client, command, args string) bool {
+	h.mu.RLock()
+	var bots []string
+	for client := range h.clients {
+		if client.handlesCommand(command) {
+			bots = append(bots, client.username)
+		}
+	}
+	bots = append(bots, h.remoteBotsFor(command)...)
+	h.mu.RUnlock()
+
+	if len(bots) == 0 {
+		return false
+	}
+
+	event := newWireEvent(&CommandEvent{
+		Type:      EventTypeCommand,
+		Command:   command,
+		Args:      args,
+		Username:  from.username,
+		Timestamp: time.Now(),
+	})
+
+	for _, bot := range bots {
+		h.sendDirect(bot, event)
+	}
+	return true
+}
+
+// emitWebhook encola un evento para los webhooks salientes (no bloquea)
+func (h *Hub) emitWebhook(event string, data interface{}) {
+	if h.webhooks != nil {
+		h.webhooks.Dispatch(event, data)
 	}
 }
 
@@ -279,24 +554,18 @@ func (h *Hub) broadcastUserList() {
 			Connected:   userStatus.Connected,
 			LastSeen:    userStatus.LastSeen,
 			ConnectedAt: userStatus.ConnectedAt,
+			Bot:         userStatus.Bot,
 		}
 		users = append(users, userCopy)
 	}
+	users = h.mergeRemoteUsers(users)
 	h.mu.RUnlock()
 
-	// Crear mensaje con la lista de usuarios
-	userListMsg := map[string]interface{}{
-		"type":  "userList",
-		"users": users,
-	}
-
-	log.Printf("👥 Enviando lista de %d usuarios a todos los clientes", len(users))
+	slog.Debug("difundiendo lista de usuarios", "users", len(users))
 
-	if msgBytes, err := json.Marshal(userListMsg); err == nil {
-		h.broadcastMessage(msgBytes)
-	} else {
-		log.Printf("❌ Error serializando lista de usuarios: %v", err)
-	}
+	// La lista no va al historial: se reparte directamente a los shards
+	h.metrics.MessagesTotal.Inc(EventTypeUserList)
+	h.fanOut(newWireEvent(&UserListEvent{Type: EventTypeUserList, Users: users}))
 }
 
 // GetClientCount devuelve el número actual de clientes conectados de forma thread-safe
@@ -319,6 +588,15 @@ func (h *Hub) GetConnectedUsers() []string {
 	return users
 }
 
+// isKnownUser indica si el nombre es de una cuenta registrada o de un usuario
+// conectado a este nodo
+func (h *Hub) isKnownUser(username string) bool {
+	if h.auth != nil && h.auth.accounts.Exists(username) {
+		return true
+	}
+	return containsString(h.GetConnectedUsers(), username)
+}
+
 // GetUserHistory devuelve el historial de todos los usuarios
 func (h *Hub) GetUserHistory() map[string]*UserStatus {
 	h.mu.RLock()
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// incomingHookPrefix es la ruta del endpoint público de webhooks entrantes
+const incomingHookPrefix = "/api/hooks/"
+
+// defaultRoom es la única sala del chat; se acepta explícitamente en los payloads
+const defaultRoom = "general"
+
+// maxIncomingHookBody limita el tamaño del JSON aceptado por un webhook entrante
+const maxIncomingHookBody = 64 * 1024
+
+// IncomingHook permite a scripts publicar mensajes como un usuario bot
+type IncomingHook struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`      // Nombre del bot que firma los mensajes
+	TokenHash string    `json:"tokenHash"` // SHA-256 del token; el token solo se muestra al crearlo
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// IncomingHookPayload es el JSON que aceptan los webhooks entrantes
+type IncomingHookPayload struct {
+	Content  string `json:"content"`
+	Username string `json:"username,omitempty"` // Firma el mensaje como "<nombre del hook>/<username>"
+	Room     string `json:"room,omitempty"`
+}
+
+// IncomingHookRegistry guarda los webhooks entrantes indexados por el hash de su token
+type IncomingHookRegistry struct {
+	hooks     map[string]*IncomingHook
+	storePath string
+	mu        sync.RWMutex
+}
+
+// NewIncomingHookRegistry crea el registro y carga los hooks persistidos
+func NewIncomingHookRegistry(storePath string) *IncomingHookRegistry {
+	r := &IncomingHookRegistry{
+		hooks:     make(map[string]*IncomingHook),
+		storePath: storePath,
+	}
+
+	if err := r.load(); err != nil {
+		slog.Error("error cargando webhooks entrantes", "path", storePath, "error", err)
+	}
+	return r
+}
+
+// Create registra un hook nuevo y devuelve el token en claro (única vez que se ve)
+func (r *IncomingHookRegistry) Create(name string) (*IncomingHook, string, error) {
+	if !validateUsername(name) {
+		return nil, "", errors.New("nombre de bot inválido")
+	}
+
+	token := randomHex(24)
+	hook := &IncomingHook{
+		ID:        randomHex(8),
+		Name:      name,
+		TokenHash: sha256Hex([]byte(token)),
+		CreatedAt: time.Now(),
+	}
+
+	r.mu.Lock()
+	r.hooks[hook.TokenHash] = hook
+	err := r.saveLocked()
+	r.mu.Unlock()
+
+	if err != nil {
+		slog.Error("error persistiendo webhooks entrantes", "error", err)
+	}
+
+	slog.Info("webhook entrante creado", "hook", hook.ID, "bot", hook.Name)
+	return hook, token, nil
+}
+
+// Remove elimina un hook por su ID
+func (r *IncomingHookRegistry) Remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for tokenHash, hook := range r.hooks {
+		if hook.ID == id {
+			delete(r.hooks, tokenHash)
+			if err := r.saveLocked(); err != nil {
+				slog.Error("error persistiendo webhooks entrantes", "error", err)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// List devuelve los hooks registrados sin el hash del token
+func (r *IncomingHookRegistry) List() []IncomingHook {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	list := make([]IncomingHook, 0, len(r.hooks))
+	for _, hook := range r.hooks {
+		hookCopy := *hook
+		hookCopy.TokenHash = ""
+		list = append(list, hookCopy)
+	}
+	return list
+}
+
+// Lookup busca el hook correspondiente a un token
+func (r *IncomingHookRegistry) Lookup(token string) (*IncomingHook, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hook, exists := r.hooks[sha256Hex([]byte(token))]
+	return hook, exists
+}
+
+// load lee los hooks persistidos
+func (r *IncomingHookRegistry) load() error {
+	if r.storePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(r.storePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var hooks []*IncomingHook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		r.hooks[hook.TokenHash] = hook
+	}
+	return nil
+}
+
+// saveLocked persiste los hooks. Requiere r.mu tomado.
+func (r *IncomingHookRegistry) saveLocked() error {
+	if r.storePath == "" {
+		return nil
+	}
+
+	hooks := make([]*IncomingHook, 0, len(r.hooks))
+	for _, hook := range r.hooks {
+		hooks = append(hooks, hook)
+	}
+
+	data, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(r.storePath), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(r.storePath, data, 0o600)
+}
+
+// serveIncomingHook publica en el chat el mensaje recibido en POST /api/hooks/{token}
+func serveIncomingHook(hub *Hub, registry *IncomingHookRegistry, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimPrefix(r.URL.Path, incomingHookPrefix)
+	hook, exists := registry.Lookup(token)
+	if token == "" || !exists {
+		requestLogger(r).Warn("webhook entrante con token desconocido", "ip", clientIP(r))
+		http.Error(w, "Webhook no encontrado", http.StatusNotFound)
+		return
+	}
+
+	var payload IncomingHookPayload
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxIncomingHookBody)).Decode(&payload); err != nil {
+		http.Error(w, "JSON inválido", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(payload.Content) == "" {
+		http.Error(w, "El campo 'content' es obligatorio", http.StatusBadRequest)
+		return
+	}
+
+	// El servidor tiene una única sala; cualquier otra se rechaza explícitamente
+	if payload.Room != "" && payload.Room != defaultRoom {
+		http.Error(w, "Sala desconocida: "+payload.Room, http.StatusBadRequest)
+		return
+	}
+
+	// El hook solo puede firmar con su nombre o con un nombre dentro de su espacio
+	// ("ci-bot/deploy"), nunca suplantar a un usuario
+	username := hook.Name
+	if payload.Username != "" {
+		if !validateUsername(payload.Username) {
+			http.Error(w, "Nombre de usuario inválido", http.StatusBadRequest)
+			return
+		}
+		username = hook.Name + "/" + payload.Username
+	}
+	if hub.isKnownUser(username) {
+		requestLogger(r).Warn("webhook entrante rechazado: el nombre pertenece a un usuario", "hook", hook.ID, "user", username)
+		http.Error(w, "El nombre pertenece a un usuario registrado o conectado", http.StatusConflict)
+		return
+	}
+
+	msg := NewMessage(username, payload.Content)
+	msg.Bot = true
+
+	// Misma cadena de interceptores que los mensajes de readPump (filtro, spam,
+	// enlaces...), con un cliente sin conexión que representa al hook
+	sender := &Client{
+		hub:      hub,
+		username: username,
+		role:     RoleBot,
+		ip:       clientIP(r),
+		logger:   requestLogger(r).With("hook", hook.ID, "user", username),
+	}
+	if err := hub.pipeline.Process(&MessageContext{Client: sender, Message: msg}); err != nil {
+		var reject *RejectError
+		switch {
+		case errors.As(err, &reject):
+			hub.metrics.MessagesDropped.Inc("rejected")
+			http.Error(w, reject.Reason, http.StatusUnprocessableEntity)
+		case errors.Is(err, ErrMessageHandled):
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": "handled", "username": username})
+		default:
+			hub.metrics.MessagesDropped.Inc("filtered")
+			writeJSON(w, http.StatusAccepted, map[string]interface{}{"status": "dropped", "username": username})
+		}
+		return
+	}
+
+	if !hub.queueBroadcast(msg, nil) {
+		requestLogger(r).Warn("hub ocupado, mensaje de webhook entrante descartado", "hook", hook.ID)
+		hub.metrics.MessagesDropped.Inc("hub_busy")
+		http.Error(w, "Servidor ocupado, reintenta más tarde", http.StatusServiceUnavailable)
+		return
+	}
+	requestLogger(r).Debug("mensaje de webhook entrante publicado", "hook", hook.ID, "user", username, "messageId", msg.ID)
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"status":    "accepted",
+		"username":  username,
+		"timestamp": msg.Timestamp,
+	})
+}
+
+// serveIncomingHooksAdmin gestiona los webhooks entrantes: GET lista, POST crea, DELETE ?id= elimina
+func serveIncomingHooksAdmin(registry *IncomingHookRegistry, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{"hooks": registry.List()})
+
+	case "POST":
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxIncomingHookBody)).Decode(&req); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+
+		hook, token, err := registry.Create(req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, map[string]interface{}{
+			"id":    hook.ID,
+			"name":  hook.Name,
+			"token": token,
+			"url":   incomingHookPrefix + token,
+		})
+
+	case "DELETE":
+		if !registry.Remove(r.URL.Query().Get("id")) {
+			http.Error(w, "Webhook no encontrado", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
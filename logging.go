@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// logMessageContent indica si los logs pueden incluir el texto de los mensajes
+// (LOG_MESSAGE_CONTENT). Por defecto solo se registra su longitud.
+var logMessageContent = false
+
+// configureLogging configura el logger global de slog: LOG_LEVEL (debug, info,
+// warn, error), LOG_FORMAT (text o json) y LOG_MESSAGE_CONTENT (true/false).
+// Los log.Printf que queden también pasan por este logger.
+func configureLogging() {
+	logMessageContent = os.Getenv("LOG_MESSAGE_CONTENT") == "true"
+	slog.SetDefault(slog.New(newLogHandler(os.Stdout, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))))
+}
+
+// newLogHandler crea el handler de slog con el formato y nivel indicados
+func newLogHandler(w io.Writer, format, level string) slog.Handler {
+	options := &slog.HandlerOptions{Level: parseLogLevel(level)}
+	if strings.EqualFold(format, "json") {
+		return slog.NewJSONHandler(w, options)
+	}
+	return slog.NewTextHandler(w, options)
+}
+
+// parseLogLevel traduce el nivel configurado (info por defecto)
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// contentAttr registra el texto de un mensaje solo si LOG_MESSAGE_CONTENT lo permite;
+// si no, solo su longitud
+func contentAttr(content string) slog.Attr {
+	if logMessageContent {
+		return slog.String("content", content)
+	}
+	return slog.Int("contentLength", len(content))
+}
+
+// requestIDHeader es la cabecera con el identificador de la petición
+const requestIDHeader = "X-Request-ID"
+
+// requestLoggerKey es la clave del logger de la petición en el contexto
+type requestLoggerKey struct{}
+
+// withRequestID asigna un identificador a cada petición (o respeta el del proxy),
+// lo devuelve en X-Request-ID y deja en el contexto un logger que lo incluye
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 64 {
+			id = randomHex(8)
+		}
+		w.Header().Set(requestIDHeader, id)
+
+		logger := slog.Default().With("requestId", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestLoggerKey{}, logger)))
+	})
+}
+
+// requestLogger devuelve el logger de la petición (o el global si no pasó por withRequestID)
+func requestLogger(r *http.Request) *slog.Logger {
+	if logger, ok := r.Context().Value(requestLoggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// fatal registra un error de arranque y termina el proceso
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
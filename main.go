@@ -1,14 +1,78 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
+	// Logs estructurados (LOG_LEVEL, LOG_FORMAT, LOG_MESSAGE_CONTENT)
+	configureLogging()
+
+	// ⭐ Ajustes por despliegue: archivo YAML/JSON, variables de entorno y flags
+	cfg, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		fatal("configuración inválida", "error", err)
+	}
+
+	// ⭐ Proxies cuyo X-Forwarded-For se respeta
+	configureTrustedProxies()
+
 	// Crear el hub de chat
-	hub := NewHub()
+	hub := NewHubWithConfig(cfg)
+
+	// ⭐ Almacenamiento de adjuntos direccionado por contenido
+	configureAttachments(hub)
+
+	// ⭐ Historial guardado en el último apagado
+	historyPath := envOrDefault("HISTORY_FILE", "./data/history.json")
+	if err := hub.LoadHistory(historyPath); err != nil {
+		slog.Error("error restaurando historial", "path", historyPath, "error", err)
+	}
+
+	// ⭐ Cuotas de subida por rol
+	configureUploadQuota(hub)
+
+	// ⭐ Webhooks salientes (asíncronos, firmados con HMAC)
+	hub.webhooks = NewWebhookDispatcher(
+		envOrDefault("WEBHOOKS_FILE", "./data/webhooks.json"),
+		envOrDefault("WEBHOOK_DEADLETTER_FILE", "./data/webhooks-deadletter.jsonl"),
+	)
+	go hub.webhooks.Run()
+
+	// ⭐ Webhooks entrantes para publicar mensajes desde scripts
+	incomingHooks := NewIncomingHookRegistry(envOrDefault("INCOMING_HOOKS_FILE", "./data/incoming-hooks.json"))
+
+	// ⭐ Cuentas de bot para la API de bots sobre WebSocket
+	hub.bots = NewBotRegistry(envOrDefault("BOTS_FILE", "./data/bots.json"))
+
+	// ⭐ Filtro de palabras con recarga en caliente
+	configureContentFilter(hub)
+
+	// ⭐ Detección de spam
+	configureSpamDetection(hub)
+
+	// ⭐ Cuentas registradas con contraseña y tokens de sesión
+	configureAuth(hub)
+
+	// ⭐ Tokens JWT del gateway de SSO (portal interno)
+	configureSSO(hub)
+
+	// ⭐ Orígenes permitidos para el WebSocket
+	configureOrigins(hub)
+
+	// ⭐ Varias instancias detrás del balanceador (backplane en Redis)
+	configureBackplane(hub)
+
+	// API de administración protegida por ADMIN_TOKEN
+	admin := &adminAuth{token: os.Getenv("ADMIN_TOKEN")}
 
 	// Iniciar el hub en una goroutine separada
 	go hub.Run()
@@ -19,29 +83,87 @@ func main() {
 		serveWS(hub, w, r)
 	})
 
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		serveHealthz(hub, w, r)
+	})
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveReadyz(hub, w, r)
+	})
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		serveMetrics(hub, w, r)
+	})
+
+	http.HandleFunc("/api/protocol", serveProtocol)
+	http.HandleFunc("/api/admin/config", admin.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		serveConfigAdmin(cfg, w, r)
+	}))
+	http.HandleFunc("/api/admin/webhooks", admin.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		serveWebhooksAdmin(hub.webhooks, w, r)
+	}))
+	http.HandleFunc("/api/register", hub.auth.serveRegister)
+	http.HandleFunc("/api/login", hub.auth.serveLogin)
+	http.HandleFunc("/api/admin/accounts", admin.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		serveAccountsAdmin(hub.auth.accounts, w, r)
+	}))
+	http.HandleFunc("/api/admin/bots", admin.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		serveBotsAdmin(hub.bots, w, r)
+	}))
+	http.HandleFunc("/api/admin/incoming-hooks", admin.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		serveIncomingHooksAdmin(incomingHooks, w, r)
+	}))
+	http.HandleFunc(incomingHookPrefix, func(w http.ResponseWriter, r *http.Request) {
+		serveIncomingHook(hub, incomingHooks, w, r)
+	})
+	http.HandleFunc(attachmentURLPrefix, func(w http.ResponseWriter, r *http.Request) {
+		serveAttachment(hub, w, r)
+	})
+
 	// Servir archivos estáticos desde el directorio ./static/
 	fs := http.FileServer(http.Dir("./static/"))
 	http.Handle("/static/", http.StripPrefix("/static/", fs))
 
-	// ⭐ RAILWAY: Obtener puerto de variable de entorno
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080" // Puerto por defecto para desarrollo local
-	}
+	// ⭐ RAILWAY: el puerto llega en PORT (8080 por defecto para desarrollo local)
+	port := cfg.Port
 
 	// Información de inicio
-	log.Println("🚀 GO O NO GO - Servidor de chat iniciado")
-	log.Printf("📡 Puerto: %s", port)
-	log.Println("💬 WebSocket endpoint: /ws")
-	log.Println("🖼️ Soporte para imágenes habilitado (máx. 5MB)")
-	log.Println("📁 Archivos estáticos servidos desde: ./static/")
-	log.Println("✅ Servidor listo para recibir conexiones...")
-
-	// ⭐ RAILWAY: Usar puerto dinámico
-	err := http.ListenAndServe(":"+port, nil)
-	if err != nil {
-		log.Fatal("❌ Error iniciando servidor HTTP:", err)
+	slog.Info("GO O NO GO - servidor de chat iniciado",
+		"port", port, "websocket", "/ws", "maxImageBytes", cfg.MaxImageSize, "static", "./static/", "config", cfg.source)
+
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           withRequestID(http.DefaultServeMux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// ⭐ TLS propio para despliegues sin proxy que termine HTTPS
+	certs, redirect := configureTLS(port)
+	servers := []*http.Server{server}
+	if redirect != nil {
+		servers = append(servers, redirect)
 	}
+
+	go func() {
+		var err error
+		if certs != nil {
+			server.TLSConfig = newTLSConfig(certs)
+			slog.Info("HTTPS habilitado", "port", port)
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			// ⭐ RAILWAY: Usar puerto dinámico
+			err = server.ListenAndServe()
+		}
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fatal("error iniciando servidor HTTP", "error", err)
+		}
+	}()
+
+	// ⭐ RAILWAY: cada redeploy envía SIGTERM; apagar avisando a los clientes
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+
+	gracefulShutdown(servers, hub, historyPath, envDuration("SHUTDOWN_TIMEOUT", 10*time.Second))
 }
 
 // serveHome sirve la página principal del chat
@@ -66,3 +188,303 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 	// Servir el archivo index.html
 	http.ServeFile(w, r, "index.html")
 }
+
+// envOrDefault devuelve la variable de entorno o el valor por defecto si está vacía
+func envOrDefault(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// configureAttachments selecciona el backend de adjuntos según variables de entorno:
+// ATTACHMENTS_BACKEND=disk (por defecto), s3 o inline (imágenes en base64 como antes)
+func configureAttachments(hub *Hub) {
+	switch backend := os.Getenv("ATTACHMENTS_BACKEND"); backend {
+	case "", "disk":
+		dir := envOrDefault("ATTACHMENTS_DIR", "./data/attachments")
+		store, err := NewDiskStore(dir)
+		if err != nil {
+			fatal("error inicializando almacén de adjuntos", "dir", dir, "error", err)
+		}
+		hub.SetAttachmentStore(store)
+		slog.Info("adjuntos en disco", "dir", dir)
+
+	case "s3":
+		store := NewS3Store(
+			os.Getenv("S3_ENDPOINT"),
+			os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY"),
+			os.Getenv("S3_SECRET_KEY"),
+		)
+		store.Prefix = os.Getenv("S3_PREFIX")
+		hub.SetAttachmentStore(store)
+		slog.Info("adjuntos en S3", "endpoint", store.Endpoint, "bucket", store.Bucket)
+
+	case "inline":
+		slog.Info("adjuntos en línea (sin deduplicación)")
+
+	default:
+		fatal("ATTACHMENTS_BACKEND desconocido", "value", backend)
+	}
+}
+
+// configureUploadQuota ajusta las cuotas de subida según variables de entorno:
+// UPLOAD_QUOTA_BYTES (límite por defecto, 0 = sin límite), UPLOAD_QUOTA_WINDOW
+// (duración, p. ej. "1h") y UPLOAD_QUOTA_ROLES ("guest=10485760,admin=0")
+func configureUploadQuota(hub *Hub) {
+	window := envDuration("UPLOAD_QUOTA_WINDOW", defaultUploadQuotaWindow)
+
+	limit := int64(defaultUploadQuotaBytes)
+	if value := os.Getenv("UPLOAD_QUOTA_BYTES"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			fatal("UPLOAD_QUOTA_BYTES inválido", "value", value)
+		}
+		limit = parsed
+	}
+
+	quota := NewUploadQuota(window, limit)
+
+	roleLimits, err := ParseRoleLimits(os.Getenv("UPLOAD_QUOTA_ROLES"))
+	if err != nil {
+		fatal("UPLOAD_QUOTA_ROLES inválido", "error", err)
+	}
+	for role, roleLimit := range roleLimits {
+		quota.SetRoleLimit(role, roleLimit)
+	}
+
+	hub.uploadQuota = quota
+	slog.Info("cuota de subida configurada", "bytes", limit, "window", window, "roles", roleLimits)
+}
+
+// configureContentFilter carga el filtro de contenido desde FILTER_FILE
+// (por defecto ./data/filter.json) y lo recarga cuando el archivo cambia
+func configureContentFilter(hub *Hub) {
+	path := envOrDefault("FILTER_FILE", "./data/filter.json")
+
+	filter, err := NewContentFilter(path)
+	if err != nil {
+		fatal("error cargando filtro de contenido", "path", path, "error", err)
+	}
+
+	hub.contentFilter = filter
+	go filter.Watch(5 * time.Second)
+	slog.Info("filtro de contenido activo", "path", path)
+}
+
+// configureSpamDetection ajusta el detector de spam con SPAM_ACTION (drop, warn, mute),
+// SPAM_WINDOW, SPAM_MAX_DUPLICATES, SPAM_MAX_LINKS, SPAM_MAX_MENTIONS y SPAM_MUTE_DURATION
+func configureSpamDetection(hub *Hub) {
+	config := DefaultSpamConfig()
+
+	switch action := envOrDefault("SPAM_ACTION", config.Action); action {
+	case SpamActionDrop, SpamActionWarn, SpamActionMute:
+		config.Action = action
+	case "off":
+		hub.spamDetector = nil
+		slog.Info("detección de spam deshabilitada")
+		return
+	default:
+		fatal("SPAM_ACTION inválido", "value", action)
+	}
+
+	config.Window = envDuration("SPAM_WINDOW", config.Window)
+	config.MuteDuration = envDuration("SPAM_MUTE_DURATION", config.MuteDuration)
+	config.MaxDuplicates = envInt("SPAM_MAX_DUPLICATES", config.MaxDuplicates)
+	config.MaxLinks = envInt("SPAM_MAX_LINKS", config.MaxLinks)
+	config.MaxMentions = envInt("SPAM_MAX_MENTIONS", config.MaxMentions)
+
+	hub.spamDetector = NewSpamDetector(config)
+	slog.Info("detección de spam configurada", "action", config.Action, "window", config.Window,
+		"maxDuplicates", config.MaxDuplicates, "maxLinks", config.MaxLinks, "maxMentions", config.MaxMentions)
+}
+
+// envDuration lee una duración de una variable de entorno o termina si es inválida
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		fatal("variable de entorno inválida", "name", name, "value", value)
+	}
+	return parsed
+}
+
+// envInt lee un entero no negativo de una variable de entorno o termina si es inválido
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 0 {
+		fatal("variable de entorno inválida", "name", name, "value", value)
+	}
+	return parsed
+}
+
+// configureAuth habilita las cuentas registradas: ACCOUNTS_FILE, SESSION_SECRET,
+// SESSION_TTL, ALLOW_GUESTS (por defecto true), GUEST_PREFIX (por defecto "guest-") y
+// AUTH_RATE_LIMIT/AUTH_RATE_WINDOW (intentos por IP, 0 para no limitar)
+func configureAuth(hub *Hub) {
+	accounts, err := NewAccountStore(envOrDefault("ACCOUNTS_FILE", "./data/accounts.json"))
+	if err != nil {
+		fatal("error cargando cuentas", "error", err)
+	}
+
+	secret := []byte(os.Getenv("SESSION_SECRET"))
+	if len(secret) == 0 {
+		secret = []byte(randomHex(32))
+		slog.Warn("SESSION_SECRET no configurado: las sesiones se invalidarán al reiniciar")
+	}
+
+	allowGuests := envOrDefault("ALLOW_GUESTS", "true") != "false"
+	guestPrefix := envOrDefault("GUEST_PREFIX", "guest-")
+	signer := NewTokenSigner(secret, envDuration("SESSION_TTL", 24*time.Hour))
+
+	hub.auth = NewAuthService(accounts, signer, allowGuests, guestPrefix)
+	hub.auth.limiter = nil
+	if attempts := envInt("AUTH_RATE_LIMIT", defaultAuthAttempts); attempts > 0 {
+		hub.auth.limiter = NewIPLimiter(attempts, envDuration("AUTH_RATE_WINDOW", time.Minute))
+	}
+	slog.Info("cuentas habilitadas", "allowGuests", allowGuests, "guestPrefix", guestPrefix)
+}
+
+// configureSSO acepta los JWT del gateway de SSO en /ws. Se habilita con
+// SSO_JWT_SECRET (HS256) o SSO_PUBLIC_KEY_FILE (RS256, PEM). Opcionales:
+// SSO_ISSUER, SSO_AUDIENCE, SSO_USERNAME_CLAIM, SSO_ROLES_CLAIM,
+// SSO_ADMIN_ROLES, SSO_MODERATOR_ROLES y TOKEN_COOKIE.
+func configureSSO(hub *Hub) {
+	tokenCookieName = envOrDefault("TOKEN_COOKIE", tokenCookieName)
+
+	var verifier *JWTVerifier
+	if secret := os.Getenv("SSO_JWT_SECRET"); secret != "" {
+		verifier = NewHMACVerifier([]byte(secret))
+	} else if keyFile := os.Getenv("SSO_PUBLIC_KEY_FILE"); keyFile != "" {
+		pemData, err := os.ReadFile(keyFile)
+		if err != nil {
+			fatal("error leyendo clave pública del SSO", "path", keyFile, "error", err)
+		}
+		verifier, err = NewRSAVerifier(pemData)
+		if err != nil {
+			fatal("clave pública del SSO inválida", "path", keyFile, "error", err)
+		}
+	} else {
+		return
+	}
+
+	verifier.Issuer = os.Getenv("SSO_ISSUER")
+	verifier.Audience = os.Getenv("SSO_AUDIENCE")
+	if claim := os.Getenv("SSO_USERNAME_CLAIM"); claim != "" {
+		verifier.UsernameClaims = []string{claim}
+	}
+	verifier.RolesClaim = envOrDefault("SSO_ROLES_CLAIM", verifier.RolesClaim)
+	if roles := os.Getenv("SSO_ADMIN_ROLES"); roles != "" {
+		verifier.AdminRoles = stringList(roles)
+	}
+	if roles := os.Getenv("SSO_MODERATOR_ROLES"); roles != "" {
+		verifier.ModeratorRoles = stringList(roles)
+	}
+
+	hub.sso = verifier
+	slog.Info("SSO habilitado", "alg", verifier.alg, "issuer", verifier.Issuer, "audience", verifier.Audience)
+}
+
+// configureOrigins lee ALLOWED_ORIGINS (lista separada por comas; "*" = cualquiera,
+// solo para desarrollo) y añade el dominio público de Railway si existe
+func configureOrigins(hub *Hub) {
+	entries := strings.Split(os.Getenv("ALLOWED_ORIGINS"), ",")
+	if domain := os.Getenv("RAILWAY_PUBLIC_DOMAIN"); domain != "" {
+		entries = append(entries, "https://"+domain)
+	}
+
+	hub.origins = NewOriginPolicy(entries)
+	if hub.origins.AllowAll() {
+		slog.Warn("ALLOWED_ORIGINS=*: cualquier web puede abrir un WebSocket (solo para desarrollo)")
+		return
+	}
+	slog.Info("orígenes permitidos configurados", "patterns", len(hub.origins.patterns))
+}
+
+// configureTrustedProxies lee TRUSTED_PROXIES: redes CIDR o IPs separadas por comas
+// de los proxies delante del servidor. Sin ella se ignora X-Forwarded-For.
+func configureTrustedProxies() {
+	proxies, err := ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		fatal("TRUSTED_PROXIES inválido", "error", err)
+	}
+	trustedProxies = proxies
+	if len(proxies) == 0 {
+		slog.Info("sin proxies de confianza: se ignora X-Forwarded-For")
+		return
+	}
+	slog.Info("proxies de confianza configurados", "networks", len(proxies))
+}
+
+// configureTLS carga TLS_CERT_FILE y TLS_KEY_FILE (recargados en caliente al cambiar)
+// y, si se define TLS_REDIRECT_ADDR (p. ej. ":80"), arranca un listener HTTP que
+// redirige a HTTPS. Devuelve los certificados (nil si TLS no está configurado) y el
+// servidor de redirección (nil si no se arrancó) para apagarlo junto al principal.
+func configureTLS(httpsPort string) (*CertReloader, *http.Server) {
+	certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		fatal("TLS_CERT_FILE y TLS_KEY_FILE deben configurarse juntos")
+	}
+
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		fatal("error cargando certificado TLS", "error", err)
+	}
+	go certs.Watch(envDuration("TLS_RELOAD_INTERVAL", time.Minute))
+
+	var redirect *http.Server
+	if addr := os.Getenv("TLS_REDIRECT_ADDR"); addr != "" {
+		redirect = &http.Server{
+			Addr:              addr,
+			Handler:           httpsRedirectHandler(httpsPort),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			slog.Info("redirección HTTP→HTTPS escuchando", "addr", addr)
+			if err := redirect.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("error en el listener de redirección", "error", err)
+			}
+		}()
+	}
+	return certs, redirect
+}
+
+// configureBackplane conecta este nodo con las demás instancias a través de Redis:
+// BACKPLANE_URL (redis:// o rediss://), BACKPLANE_CHANNEL (por defecto "chat") y
+// NODE_ID (por defecto la réplica de Railway o el hostname con un sufijo aleatorio)
+func configureBackplane(hub *Hub) {
+	rawURL := os.Getenv("BACKPLANE_URL")
+	if rawURL == "" {
+		return
+	}
+
+	node := os.Getenv("NODE_ID")
+	if node == "" {
+		node = os.Getenv("RAILWAY_REPLICA_ID")
+	}
+	if node == "" {
+		hostname, _ := os.Hostname()
+		node = hostname + "-" + randomHex(3)
+	}
+
+	backplane, err := NewRedisBackplane(rawURL, node, envOrDefault("BACKPLANE_CHANNEL", "chat"))
+	if err != nil {
+		fatal("error conectando al backplane", "error", err)
+	}
+	if err := hub.SetBackplane(backplane); err != nil {
+		fatal("error suscribiéndose al backplane", "error", err)
+	}
+	slog.Info("backplane de clúster habilitado", "node", node, "addr", backplane.options.addr, "channel", backplane.channel)
+}
@@ -1,23 +1,33 @@
 package main
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
 
 // ImageData representa los datos de una imagen
 type ImageData struct {
-	Data string `json:"data"` // Base64 data URL
-	Name string `json:"name"` // Nombre del archivo
-	Type string `json:"type"` // MIME type
-	Size int64  `json:"size"` // Tamaño en bytes
+	Data string `json:"data"`           // Base64 data URL o ruta /attachments/<hash>
+	Name string `json:"name"`           // Nombre del archivo
+	Type string `json:"type"`           // MIME type
+	Size int64  `json:"size"`           // Tamaño en bytes
+	Hash string `json:"hash,omitempty"` // SHA-256 del contenido si está en el almacén de adjuntos
 }
 
 // Message representa un mensaje de chat
 type Message struct {
+	ID        string     `json:"id,omitempty"`
 	Username  string     `json:"username"`
 	Content   string     `json:"content"`
 	Timestamp time.Time  `json:"timestamp"`
-	Type      string     `json:"type"`            // "message", "system", "join", "leave"
+	Type      string     `json:"type"`            // "message", "system", "join", "leave", "ephemeral"
 	Image     *ImageData `json:"image,omitempty"` // Datos de imagen opcionales
 	HasImage  bool       `json:"hasImage"`        // Indica si el mensaje tiene imagen
+	Bot       bool       `json:"bot,omitempty"`   // Publicado por un bot (webhook entrante o API de bots)
+
+	// Metadatos añadidos por los interceptores (enlaces detectados, puntuaciones...)
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
 }
 
 // MessageType define los tipos de mensajes
@@ -26,11 +36,20 @@ const (
 	MessageTypeSystem  = "system"
 	MessageTypeJoin    = "join"
 	MessageTypeLeave   = "leave"
+
+	// Mensaje de un bot visible solo para un usuario (no se difunde ni se guarda)
+	MessageTypeEphemeral = "ephemeral"
 )
 
+// EventType implementa Event: los mensajes usan su propio tipo
+func (m *Message) EventType() string {
+	return m.Type
+}
+
 // NewMessage crea un nuevo mensaje de chat
 func NewMessage(username, content string) *Message {
 	return &Message{
+		ID:        randomHex(8),
 		Username:  username,
 		Content:   content,
 		Timestamp: time.Now(),
@@ -42,6 +61,7 @@ func NewMessage(username, content string) *Message {
 // NewMessageWithImage crea un nuevo mensaje de chat con imagen
 func NewMessageWithImage(username, content string, imageData *ImageData) *Message {
 	return &Message{
+		ID:        randomHex(8),
 		Username:  username,
 		Content:   content,
 		Timestamp: time.Now(),
@@ -54,6 +74,7 @@ func NewMessageWithImage(username, content string, imageData *ImageData) *Messag
 // NewSystemMessage crea un nuevo mensaje del sistema
 func NewSystemMessage(content string) *Message {
 	return &Message{
+		ID:        randomHex(8),
 		Username:  "Sistema",
 		Content:   content,
 		Timestamp: time.Now(),
@@ -61,3 +82,24 @@ func NewSystemMessage(content string) *Message {
 		HasImage:  false,
 	}
 }
+
+// NewEphemeralMessage crea un mensaje de bot dirigido a un único usuario
+func NewEphemeralMessage(botName, content string) *Message {
+	return &Message{
+		ID:        randomHex(8),
+		Username:  botName,
+		Content:   content,
+		Timestamp: time.Now(),
+		Type:      MessageTypeEphemeral,
+		Bot:       true,
+	}
+}
+
+// randomHex genera n bytes aleatorios codificados en hex
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CounterVec es un contador de Prometheus con una etiqueta
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	values map[string]float64
+	mu     sync.Mutex
+}
+
+// NewCounterVec crea un contador con la etiqueta indicada ("" = sin etiqueta)
+func NewCounterVec(name, help, label string) *CounterVec {
+	return &CounterVec{name: name, help: help, label: label, values: make(map[string]float64)}
+}
+
+// Inc suma uno al contador de la etiqueta
+func (c *CounterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+// Add suma el valor al contador de la etiqueta
+func (c *CounterVec) Add(labelValue string, value float64) {
+	c.mu.Lock()
+	c.values[labelValue] += value
+	c.mu.Unlock()
+}
+
+// Value devuelve el valor actual del contador de la etiqueta
+func (c *CounterVec) Value(labelValue string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	writeMetricHeader(w, c.name, c.help, "counter")
+	for _, labelValue := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.label, labelValue), formatFloat(c.values[labelValue]))
+	}
+}
+
+// HistogramVec es un histograma de Prometheus con una etiqueta
+type HistogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+	series  map[string]*histogramSeries
+	mu      sync.Mutex
+}
+
+// histogramSeries son los acumulados de una etiqueta
+type histogramSeries struct {
+	counts []uint64 // Uno por bucket, no acumulativos
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec crea un histograma con los límites de bucket indicados (ordenados)
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	return &HistogramVec{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+// Observe registra una observación
+func (h *HistogramVec) Observe(labelValue string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	series, exists := h.series[labelValue]
+	if !exists {
+		series = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = series
+	}
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+			break
+		}
+	}
+	series.sum += value
+	series.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	labelValues := make([]string, 0, len(h.series))
+	for labelValue := range h.series {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		series := h.series[labelValue]
+		base := formatLabels(h.label, labelValue)
+
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += series.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(base, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(base, "le", "+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, base, formatFloat(series.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, base, series.count)
+	}
+}
+
+// Metrics agrupa las métricas del chat que se exponen en /metrics
+type Metrics struct {
+	MessagesTotal      *CounterVec   // Mensajes difundidos por tipo
+	MessagesDropped    *CounterVec   // Mensajes descartados por motivo
+	ImageBytesReceived *CounterVec   // Bytes de imagen recibidos de los clientes
+	HandshakeFailures  *CounterVec   // Conexiones a /ws rechazadas por motivo
+	BackplaneEvents    *CounterVec   // Eventos recibidos de otros nodos por tipo
+	SlowConsumers      *CounterVec   // Clientes con el buffer de envío lleno por acción tomada
+	OfflineMessages    *CounterVec   // Mensajes para usuarios desconectados por resultado
+	CompressedBytes    *CounterVec   // Bytes de los mensajes comprimidos antes (payload) y después (wire)
+	CompressionRatio   *HistogramVec // Tamaño comprimido / tamaño original de cada mensaje
+	HubLoopLatency     *HistogramVec // Tiempo que tarda Hub.Run en atender cada evento
+
+	startedAt time.Time
+}
+
+// NewMetrics crea el conjunto de métricas del chat
+func NewMetrics() *Metrics {
+	return &Metrics{
+		MessagesTotal:      NewCounterVec("chat_messages_total", "Mensajes difundidos por tipo.", "type"),
+		MessagesDropped:    NewCounterVec("chat_messages_dropped_total", "Mensajes descartados por motivo.", "reason"),
+		ImageBytesReceived: NewCounterVec("chat_image_bytes_received_total", "Bytes de imagen recibidos de los clientes.", ""),
+		HandshakeFailures:  NewCounterVec("chat_handshake_failures_total", "Conexiones a /ws rechazadas por motivo.", "reason"),
+		BackplaneEvents:    NewCounterVec("chat_backplane_events_total", "Eventos recibidos de otros nodos por tipo.", "kind"),
+		SlowConsumers:      NewCounterVec("chat_slow_consumers_total", "Veces que un cliente tenía el buffer de envío lleno, por acción tomada.", "action"),
+		OfflineMessages:    NewCounterVec("chat_offline_messages_total", "Mensajes para usuarios desconectados por resultado (queued, delivered, expired, dropped).", "result"),
+		CompressedBytes:    NewCounterVec("chat_ws_compressed_bytes_total", "Bytes de los mensajes enviados con permessage-deflate, antes (payload) y después (wire) de comprimir.", "stage"),
+		CompressionRatio: NewHistogramVec("chat_ws_compression_ratio", "Tamaño comprimido entre tamaño original de cada mensaje enviado con permessage-deflate.", "",
+			[]float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.8, 1}),
+		HubLoopLatency: NewHistogramVec("chat_hub_loop_latency_seconds", "Tiempo que tarda el loop del hub en atender cada evento.", "event",
+			[]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}),
+		startedAt: time.Now(),
+	}
+}
+
+// observeLoop registra la duración de un evento del loop del hub
+func (m *Metrics) observeLoop(event string, start time.Time) {
+	m.HubLoopLatency.Observe(event, time.Since(start).Seconds())
+}
+
+// serveMetrics expone las métricas en formato de texto de Prometheus: GET /metrics
+func serveMetrics(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	// Valores instantáneos que se calculan en cada scrape
+	hub.mu.RLock()
+	clients, bufferTotal, bufferMax := 0, 0, 0
+	for client := range hub.clients {
+		clients++
+		depth := len(client.send)
+		bufferTotal += depth
+		if depth > bufferMax {
+			bufferMax = depth
+		}
+	}
+	history := len(hub.messageHistory)
+	hub.mu.RUnlock()
+
+	writeGauge(w, "chat_connected_clients", "Clientes WebSocket conectados.", float64(clients))
+	writeGauge(w, "chat_send_buffer_messages", "Mensajes pendientes en los buffers de envío de todos los clientes.", float64(bufferTotal))
+	writeGauge(w, "chat_send_buffer_max_messages", "Mensajes pendientes en el buffer de envío más lleno.", float64(bufferMax))
+	writeGauge(w, "chat_broadcast_queue_messages", "Mensajes esperando en la cola de difusión del hub.", float64(len(hub.broadcast)))
+	writeGauge(w, "chat_history_messages", "Mensajes en el historial.", float64(history))
+	writeGauge(w, "chat_uptime_seconds", "Segundos desde el arranque.", time.Since(hub.metrics.startedAt).Seconds())
+
+	hub.metrics.MessagesTotal.write(w)
+	hub.metrics.MessagesDropped.write(w)
+	hub.metrics.ImageBytesReceived.write(w)
+	hub.metrics.HandshakeFailures.write(w)
+	hub.metrics.BackplaneEvents.write(w)
+	hub.metrics.SlowConsumers.write(w)
+	hub.metrics.OfflineMessages.write(w)
+	hub.metrics.CompressedBytes.write(w)
+	hub.metrics.CompressionRatio.write(w)
+	hub.metrics.HubLoopLatency.write(w)
+}
+
+// writeGauge escribe una métrica de tipo gauge sin etiquetas
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeMetricHeader(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+// writeMetricHeader escribe las líneas HELP y TYPE
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// formatLabels devuelve {label="valor"} o "" si la métrica no tiene etiqueta
+func formatLabels(label, value string) string {
+	if label == "" {
+		return ""
+	}
+	return "{" + label + "=" + strconv.Quote(value) + "}"
+}
+
+// withLabel añade una etiqueta a un conjunto ya formateado
+func withLabel(labels, label, value string) string {
+	pair := label + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + pair + "}"
+}
+
+// formatFloat formatea un valor como lo espera Prometheus
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// sortedKeys devuelve las claves del mapa ordenadas
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	// ErrMessageHandled indica que un interceptor ya procesó el mensaje
+	// (p. ej. un comando enrutado a un bot) y no debe difundirse
+	ErrMessageHandled = errors.New("mensaje procesado por un interceptor")
+
+	// ErrMessageDropped indica que el mensaje se descarta sin avisar al cliente
+	ErrMessageDropped = errors.New("mensaje descartado")
+)
+
+// RejectError rechaza un mensaje y se notifica al cliente con su código
+type RejectError struct {
+	Code   string
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
+
+// Reject crea un error de rechazo con código y motivo para el cliente
+func Reject(code, reason string) error {
+	return &RejectError{Code: code, Reason: reason}
+}
+
+// MessageContext es lo que recibe cada interceptor: el mensaje (modificable) y su autor
+type MessageContext struct {
+	Client  *Client
+	Message *Message
+
+	// Bytes reservados en la cuota de subida; se devuelven si el mensaje no se publica
+	quotaBytes int64
+}
+
+// releaseQuota devuelve a la cuota del autor lo reservado para un mensaje que no
+// llegó a publicarse (lo rechazó un interceptor posterior o el hub estaba ocupado)
+func (ctx *MessageContext) releaseQuota() {
+	quota := ctx.Client.hub.uploadQuota
+	if quota == nil || ctx.quotaBytes == 0 {
+		return
+	}
+	quota.Release(ctx.Client.username, ctx.quotaBytes)
+	ctx.quotaBytes = 0
+}
+
+// Annotate añade metadatos al mensaje que viajan al resto de clientes
+func (ctx *MessageContext) Annotate(key string, value interface{}) {
+	if ctx.Message.Annotations == nil {
+		ctx.Message.Annotations = make(map[string]interface{})
+	}
+	ctx.Message.Annotations[key] = value
+}
+
+// MessageInterceptor procesa un mensaje antes de difundirlo. Puede transformarlo
+// o anotarlo modificando ctx.Message, o detener la cadena devolviendo un error
+// (RejectError, ErrMessageDropped o ErrMessageHandled).
+type MessageInterceptor interface {
+	Name() string
+	Intercept(ctx *MessageContext) error
+}
+
+// InterceptorFunc adapta una función a MessageInterceptor
+type InterceptorFunc struct {
+	name string
+	fn   func(ctx *MessageContext) error
+}
+
+// NewInterceptorFunc crea un interceptor a partir de una función
+func NewInterceptorFunc(name string, fn func(ctx *MessageContext) error) *InterceptorFunc {
+	return &InterceptorFunc{name: name, fn: fn}
+}
+
+func (f *InterceptorFunc) Name() string                        { return f.name }
+func (f *InterceptorFunc) Intercept(ctx *MessageContext) error { return f.fn(ctx) }
+
+// MessagePipeline es la cadena ordenada de interceptores entre readPump y el hub
+type MessagePipeline struct {
+	interceptors []MessageInterceptor
+	mu           sync.RWMutex
+}
+
+// NewMessagePipeline crea una cadena con los interceptores indicados
+func NewMessagePipeline(interceptors ...MessageInterceptor) *MessagePipeline {
+	return &MessagePipeline{interceptors: interceptors}
+}
+
+// Use añade un interceptor al final de la cadena
+func (p *MessagePipeline) Use(interceptor MessageInterceptor) {
+	p.mu.Lock()
+	p.interceptors = append(p.interceptors, interceptor)
+	p.mu.Unlock()
+}
+
+// Names devuelve los nombres de los interceptores en orden
+func (p *MessagePipeline) Names() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	names := make([]string, len(p.interceptors))
+	for i, interceptor := range p.interceptors {
+		names[i] = interceptor.Name()
+	}
+	return names
+}
+
+// Process ejecuta los interceptores en orden y se detiene en el primer error
+func (p *MessagePipeline) Process(ctx *MessageContext) error {
+	p.mu.RLock()
+	interceptors := p.interceptors
+	p.mu.RUnlock()
+
+	for _, interceptor := range interceptors {
+		if err := interceptor.Intercept(ctx); err != nil {
+			if !errors.Is(err, ErrMessageHandled) {
+				ctx.Client.log().Info("interceptor detuvo el mensaje", "interceptor", interceptor.Name(), "messageId", ctx.Message.ID, "reason", err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// NewDefaultPipeline crea la cadena con las reglas que antes estaban en readPump
+func NewDefaultPipeline() *MessagePipeline {
+	return NewMessagePipeline(
+		NewInterceptorFunc("empty", rejectEmptyMessages),
+		NewInterceptorFunc("spam", detectSpam),
+		NewInterceptorFunc("image-validation", validateMessageImage),
+		NewInterceptorFunc("upload-quota", enforceUploadQuota),
+		NewInterceptorFunc("content-filter", filterContent),
+		NewInterceptorFunc("commands", routeBotCommands),
+		NewInterceptorFunc("links", annotateLinks),
+	)
+}
+
+// rejectEmptyMessages descarta mensajes sin texto ni imagen
+func rejectEmptyMessages(ctx *MessageContext) error {
+	if !ctx.Message.HasImage && strings.TrimSpace(ctx.Message.Content) == "" {
+		return ErrMessageDropped
+	}
+	return nil
+}
+
+// validateMessageImage aplica las validaciones de seguridad de imágenes
+func validateMessageImage(ctx *MessageContext) error {
+	if !ctx.Message.HasImage || ctx.Message.Image == nil {
+		return nil
+	}
+
+	if !ctx.Client.isValidImage(ctx.Message.Image) {
+		maxMB := float64(ctx.Client.config().MaxImageSize) / (1024 * 1024)
+		return Reject("INVALID_IMAGE", fmt.Sprintf("Imagen inválida. Solo se permiten imágenes de hasta %gMB.", maxMB))
+	}
+
+	// El tamaño que declara el cliente no es de fiar: se usa el real
+	ctx.Message.Image.Size = imagePayloadSize(ctx.Message.Image)
+	return nil
+}
+
+// enforceUploadQuota contabiliza los bytes subidos en la cuota del usuario
+func enforceUploadQuota(ctx *MessageContext) error {
+	quota := ctx.Client.hub.uploadQuota
+	if quota == nil || !ctx.Message.HasImage || ctx.Message.Image == nil {
+		return nil
+	}
+
+	size := imagePayloadSize(ctx.Message.Image)
+	if !quota.Reserve(ctx.Client.username, ctx.Client.role, size) {
+		ctx.Client.log().Info("cuota de subida excedida", "usedBytes", quota.Usage(ctx.Client.username))
+		return Reject("QUOTA_EXCEEDED", "Has alcanzado tu límite de subida de imágenes. Inténtalo más tarde.")
+	}
+	ctx.quotaBytes = size
+	return nil
+}
+
+// routeBotCommands enruta "/comando args" a los bots que lo atienden
+func routeBotCommands(ctx *MessageContext) error {
+	if ctx.Client.bot != nil || ctx.Message.HasImage {
+		return nil
+	}
+
+	command, args, ok := parseCommand(ctx.Message.Content)
+	if ok && ctx.Client.hub.routeCommand(ctx.Client, command, args) {
+		ctx.Client.log().Debug("comando enrutado a bots", "command", command)
+		return ErrMessageHandled
+	}
+	return nil
+}
+
+// linkPattern detecta URLs http(s) en el texto
+var linkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+
+// annotateLinks anota los enlaces encontrados en el mensaje
+func annotateLinks(ctx *MessageContext) error {
+	if links := linkPattern.FindAllString(ctx.Message.Content, -1); len(links) > 0 {
+		ctx.Annotate("links", links)
+	}
+	return nil
+}
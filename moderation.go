@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// ModerationEvent es una notificación solo para moderadores (y webhooks de moderación)
+type ModerationEvent struct {
+	Type      string    `json:"type"`   // Siempre "moderation"
+	Action    string    `json:"action"` // "filtered", ...
+	Mode      string    `json:"mode,omitempty"`
+	Username  string    `json:"username"`
+	MessageID string    `json:"messageId,omitempty"`
+	Content   string    `json:"content,omitempty"` // Contenido original, antes de enmascarar
+	Rules     []string  `json:"rules,omitempty"`
+	Matches   []string  `json:"matches,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventType implementa Event
+func (e *ModerationEvent) EventType() string { return EventTypeModeration }
+
+// isModerator indica si el cliente recibe notificaciones de moderación
+func (c *Client) isModerator() bool {
+	return c.role == RoleModerator || c.role == RoleAdmin
+}
+
+// notifyModerators envía el evento a los moderadores conectados y a los webhooks
+func (h *Hub) notifyModerators(event *ModerationEvent) {
+	slog.Info("evento de moderación", "action", event.Action, "mode", event.Mode, "user", event.Username, "rules", event.Rules)
+
+	h.emitWebhook(WebhookEventModeration, event)
+
+	wire := newWireEvent(event)
+	h.deliverToModerators(wire)
+	h.publishEvent(BackplaneModeration, "", wire)
+}
+
+// deliverToModerators envía el evento a los moderadores conectados a este nodo
+func (h *Hub) deliverToModerators(event *wireEvent) {
+	h.mu.RLock()
+	var moderators []string
+	for client := range h.clients {
+		if client.isModerator() {
+			moderators = append(moderators, client.username)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, moderator := range moderators {
+		h.sendDirect(moderator, event)
+	}
+}
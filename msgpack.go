@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// MessagePack usa los mismos nombres de campo que el JSON (las etiquetas json de los
+// structs), así que el esquema de /api/protocol vale para las dos codificaciones. Las
+// diferencias: las fechas viajan como timestamp de MessagePack y las imágenes en
+// línea como bytes (bin) en lugar de un data URL en base64.
+
+// marshalMsgpack serializa un valor en MessagePack
+func marshalMsgpack(value interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	enc.UseCompactInts(true)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmarshalMsgpack decodifica un valor en MessagePack
+func unmarshalMsgpack(data []byte, value interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(value)
+}
+
+// msgpackImage es ImageData tal como viaja en MessagePack: data son los bytes de la
+// imagen si va en línea o la ruta /attachments/<hash> si está en el almacén
+type msgpackImage struct {
+	Data interface{} `msgpack:"data"`
+	Name string      `msgpack:"name"`
+	Type string      `msgpack:"type"`
+	Size int64       `msgpack:"size"`
+	Hash string      `msgpack:"hash,omitempty"`
+}
+
+// EncodeMsgpack envía las imágenes en línea como bytes, sin la sobrecarga del base64
+func (img *ImageData) EncodeMsgpack(enc *msgpack.Encoder) error {
+	wire := msgpackImage{Data: img.Data, Name: img.Name, Type: img.Type, Size: img.Size, Hash: img.Hash}
+	if data, err := decodeDataURL(img.Data); err == nil {
+		wire.Data = data
+	}
+	return enc.Encode(&wire)
+}
+
+// DecodeMsgpack acepta la imagen como bytes y la convierte en el data URL con el que
+// trabaja el resto del servidor (validación, almacén de adjuntos, clientes JSON)
+func (img *ImageData) DecodeMsgpack(dec *msgpack.Decoder) error {
+	var wire msgpackImage
+	if err := dec.Decode(&wire); err != nil {
+		return err
+	}
+
+	*img = ImageData{Name: wire.Name, Type: wire.Type, Size: wire.Size, Hash: wire.Hash}
+	switch data := wire.Data.(type) {
+	case []byte:
+		img.Data = "data:" + wire.Type + ";base64," + base64.StdEncoding.EncodeToString(data)
+	case string:
+		img.Data = data
+	case nil:
+	default:
+		return fmt.Errorf("datos de imagen inválidos: %T", data)
+	}
+	return nil
+}
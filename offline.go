@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// queuedMessage es un mensaje guardado para un usuario desconectado
+type queuedMessage struct {
+	msg      *Message
+	queuedAt time.Time
+}
+
+// OfflineQueue guarda las menciones que reciben los usuarios registrados mientras
+// están desconectados, hasta su próxima conexión. Cada usuario tiene un límite de
+// mensajes (al superarlo se descartan los más antiguos) y los mensajes caducan.
+// Solo se usa desde el loop del hub; vive en memoria, así que se pierde al reiniciar.
+type OfflineQueue struct {
+	limit  int
+	ttl    time.Duration
+	queues map[string][]queuedMessage
+	now    func() time.Time
+}
+
+// NewOfflineQueue crea una cola con el límite por usuario y la caducidad indicados
+func NewOfflineQueue(limit int, ttl time.Duration) *OfflineQueue {
+	return &OfflineQueue{
+		limit:  limit,
+		ttl:    ttl,
+		queues: make(map[string][]queuedMessage),
+		now:    time.Now,
+	}
+}
+
+// Push guarda un mensaje para el usuario. Devuelve los mensajes que salieron de las
+// colas por caducados (de cualquier usuario, para que los de quien no vuelve no se
+// acumulen) y los que se descartaron por superar el límite.
+func (q *OfflineQueue) Push(username string, msg *Message) (expired, dropped []*Message) {
+	now := q.now()
+	for name, queue := range q.queues {
+		pruned, old := q.prune(queue, now)
+		expired = append(expired, old...)
+		if len(pruned) == 0 {
+			delete(q.queues, name)
+		} else {
+			q.queues[name] = pruned
+		}
+	}
+
+	queue := append(q.queues[username], queuedMessage{msg: msg, queuedAt: now})
+	if len(queue) > q.limit {
+		dropped = messagesOf(queue[:len(queue)-q.limit])
+		queue = queue[len(queue)-q.limit:]
+	}
+	q.queues[username] = queue
+	return expired, dropped
+}
+
+// Drain devuelve los mensajes vigentes del usuario en orden de llegada y vacía su
+// cola. También devuelve los que habían caducado.
+func (q *OfflineQueue) Drain(username string) (messages, expired []*Message) {
+	queue, expired := q.prune(q.queues[username], q.now())
+	delete(q.queues, username)
+	return messagesOf(queue), expired
+}
+
+// prune separa los mensajes vigentes de los caducados (los más antiguos están al principio)
+func (q *OfflineQueue) prune(queue []queuedMessage, now time.Time) ([]queuedMessage, []*Message) {
+	i := 0
+	for i < len(queue) && now.Sub(queue[i].queuedAt) > q.ttl {
+		i++
+	}
+	return queue[i:], messagesOf(queue[:i])
+}
+
+// messagesOf devuelve los mensajes de una cola
+func messagesOf(queue []queuedMessage) []*Message {
+	messages := make([]*Message, len(queue))
+	for i, queued := range queue {
+		messages[i] = queued.msg
+	}
+	return messages
+}
+
+// isOffline indica si el usuario tiene una cuenta registrada y ahora no está
+// conectado ni a este nodo ni a otro. Los invitados no reciben mensajes pendientes:
+// su nombre lo puede usar cualquiera en la siguiente conexión.
+func (h *Hub) isOffline(username string) bool {
+	if h.auth == nil || !h.auth.accounts.Exists(username) {
+		return false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if status, exists := h.userHistory[username]; exists && (status.Connected || status.Bot) {
+		return false
+	}
+	for _, presence := range h.remoteNodes {
+		for _, user := range presence.users {
+			if user.Username == username {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// queueOffline guarda el mensaje si su destinatario está desconectado. Devuelve
+// false si no se guardó (cola deshabilitada, usuario conectado o sin cuenta). El
+// mensaje en cola conserva una referencia a su adjunto hasta entregarse o caducar.
+func (h *Hub) queueOffline(username string, msg *Message) bool {
+	if h.offline == nil || !h.isOffline(username) {
+		return false
+	}
+
+	h.retainAttachment(msg)
+	expired, dropped := h.offline.Push(username, msg)
+	h.releaseQueued(expired)
+	h.releaseQueued(dropped)
+
+	h.metrics.OfflineMessages.Inc("queued")
+	h.metrics.OfflineMessages.Add("expired", float64(len(expired)))
+	h.metrics.OfflineMessages.Add("dropped", float64(len(dropped)))
+	slog.Debug("mensaje guardado para usuario desconectado", "user", username, "messageId", msg.ID)
+	return true
+}
+
+// queueMentions guarda el mensaje para los usuarios mencionados (@nombre) que
+// están desconectados
+func (h *Hub) queueMentions(msg *Message) {
+	if h.offline == nil || msg.Type != MessageTypeMessage {
+		return
+	}
+
+	mentioned := make(map[string]bool)
+	for _, mention := range mentionPattern.FindAllString(msg.Content, -1) {
+		username := mention[1:]
+		if username == msg.Username || mentioned[username] {
+			continue
+		}
+		mentioned[username] = true
+		h.queueOffline(username, msg)
+	}
+}
+
+// deliverOffline envía al cliente recién conectado lo que recibió mientras estaba
+// desconectado, precedido de un aviso
+func (h *Hub) deliverOffline(client *Client) {
+	if h.offline == nil {
+		return
+	}
+
+	messages, expired := h.offline.Drain(client.username)
+	h.releaseQueued(expired)
+	h.metrics.OfflineMessages.Add("expired", float64(len(expired)))
+	if len(messages) == 0 {
+		return
+	}
+
+	notice := fmt.Sprintf("📬 Tienes %d mensajes de cuando no estabas conectado", len(messages))
+	h.sendToClient(client, newWireEvent(NewSystemMessage(notice)))
+	for _, msg := range messages {
+		h.sendToClient(client, newWireEvent(msg))
+	}
+	h.releaseQueued(messages)
+
+	h.metrics.OfflineMessages.Add("delivered", float64(len(messages)))
+	client.log().Info("mensajes pendientes entregados", "messages", len(messages))
+}
+
+// releaseQueued libera las referencias a adjuntos de los mensajes que salen de la cola
+func (h *Hub) releaseQueued(messages []*Message) {
+	for _, msg := range messages {
+		h.releaseAttachment(msg)
+	}
+}
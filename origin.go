@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPattern es una entrada de la lista de orígenes permitidos
+type originPattern struct {
+	scheme   string // "" = cualquier esquema
+	host     string // Sin el "*." en los comodines
+	port     string // "" = cualquier puerto
+	wildcard bool   // "*.example.com" admite cualquier subdominio
+}
+
+// OriginPolicy decide qué páginas pueden abrir un WebSocket contra el servidor.
+// Sin ella cualquier web podría abrir un socket con la cookie del usuario (CSRF).
+// El mismo origen y las peticiones sin Origin (bots, scripts) se permiten siempre.
+type OriginPolicy struct {
+	patterns []originPattern
+	allowAll bool
+}
+
+// NewOriginPolicy crea la política a partir de entradas como "https://chat.example.com",
+// "chat.example.com", "*.example.com" o "localhost:8080". "*" permite cualquier origen
+// (solo para desarrollo).
+func NewOriginPolicy(entries []string) *OriginPolicy {
+	p := &OriginPolicy{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(strings.ToLower(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			p.allowAll = true
+			continue
+		}
+
+		var pattern originPattern
+		if scheme, rest, ok := strings.Cut(entry, "://"); ok {
+			pattern.scheme, entry = scheme, rest
+		}
+		entry = strings.TrimSuffix(entry, "/")
+
+		if host, port, err := net.SplitHostPort(entry); err == nil {
+			entry, pattern.port = host, port
+		}
+		if strings.HasPrefix(entry, "*.") {
+			pattern.wildcard = true
+			entry = strings.TrimPrefix(entry, "*.")
+		}
+		pattern.host = entry
+		p.patterns = append(p.patterns, pattern)
+	}
+	return p
+}
+
+// AllowAll indica si la política está en modo permisivo de desarrollo
+func (p *OriginPolicy) AllowAll() bool {
+	return p != nil && p.allowAll
+}
+
+// Check aplica la política a una petición de upgrade. Una política nil solo
+// permite el mismo origen.
+func (p *OriginPolicy) Check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(strings.ToLower(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+
+	if u.Host == strings.ToLower(r.Host) || p.AllowAll() {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+
+	host, port := u.Hostname(), u.Port()
+	for _, pattern := range p.patterns {
+		if pattern.matches(u.Scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches compara el origen con la entrada de la lista
+func (o originPattern) matches(scheme, host, port string) bool {
+	if o.scheme != "" && o.scheme != scheme {
+		return false
+	}
+	if o.port != "" && o.port != port {
+		return false
+	}
+	if o.wildcard {
+		return strings.HasSuffix(host, "."+o.host)
+	}
+	return host == o.host
+}
+
+// checkOrigin rechaza y registra los orígenes no permitidos antes de autenticar
+func checkOrigin(hub *Hub, w http.ResponseWriter, r *http.Request) bool {
+	if hub.origins.Check(r) {
+		return true
+	}
+
+	requestLogger(r).Warn("origen rechazado", "origin", r.Header.Get("Origin"), "ip", clientIP(r), "host", r.Host)
+	http.Error(w, "Origen no permitido", http.StatusForbidden)
+	return false
+}
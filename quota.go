@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadRecord registra una subida de un usuario en un instante dado
+type uploadRecord struct {
+	at   time.Time
+	size int64
+}
+
+// UploadQuota limita los bytes que cada usuario puede subir en una ventana deslizante.
+// Los límites se definen por rol; un límite de 0 significa sin límite.
+type UploadQuota struct {
+	window       time.Duration
+	defaultLimit int64
+	roleLimits   map[string]int64
+	usage        map[string][]uploadRecord
+	now          func() time.Time
+	mu           sync.Mutex
+}
+
+// NewUploadQuota crea una cuota con la ventana y el límite por defecto indicados
+func NewUploadQuota(window time.Duration, defaultLimit int64) *UploadQuota {
+	return &UploadQuota{
+		window:       window,
+		defaultLimit: defaultLimit,
+		roleLimits:   make(map[string]int64),
+		usage:        make(map[string][]uploadRecord),
+		now:          time.Now,
+	}
+}
+
+// SetRoleLimit define el límite de bytes para un rol concreto
+func (q *UploadQuota) SetRoleLimit(role string, limit int64) {
+	q.mu.Lock()
+	q.roleLimits[role] = limit
+	q.mu.Unlock()
+}
+
+// Limit devuelve el límite aplicable a un rol
+func (q *UploadQuota) Limit(role string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limitLocked(role)
+}
+
+func (q *UploadQuota) limitLocked(role string) int64 {
+	if limit, exists := q.roleLimits[role]; exists {
+		return limit
+	}
+	return q.defaultLimit
+}
+
+// Reserve comprueba si el usuario puede subir size bytes y, si puede, los contabiliza
+func (q *UploadQuota) Reserve(username, role string, size int64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	limit := q.limitLocked(role)
+	records := q.pruneLocked(username)
+
+	if limit > 0 {
+		var used int64
+		for _, record := range records {
+			used += record.size
+		}
+		if used+size > limit {
+			return false
+		}
+	}
+
+	q.usage[username] = append(records, uploadRecord{at: q.now(), size: size})
+	return true
+}
+
+// Release devuelve a la cuota una subida reservada que finalmente no se publicó
+func (q *UploadQuota) Release(username string, size int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	records := q.pruneLocked(username)
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].size == size {
+			q.usage[username] = append(records[:i], records[i+1:]...)
+			return
+		}
+	}
+}
+
+// Usage devuelve los bytes subidos por el usuario dentro de la ventana actual
+func (q *UploadQuota) Usage(username string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var used int64
+	for _, record := range q.pruneLocked(username) {
+		used += record.size
+	}
+	return used
+}
+
+// pruneLocked descarta registros fuera de la ventana. Requiere q.mu tomado.
+func (q *UploadQuota) pruneLocked(username string) []uploadRecord {
+	records := q.usage[username]
+	cutoff := q.now().Add(-q.window)
+
+	i := 0
+	for i < len(records) && !records[i].at.After(cutoff) {
+		i++
+	}
+	records = records[i:]
+
+	if len(records) == 0 {
+		delete(q.usage, username)
+		return nil
+	}
+	q.usage[username] = records
+	return records
+}
+
+// ParseRoleLimits interpreta una lista "rol=bytes,rol=bytes" (p. ej. "guest=10485760,admin=0")
+func ParseRoleLimits(spec string) (map[string]int64, error) {
+	limits := make(map[string]int64)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		role, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("límite inválido '%s', se esperaba rol=bytes", part)
+		}
+
+		limit, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("límite inválido para el rol '%s': %s", role, value)
+		}
+		limits[strings.TrimSpace(role)] = limit
+	}
+	return limits, nil
+}
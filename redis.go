@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plazo de conexión y de cada comando a Redis
+const redisTimeout = 2 * time.Second
+
+// Eventos pendientes de publicar antes de empezar a descartarlos
+const redisOutboxSize = 1024
+
+var (
+	// errBackplaneBusy indica que la cola de publicación está llena
+	errBackplaneBusy = errors.New("cola de publicación del backplane llena")
+
+	// errBackplaneClosed indica que el backplane ya se cerró
+	errBackplaneClosed = errors.New("backplane cerrado")
+)
+
+// redisError es un error devuelto por el servidor (-ERR ...), no de la conexión
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisConn es una conexión RESP mínima: comandos como arrays de bulk strings
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisOptions son los datos de conexión extraídos de la URL
+type redisOptions struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+}
+
+// parseRedisURL interpreta redis://[usuario:contraseña@]host[:puerto][/db] (rediss:// = TLS)
+func parseRedisURL(rawURL string) (*redisOptions, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("esquema no soportado: %q", u.Scheme)
+	}
+
+	options := &redisOptions{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		options.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		options.username = u.User.Username()
+		options.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if options.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("base de datos inválida: %q", db)
+		}
+	}
+	return options, nil
+}
+
+// dialRedis abre una conexión autenticada y con la base de datos seleccionada
+func dialRedis(options *redisOptions) (*redisConn, error) {
+	dialer := &net.Dialer{Timeout: redisTimeout}
+
+	var conn net.Conn
+	var err error
+	if options.tls {
+		conn, err = tls.DialWithDialer(dialer, "tcp", options.addr, &tls.Config{MinVersion: tls.VersionTLS12})
+	} else {
+		conn, err = dialer.Dial("tcp", options.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if options.password != "" {
+		args := []string{"AUTH", options.password}
+		if options.username != "" {
+			args = []string{"AUTH", options.username, options.password}
+		}
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if options.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(options.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// do envía un comando y lee su respuesta
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	defer rc.conn.SetDeadline(time.Time{})
+
+	if err := rc.write(args...); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+// write envía un comando sin esperar respuesta
+func (rc *redisConn) write(args ...string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(rc.conn, b.String())
+	return err
+}
+
+// read lee una respuesta RESP: string, int64, nil, []interface{} o redisError
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: respuesta vacía")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = rc.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: respuesta desconocida %q", line)
+}
+
+// RedisBackplane comunica los nodos por Redis: los eventos viajan por PUBLISH/SUBSCRIBE
+// y cada nombre de usuario es una clave con caducidad cuyo valor es el nodo que lo usa
+type RedisBackplane struct {
+	options *redisOptions
+	node    string
+	channel string        // Canal de pub/sub
+	prefix  string        // Prefijo de las claves de nombres de usuario
+	ttl     time.Duration // Caducidad de las reservas si el nodo cae
+
+	outbox chan []byte
+	closed chan struct{}
+	once   sync.Once
+
+	// Conexión para comandos (se reabre tras un error de red)
+	conn *redisConn
+	mu   sync.Mutex
+
+	// Conexión de la suscripción (para cerrarla en Close)
+	subConn *redisConn
+	subMu   sync.Mutex
+}
+
+// NewRedisBackplane crea el backplane para el nodo indicado. channel da nombre al
+// canal de pub/sub y al prefijo de las claves, para poder compartir un Redis.
+func NewRedisBackplane(rawURL, node, channel string) (*RedisBackplane, error) {
+	options, err := parseRedisURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &RedisBackplane{
+		options: options,
+		node:    node,
+		channel: channel,
+		prefix:  channel + ":user:",
+		ttl:     3 * presenceInterval,
+		outbox:  make(chan []byte, redisOutboxSize),
+		closed:  make(chan struct{}),
+	}
+	if err := b.Ping(); err != nil {
+		return nil, err
+	}
+
+	go b.publishLoop()
+	return b, nil
+}
+
+// NodeID identifica al nodo
+func (b *RedisBackplane) NodeID() string {
+	return b.node
+}
+
+// command ejecuta un comando por la conexión compartida
+func (b *RedisBackplane) command(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	select {
+	case <-b.closed:
+		return nil, errBackplaneClosed
+	default:
+	}
+
+	if b.conn == nil {
+		conn, err := dialRedis(b.options)
+		if err != nil {
+			return nil, err
+		}
+		b.conn = conn
+	}
+
+	reply, err := b.conn.do(args...)
+	var serverErr redisError
+	if err != nil && !errors.As(err, &serverErr) {
+		// Error de red: la próxima llamada abre otra conexión
+		b.conn.conn.Close()
+		b.conn = nil
+	}
+	return reply, err
+}
+
+// Ping comprueba que Redis responde (/readyz)
+func (b *RedisBackplane) Ping() error {
+	_, err := b.command("PING")
+	return err
+}
+
+// Publish encola el evento; una goroutine lo publica para no bloquear el hub
+func (b *RedisBackplane) Publish(event *BackplaneEvent) error {
+	event.Node = b.node
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case b.outbox <- data:
+		return nil
+	default:
+		return errBackplaneBusy
+	}
+}
+
+// publishLoop envía los eventos encolados hasta que se cierra el backplane
+func (b *RedisBackplane) publishLoop() {
+	for {
+		select {
+		case data := <-b.outbox:
+			if _, err := b.command("PUBLISH", b.channel, string(data)); err != nil {
+				slog.Warn("error publicando en Redis", "error", err)
+			}
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+// Subscribe recibe los eventos de los demás nodos en una goroutine que se
+// reconecta con espera exponencial si se pierde la conexión
+func (b *RedisBackplane) Subscribe(handler func(*BackplaneEvent)) error {
+	conn, err := b.subscribe()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		backoff := time.Second
+		for {
+			err := b.receive(conn, handler)
+			select {
+			case <-b.closed:
+				return
+			default:
+			}
+			slog.Warn("suscripción a Redis perdida, reconectando", "error", err, "retryIn", backoff)
+
+			for {
+				select {
+				case <-b.closed:
+					return
+				case <-time.After(backoff):
+				}
+				if conn, err = b.subscribe(); err == nil {
+					backoff = time.Second
+					break
+				}
+				backoff = min(backoff*2, 30*time.Second)
+			}
+		}
+	}()
+	return nil
+}
+
+// subscribe abre la conexión de la suscripción y se suscribe al canal
+func (b *RedisBackplane) subscribe() (*redisConn, error) {
+	conn, err := dialRedis(b.options)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("SUBSCRIBE", b.channel); err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+
+	b.subMu.Lock()
+	b.subConn = conn
+	b.subMu.Unlock()
+	return conn, nil
+}
+
+// receive entrega los mensajes de la suscripción hasta que falla la conexión
+func (b *RedisBackplane) receive(conn *redisConn, handler func(*BackplaneEvent)) error {
+	defer conn.conn.Close()
+
+	for {
+		reply, err := conn.read()
+		if err != nil {
+			return err
+		}
+
+		// ["message", canal, datos]
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		data, _ := parts[2].(string)
+
+		var event BackplaneEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			slog.Warn("evento de Redis inválido", "error", err)
+			continue
+		}
+		if event.Node == b.node {
+			continue // Redis también entrega lo que publica este nodo
+		}
+		handler(&event)
+	}
+}
+
+// Scripts de Lua para las reservas de nombres: cada operación es un único EVAL,
+// atómico en Redis y con una sola ida y vuelta aunque haya muchos usuarios.
+const (
+	// claimUsernameScript reserva la clave si está libre o renueva la de este nodo.
+	// KEYS[1] = clave, ARGV[1] = nodo, ARGV[2] = caducidad en ms. Devuelve 1 o 0.
+	claimUsernameScript = `local owner = redis.call('GET', KEYS[1])
+if not owner then
+  redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+  return 1
+end
+if owner == ARGV[1] then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+  return 1
+end
+return 0`
+
+	// releaseUsernameScript borra la clave solo si es de este nodo (compare-and-delete).
+	// KEYS[1] = clave, ARGV[1] = nodo.
+	releaseUsernameScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0`
+
+	// refreshUsernamesScript renueva las claves de este nodo y recupera las caducadas.
+	// KEYS = claves, ARGV[1] = nodo, ARGV[2] = caducidad en ms. Devuelve las claves
+	// que tiene otro nodo.
+	refreshUsernamesScript = `local taken = {}
+for _, key in ipairs(KEYS) do
+  local owner = redis.call('GET', key)
+  if not owner then
+    redis.call('SET', key, ARGV[1], 'PX', ARGV[2])
+  elseif owner == ARGV[1] then
+    redis.call('PEXPIRE', key, ARGV[2])
+  else
+    table.insert(taken, key)
+  end
+end
+return taken`
+)
+
+// ClaimUsername reserva el nombre si está libre o ya es de este nodo
+func (b *RedisBackplane) ClaimUsername(username string) (bool, error) {
+	ttl := strconv.FormatInt(b.ttl.Milliseconds(), 10)
+	reply, err := b.command("EVAL", claimUsernameScript, "1", b.prefix+username, b.node, ttl)
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+// ReleaseUsername borra la reserva si es de este nodo
+func (b *RedisBackplane) ReleaseUsername(username string) error {
+	_, err := b.command("EVAL", releaseUsernameScript, "1", b.prefix+username, b.node)
+	return err
+}
+
+// RefreshUsernames renueva la caducidad de las reservas de este nodo y recupera
+// las que hayan caducado (p. ej. tras un corte de red con Redis)
+func (b *RedisBackplane) RefreshUsernames(usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	args := make([]string, 0, len(usernames)+5)
+	args = append(args, "EVAL", refreshUsernamesScript, strconv.Itoa(len(usernames)))
+	for _, username := range usernames {
+		args = append(args, b.prefix+username)
+	}
+	args = append(args, b.node, strconv.FormatInt(b.ttl.Milliseconds(), 10))
+
+	reply, err := b.command(args...)
+	if err != nil {
+		return err
+	}
+	taken, _ := reply.([]interface{})
+	for _, key := range taken {
+		username := strings.TrimPrefix(fmt.Sprint(key), b.prefix)
+		slog.Warn("nombre de usuario reservado por otro nodo", "user", username)
+	}
+	return nil
+}
+
+// Close publica los eventos pendientes (p. ej. el aviso de apagado) y detiene
+// la publicación y la suscripción
+func (b *RedisBackplane) Close() error {
+	b.once.Do(func() {
+		for pending := true; pending; {
+			select {
+			case data := <-b.outbox:
+				if _, err := b.command("PUBLISH", b.channel, string(data)); err != nil {
+					slog.Warn("error publicando en Redis", "error", err)
+				}
+			default:
+				pending = false
+			}
+		}
+		close(b.closed)
+
+		b.subMu.Lock()
+		if b.subConn != nil {
+			b.subConn.conn.Close()
+		}
+		b.subMu.Unlock()
+
+		b.mu.Lock()
+		if b.conn != nil {
+			b.conn.conn.Close()
+			b.conn = nil
+		}
+		b.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// S3Store guarda adjuntos en un bucket compatible con S3 (AWS, MinIO, R2...)
+// usando peticiones path-style firmadas con AWS Signature V4
+type S3Store struct {
+	Endpoint  string // p. ej. https://s3.amazonaws.com o http://localhost:9000
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // prefijo opcional para las claves dentro del bucket
+
+	client *http.Client
+}
+
+// NewS3Store crea un backend S3 con un cliente HTTP con timeout
+func NewS3Store(endpoint, bucket, region, accessKey, secretKey string) *S3Store {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Store{
+		Endpoint:  strings.TrimSuffix(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Shared indica que el bucket lo comparten todas las instancias: los objetos no se
+// borran al liberarse en un nodo, porque otro puede seguir usándolos
+func (s *S3Store) Shared() bool {
+	return true
+}
+
+// Put sube el adjunto al bucket
+func (s *S3Store) Put(key string, data []byte, contentType string) error {
+	resp, err := s.do("PUT", key, data, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return s.errorFromResponse("PUT", key, resp)
+	}
+	return nil
+}
+
+// Get descarga el adjunto del bucket
+func (s *S3Store) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrAttachmentNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.errorFromResponse("GET", key, resp)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Delete elimina el adjunto del bucket
+func (s *S3Store) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s.errorFromResponse("DELETE", key, resp)
+	}
+	return nil
+}
+
+// Ping comprueba que el bucket es accesible con las credenciales configuradas (HEAD bucket)
+func (s *S3Store) Ping() error {
+	req, err := http.NewRequest("HEAD", s.Endpoint+"/"+s.Bucket, nil)
+	if err != nil {
+		return err
+	}
+
+	s.sign(req, nil, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 HEAD %s: estado %d", s.Bucket, resp.StatusCode)
+	}
+	return nil
+}
+
+// do construye, firma y ejecuta una petición sobre el objeto indicado
+func (s *S3Store) do(method, key string, body []byte, contentType string) (*http.Response, error) {
+	objectURL := s.Endpoint + "/" + s.Bucket + "/" + s.Prefix + key
+
+	req, err := http.NewRequest(method, objectURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// errorFromResponse genera un error legible a partir de una respuesta fallida
+func (s *S3Store) errorFromResponse(method, key string, resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("s3 %s %s: estado %d: %s", method, key, resp.StatusCode, strings.TrimSpace(string(msg)))
+}
+
+// sign añade las cabeceras de AWS Signature V4 a la petición
+func (s *S3Store) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	dateStamp := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := dateStamp + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), dateStamp)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, strings.Join(signedHeaders, ";"), signature,
+	))
+}
+
+// sha256Hex devuelve el SHA-256 en hexadecimal
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 calcula un HMAC-SHA256
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
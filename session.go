@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken indica un token mal formado o con firma incorrecta
+	ErrInvalidToken = errors.New("token inválido")
+
+	// ErrExpiredToken indica un token con la fecha de expiración superada
+	ErrExpiredToken = errors.New("token expirado")
+)
+
+// SessionClaims son los datos firmados dentro de un token de sesión (formato JWT HS256)
+type SessionClaims struct {
+	Subject   string `json:"sub"`
+	Role      string `json:"role,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// TokenSigner emite y verifica tokens de sesión firmados con HMAC-SHA256
+type TokenSigner struct {
+	secret []byte
+	ttl    time.Duration
+	now    func() time.Time
+}
+
+// NewTokenSigner crea un firmador con el secreto y la duración de sesión indicados
+func NewTokenSigner(secret []byte, ttl time.Duration) *TokenSigner {
+	return &TokenSigner{secret: secret, ttl: ttl, now: time.Now}
+}
+
+// jwtHeaderHS256 es la cabecera fija de los tokens emitidos por el servidor
+var jwtHeaderHS256 = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Sign emite un token de sesión para el usuario
+func (s *TokenSigner) Sign(username, role string) (string, error) {
+	now := s.now()
+	claims := SessionClaims{
+		Subject:   username,
+		Role:      role,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.ttl).Unix(),
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := jwtHeaderHS256 + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(hmacSHA256(s.secret, signingInput)), nil
+}
+
+// Verify comprueba la firma y la expiración y devuelve los datos del token
+func (s *TokenSigner) Verify(token string) (*SessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	// Solo se aceptan tokens con la cabecera que emite este servidor (evita "alg":"none")
+	if parts[0] != jwtHeaderHS256 {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, hmacSHA256(s.secret, parts[0]+"."+parts[1])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims SessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	if s.now().Unix() >= claims.ExpiresAt {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+// isSessionToken distingue un token de sesión (JWT) de un token de API de bot (hex)
+func isSessionToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Políticas para los clientes que no leen tan rápido como les llegan los mensajes
+const (
+	SlowConsumerDisconnect = "disconnect"  // Se desconecta al cliente (por defecto)
+	SlowConsumerDropOldest = "drop-oldest" // Se descartan sus mensajes más antiguos
+)
+
+// Motivo del cierre 1008 (policy violation) que recibe un cliente lento
+const slowConsumerCloseReason = "cliente lento: buffer de envío lleno"
+
+// Operaciones que el hub encarga a un shard
+const (
+	shardAdd       = iota // Empezar a entregar mensajes al cliente
+	shardRemove           // Dejar de entregarlos y cerrar su canal send
+	shardBroadcast        // Entregar payload a todos los clientes del shard
+	shardDirect           // Entregar payload a un único cliente
+)
+
+// shardOp es una operación sobre los clientes de un shard
+type shardOp struct {
+	kind   int
+	client *Client
+	event  *wireEvent
+
+	// Código y motivo del cierre para shardRemove (0 = cierre sin código)
+	code   int
+	reason string
+}
+
+// hubShard reparte la difusión entre varias goroutines. Cada cliente pertenece a un
+// shard, que es el único que escribe en su canal send y el que lo cierra; así una
+// difusión a miles de clientes no bloquea el loop del hub ni los registros, y send
+// nunca se cierra dos veces ni recibe mensajes después de cerrarse.
+type hubShard struct {
+	hub     *Hub
+	clients map[*Client]struct{}
+	ops     chan *shardOp
+	size    atomic.Int64 // Clientes del shard (para repartir los nuevos)
+}
+
+// newHubShard crea un shard con una cola de operaciones del tamaño indicado
+func newHubShard(hub *Hub, queueSize int) *hubShard {
+	return &hubShard{
+		hub:     hub,
+		clients: make(map[*Client]struct{}),
+		ops:     make(chan *shardOp, queueSize),
+	}
+}
+
+// run procesa las operaciones del shard en orden
+func (s *hubShard) run() {
+	for op := range s.ops {
+		switch op.kind {
+		case shardAdd:
+			s.clients[op.client] = struct{}{}
+
+		case shardRemove:
+			if _, ok := s.clients[op.client]; ok {
+				op.client.closeCode = op.code
+				op.client.closeReason = op.reason
+				s.remove(op.client)
+			}
+
+		case shardBroadcast:
+			for client := range s.clients {
+				payload, err := op.event.encode(client.encoding)
+				if err != nil {
+					continue
+				}
+				s.deliver(client, payload)
+			}
+
+		case shardDirect:
+			if _, ok := s.clients[op.client]; !ok {
+				continue
+			}
+			payload, err := op.event.encode(op.client.encoding)
+			if err != nil {
+				continue
+			}
+			s.deliver(op.client, payload)
+		}
+	}
+}
+
+// deliver encola el payload en el buffer de envío del cliente. Si está lleno aplica
+// la política de clientes lentos.
+func (s *hubShard) deliver(client *Client, payload []byte) {
+	select {
+	case client.send <- payload:
+		return
+	default:
+	}
+
+	metrics := s.hub.metrics
+	if s.hub.config.SlowConsumerPolicy == SlowConsumerDropOldest {
+		// Solo este shard escribe en send: tras sacar uno siempre cabe el nuevo
+		select {
+		case <-client.send:
+			metrics.MessagesDropped.Inc("slow_consumer")
+		default:
+		}
+		select {
+		case client.send <- payload:
+		default:
+			metrics.MessagesDropped.Inc("slow_consumer")
+		}
+		metrics.SlowConsumers.Inc("dropped_oldest")
+		client.log().Debug("buffer de envío lleno, mensaje más antiguo descartado")
+		return
+	}
+
+	s.evict(client)
+}
+
+// remove saca al cliente del shard y cierra su canal; writePump envía el cierre
+func (s *hubShard) remove(client *Client) {
+	delete(s.clients, client)
+	s.size.Add(-1)
+	close(client.send)
+}
+
+// evict desconecta a un cliente cuyo buffer de envío está lleno. Se descarta lo
+// pendiente para que el frame de cierre salga enseguida; al cerrarse la conexión
+// readPump lo da de baja en el hub como a cualquier otro cliente.
+func (s *hubShard) evict(client *Client) {
+	dropped := 1 // El mensaje que no cupo
+	for pending := true; pending; {
+		select {
+		case <-client.send:
+			dropped++
+		default:
+			pending = false
+		}
+	}
+
+	client.closeCode = websocket.ClosePolicyViolation
+	client.closeReason = slowConsumerCloseReason
+	s.remove(client)
+
+	s.hub.metrics.MessagesDropped.Add("slow_consumer", float64(dropped))
+	s.hub.metrics.SlowConsumers.Inc("evicted")
+	client.log().Warn("cliente desconectado por buffer de envío lleno", "dropped", dropped)
+}
+
+// startShards arranca las goroutines de los shards
+func (h *Hub) startShards() {
+	for _, shard := range h.shards {
+		go shard.run()
+	}
+}
+
+// addToShard asigna el cliente al shard con menos clientes
+func (h *Hub) addToShard(client *Client) {
+	shard := h.shards[0]
+	for _, candidate := range h.shards[1:] {
+		if candidate.size.Load() < shard.size.Load() {
+			shard = candidate
+		}
+	}
+
+	client.shard = shard
+	shard.size.Add(1)
+	shard.ops <- &shardOp{kind: shardAdd, client: client}
+}
+
+// removeFromShard pide al shard del cliente que deje de entregarle mensajes y
+// cierre su canal send con el código indicado
+func (h *Hub) removeFromShard(client *Client, code int, reason string) {
+	if client.shard == nil {
+		h.closeClient(client, code, reason)
+		return
+	}
+	client.shard.ops <- &shardOp{kind: shardRemove, client: client, code: code, reason: reason}
+}
+
+// sendToClient encola un evento para un único cliente en su shard. Los clientes
+// sin shard (nunca registrados por Run) reciben el evento directamente.
+func (h *Hub) sendToClient(client *Client, event *wireEvent) {
+	if client.shard == nil {
+		payload, err := event.encode(client.encoding)
+		if err != nil {
+			return
+		}
+		select {
+		case client.send <- payload:
+		default:
+			h.metrics.MessagesDropped.Inc("slow_consumer")
+		}
+		return
+	}
+	client.shard.ops <- &shardOp{kind: shardDirect, client: client, event: event}
+}
+
+// fanOut entrega el evento a todos los clientes: una operación por shard
+func (h *Hub) fanOut(event *wireEvent) {
+	op := &shardOp{kind: shardBroadcast, event: event}
+	for _, shard := range h.shards {
+		shard.ops <- op
+	}
+}
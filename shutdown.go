@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Mensaje de cierre que reciben los clientes cuando el servidor se apaga
+const shutdownCloseReason = "servidor reiniciando"
+
+// shutdownRequest pide al loop del hub que desconecte a todos los clientes
+type shutdownRequest struct {
+	notice string
+	done   chan []*Client
+}
+
+// Shutdown apaga el hub de forma ordenada: deja de aceptar conexiones nuevas,
+// avisa a todos los clientes con un mensaje del sistema y les envía un cierre
+// "going away" (1001). Espera a que se escriban los cierres o a que venza ctx;
+// en ese caso corta las conexiones que queden.
+func (h *Hub) Shutdown(ctx context.Context, notice string) error {
+	h.draining.Store(true)
+
+	done := make(chan []*Client, 1)
+	select {
+	case h.shutdown <- &shutdownRequest{notice: notice, done: done}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	var clients []*Client
+	select {
+	case clients = <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	slog.Info("cerrando conexiones", "clients", len(clients))
+
+	flushed := make(chan struct{})
+	go func() {
+		h.connections.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		for _, client := range clients {
+			if client.conn != nil {
+				client.conn.Close()
+			}
+		}
+		return ctx.Err()
+	}
+}
+
+// Draining indica si el hub está apagándose y ya no acepta conexiones
+func (h *Hub) Draining() bool {
+	return h.draining.Load()
+}
+
+// disconnectAll avisa y desconecta a todos los clientes. Se ejecuta en el loop del hub.
+func (h *Hub) disconnectAll(notice string) []*Client {
+	noticeEvent := newWireEvent(NewSystemMessage(notice))
+
+	h.mu.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for client := range h.clients {
+		clients = append(clients, client)
+		delete(h.clients, client)
+
+		if status, exists := h.userHistory[client.username]; exists {
+			status.Connected = false
+			status.LastSeen = time.Now()
+		}
+	}
+	h.mu.Unlock()
+
+	// El resto del clúster deja de ver a estos usuarios y puede reutilizar sus nombres
+	if h.backplane != nil {
+		for _, client := range clients {
+			h.releaseClaim(client)
+		}
+		h.publish(&BackplaneEvent{Kind: BackplanePresence, Leaving: true})
+	}
+
+	for _, client := range clients {
+		h.sendToClient(client, noticeEvent)
+		h.removeFromShard(client, websocket.CloseGoingAway, shutdownCloseReason)
+	}
+	return clients
+}
+
+// closeClient cierra el canal de envío de un cliente que aún no está en ningún
+// shard, indicando el código de cierre que writePump enviará
+func (h *Hub) closeClient(client *Client, code int, reason string) {
+	client.closeCode = code
+	client.closeReason = reason
+	close(client.send)
+}
+
+// SaveHistory guarda el historial de mensajes en un archivo JSON
+func (h *Hub) SaveHistory(path string) error {
+	h.mu.RLock()
+	data, err := json.MarshalIndent(h.messageHistory, "", "  ")
+	count := len(h.messageHistory)
+	h.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	slog.Info("historial guardado", "path", path, "messages", count)
+	return nil
+}
+
+// LoadHistory restaura el historial guardado por SaveHistory (si existe) y
+// recupera las referencias a los adjuntos de esos mensajes
+func (h *Hub) LoadHistory(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var history []*Message
+	if err := json.Unmarshal(data, &history); err != nil {
+		return err
+	}
+	if len(history) > h.maxHistorySize {
+		history = history[len(history)-h.maxHistorySize:]
+	}
+
+	if h.attachments != nil {
+		for _, msg := range history {
+			if msg.HasImage && msg.Image != nil && msg.Image.Hash != "" {
+				h.attachments.Retain(msg.Image.Hash, msg.Image.Type, msg.Image.Size)
+			}
+		}
+	}
+
+	h.mu.Lock()
+	h.messageHistory = history
+	h.mu.Unlock()
+
+	slog.Info("historial restaurado", "path", path, "messages", len(history))
+	return nil
+}
+
+// gracefulShutdown apaga el servidor en orden dentro del plazo indicado: clientes
+// WebSocket, servidores HTTP (el principal y la redirección a HTTPS), backplane,
+// webhooks pendientes, borrados de adjuntos e historial
+func gracefulShutdown(servers []*http.Server, hub *Hub, historyPath string, timeout time.Duration) {
+	slog.Info("apagando servidor", "timeout", timeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := hub.Shutdown(ctx, "🔄 El servidor se está reiniciando. Vuelve a conectarte en unos segundos."); err != nil {
+		slog.Warn("no todos los clientes se cerraron a tiempo", "error", err)
+	}
+
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("error apagando servidor HTTP", "addr", server.Addr, "error", err)
+		}
+	}
+
+	if hub.backplane != nil {
+		if err := hub.backplane.Close(); err != nil {
+			slog.Warn("error cerrando backplane", "error", err)
+		}
+	}
+
+	if hub.webhooks != nil {
+		if err := hub.webhooks.Flush(ctx); err != nil {
+			slog.Warn("webhooks pendientes sin entregar", "error", err)
+		}
+	}
+
+	if hub.attachments != nil {
+		if err := hub.attachments.Flush(ctx); err != nil {
+			slog.Warn("adjuntos pendientes de borrar", "error", err)
+		}
+	}
+
+	if historyPath != "" {
+		if err := hub.SaveHistory(historyPath); err != nil {
+			slog.Error("error guardando historial", "error", err)
+		}
+	}
+
+	slog.Info("servidor apagado")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Acciones ante spam detectado
+const (
+	SpamActionDrop = "drop" // Descarta el mensaje en silencio
+	SpamActionWarn = "warn" // Rechaza el mensaje avisando al usuario
+	SpamActionMute = "mute" // Rechaza el mensaje y silencia al usuario un tiempo
+)
+
+// SpamConfig define los umbrales del detector de spam
+type SpamConfig struct {
+	Window        time.Duration // Ventana en la que se comparan los mensajes
+	MaxDuplicates int           // Mensajes (casi) idénticos permitidos en la ventana
+	Similarity    float64       // Umbral de similitud (0-1) para considerar dos mensajes casi idénticos
+	MaxLinks      int           // Enlaces permitidos en la ventana
+	MaxMentions   int           // Menciones distintas permitidas en un mensaje
+	Action        string        // SpamActionDrop, SpamActionWarn o SpamActionMute
+	MuteDuration  time.Duration // Duración del silencio automático
+}
+
+// DefaultSpamConfig devuelve una configuración razonable para un chat pequeño
+func DefaultSpamConfig() SpamConfig {
+	return SpamConfig{
+		Window:        30 * time.Second,
+		MaxDuplicates: 2,
+		Similarity:    0.85,
+		MaxLinks:      5,
+		MaxMentions:   5,
+		Action:        SpamActionWarn,
+		MuteDuration:  5 * time.Minute,
+	}
+}
+
+// spamRecord es un mensaje reciente de un usuario o IP
+type spamRecord struct {
+	at       time.Time
+	trigrams map[string]bool
+	links    int
+}
+
+// SpamDetector detecta mensajes repetidos, ráfagas de enlaces y menciones masivas.
+// El estado por usuario vive en UserStatus (hub.userHistory); el estado por IP, aquí.
+type SpamDetector struct {
+	config SpamConfig
+	byIP   map[string][]spamRecord
+	now    func() time.Time
+	mu     sync.Mutex
+
+	// Estado de los remitentes sin conexión (webhooks entrantes), que no están en
+	// userHistory
+	senders map[string]*UserStatus
+}
+
+// NewSpamDetector crea un detector con la configuración indicada
+func NewSpamDetector(config SpamConfig) *SpamDetector {
+	return &SpamDetector{
+		config:  config,
+		byIP:    make(map[string][]spamRecord),
+		now:     time.Now,
+		senders: make(map[string]*UserStatus),
+	}
+}
+
+// senderStatus devuelve el estado anti-spam de un remitente sin conexión. De paso
+// olvida a los remitentes sin mensajes recientes ni silencio pendiente.
+func (d *SpamDetector) senderStatus(username string) *UserStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.now()
+	cutoff := now.Add(-d.config.Window)
+	for name, status := range d.senders {
+		if name != username && now.After(status.mutedUntil) &&
+			len(pruneSpamRecords(status.recentMessages, cutoff)) == 0 {
+			delete(d.senders, name)
+		}
+	}
+
+	status, exists := d.senders[username]
+	if !exists {
+		status = &UserStatus{Username: username}
+		d.senders[username] = status
+	}
+	return status
+}
+
+// IPLimiter limita los intentos por IP dentro de una ventana deslizante, con el mismo
+// registro por IP que el detector de spam. Lo usan el registro y el login para
+// frenar la fuerza bruta de contraseñas.
+type IPLimiter struct {
+	limit  int
+	window time.Duration
+	byIP   map[string][]spamRecord
+	now    func() time.Time
+	mu     sync.Mutex
+}
+
+// NewIPLimiter crea un limitador de limit intentos por IP en cada ventana
+func NewIPLimiter(limit int, window time.Duration) *IPLimiter {
+	return &IPLimiter{
+		limit:  limit,
+		window: window,
+		byIP:   make(map[string][]spamRecord),
+		now:    time.Now,
+	}
+}
+
+// Allow registra un intento de la IP e indica si está dentro del límite. De paso
+// olvida las IPs sin intentos recientes.
+func (l *IPLimiter) Allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	cutoff := now.Add(-l.window)
+	for address, records := range l.byIP {
+		if address != ip && len(pruneSpamRecords(records, cutoff)) == 0 {
+			delete(l.byIP, address)
+		}
+	}
+
+	records := pruneSpamRecords(l.byIP[ip], cutoff)
+	if len(records) >= l.limit {
+		l.byIP[ip] = records
+		return false
+	}
+	l.byIP[ip] = append(records, spamRecord{at: now})
+	return true
+}
+
+// mentionPattern detecta menciones @usuario
+var mentionPattern = regexp.MustCompile(`@[\p{L}\p{N}_-]+`)
+
+// check evalúa el mensaje contra el historial reciente y devuelve el motivo si es spam.
+// Registra el mensaje en el historial del usuario (status) y de su IP.
+func (d *SpamDetector) check(status *UserStatus, ip string, content string) string {
+	now := d.now()
+	cutoff := now.Add(-d.config.Window)
+
+	record := spamRecord{
+		at:       now,
+		trigrams: trigrams(normalizeForSpam(content)),
+		links:    len(linkPattern.FindAllString(content, -1)),
+	}
+
+	// Menciones masivas: se evalúan en el propio mensaje
+	mentions := make(map[string]bool)
+	for _, mention := range mentionPattern.FindAllString(content, -1) {
+		mentions[strings.ToLower(mention)] = true
+	}
+
+	userRecords := pruneSpamRecords(status.recentMessages, cutoff)
+	status.recentMessages = append(userRecords, record)
+
+	d.mu.Lock()
+	ipRecords := pruneSpamRecords(d.byIP[ip], cutoff)
+	if ip != "" {
+		d.byIP[ip] = append(ipRecords, record)
+	}
+	d.mu.Unlock()
+
+	if d.config.MaxMentions > 0 && len(mentions) > d.config.MaxMentions {
+		return fmt.Sprintf("menciones masivas (%d)", len(mentions))
+	}
+
+	if d.config.MaxLinks > 0 {
+		links := record.links
+		for _, previous := range userRecords {
+			links += previous.links
+		}
+		if links > d.config.MaxLinks {
+			return fmt.Sprintf("ráfaga de enlaces (%d en %s)", links, d.config.Window)
+		}
+	}
+
+	if d.config.MaxDuplicates > 0 && len(record.trigrams) > 0 {
+		if similarCount(userRecords, record, d.config.Similarity) >= d.config.MaxDuplicates {
+			return "mensajes repetidos"
+		}
+		if similarCount(ipRecords, record, d.config.Similarity) >= d.config.MaxDuplicates {
+			return "mensajes repetidos desde la misma IP"
+		}
+	}
+	return ""
+}
+
+// pruneSpamRecords descarta registros anteriores al corte
+func pruneSpamRecords(records []spamRecord, cutoff time.Time) []spamRecord {
+	i := 0
+	for i < len(records) && records[i].at.Before(cutoff) {
+		i++
+	}
+	return records[i:]
+}
+
+// similarCount cuenta los registros casi idénticos al mensaje nuevo
+func similarCount(records []spamRecord, record spamRecord, threshold float64) int {
+	count := 0
+	for _, previous := range records {
+		if jaccard(previous.trigrams, record.trigrams) >= threshold {
+			count++
+		}
+	}
+	return count
+}
+
+// normalizeForSpam pasa a minúsculas y elimina signos y espacios repetidos,
+// para que "Hola!!!" y "hola" cuenten como el mismo mensaje
+func normalizeForSpam(content string) string {
+	var b strings.Builder
+	lastSpace := true
+	for _, r := range strings.ToLower(content) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+			lastSpace = false
+		case !lastSpace:
+			b.WriteRune(' ')
+			lastSpace = true
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// trigrams devuelve el conjunto de trigramas de caracteres del texto
+func trigrams(text string) map[string]bool {
+	runes := []rune(text)
+	set := make(map[string]bool)
+	if len(runes) == 0 {
+		return set
+	}
+	if len(runes) < 3 {
+		set[text] = true
+		return set
+	}
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = true
+	}
+	return set
+}
+
+// jaccard calcula la similitud entre dos conjuntos de trigramas
+func jaccard(a, b map[string]bool) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	intersection := 0
+	for gram := range a {
+		if b[gram] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(a)+len(b)-intersection)
+}
+
+// trustedProxies son las redes de los proxies (TRUSTED_PROXIES) cuyo X-Forwarded-For
+// se respeta. Sin proxies de confianza la IP del cliente es siempre RemoteAddr.
+var trustedProxies []*net.IPNet
+
+// ParseTrustedProxies interpreta una lista de redes CIDR o IPs sueltas separadas por comas
+func ParseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("proxy inválido: %q", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("proxy inválido: %q", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy indica si la IP pertenece a alguno de los proxies de confianza
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP obtiene la IP del cliente. X-Forwarded-For solo se respeta si la conexión
+// llega de un proxy de confianza, y entonces se toma el salto más a la derecha que no
+// es un proxy de confianza: los de su izquierda los puede inventar el propio cliente.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(host) {
+		return host
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return host
+}
+
+// detectSpam es el interceptor anti-spam. Los bots y moderadores están exentos.
+func detectSpam(ctx *MessageContext) error {
+	hub := ctx.Client.hub
+	detector := hub.spamDetector
+	if detector == nil || ctx.Client.bot != nil || ctx.Client.isModerator() {
+		return nil
+	}
+
+	now := detector.now()
+
+	hub.mu.Lock()
+	status, exists := hub.userHistory[ctx.Client.username]
+	if !exists {
+		status = detector.senderStatus(ctx.Client.username)
+	}
+
+	if now.Before(status.mutedUntil) {
+		remaining := status.mutedUntil.Sub(now).Round(time.Second)
+		hub.mu.Unlock()
+		return Reject("MUTED", fmt.Sprintf("Estás silenciado por spam. Podrás escribir en %s.", remaining))
+	}
+
+	reason := detector.check(status, ctx.Client.ip, ctx.Message.Content)
+	action := detector.config.Action
+	if reason != "" && action == SpamActionMute {
+		status.mutedUntil = now.Add(detector.config.MuteDuration)
+	}
+	hub.mu.Unlock()
+
+	if reason == "" {
+		return nil
+	}
+
+	ctx.Client.log().Info("spam detectado", "ip", ctx.Client.ip, "reason", reason, "action", action)
+	hub.notifyModerators(&ModerationEvent{
+		Type:      EventTypeModeration,
+		Action:    "spam",
+		Mode:      action,
+		Username:  ctx.Client.username,
+		MessageID: ctx.Message.ID,
+		Content:   ctx.Message.Content,
+		Rules:     []string{reason},
+		Timestamp: now,
+	})
+
+	switch action {
+	case SpamActionDrop:
+		return ErrMessageDropped
+	case SpamActionMute:
+		return Reject("MUTED", fmt.Sprintf("Spam detectado (%s). Estás silenciado durante %s.", reason, detector.config.MuteDuration))
+	default:
+		return Reject("SPAM_DETECTED", fmt.Sprintf("Mensaje rechazado por spam: %s.", reason))
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Algoritmos de firma aceptados para los JWT del SSO
+const (
+	JWTAlgHS256 = "HS256"
+	JWTAlgRS256 = "RS256"
+)
+
+// SSOIdentity es la identidad extraída de un JWT del SSO
+type SSOIdentity struct {
+	Username string
+	Roles    []string // Roles tal como vienen en el token
+	Role     string   // Rol del chat resultante (RoleUser, RoleModerator o RoleAdmin)
+}
+
+// JWTVerifier verifica los JWT que emite el gateway de SSO, firmados con una
+// clave HMAC compartida (HS256) o con la clave pública RSA del emisor (RS256)
+type JWTVerifier struct {
+	alg       string
+	secret    []byte
+	publicKey *rsa.PublicKey
+
+	Issuer         string        // Si no está vacío, "iss" debe coincidir
+	Audience       string        // Si no está vacío, "aud" debe contenerlo
+	UsernameClaims []string      // Claims de las que se toma el nombre, en orden de preferencia
+	RolesClaim     string        // Claim con los roles (lista o cadena separada por espacios)
+	AdminRoles     []string      // Roles del SSO que dan rol de administrador en el chat
+	ModeratorRoles []string      // Roles del SSO que dan rol de moderador en el chat
+	Leeway         time.Duration // Margen para desajustes de reloj en exp/nbf
+
+	now func() time.Time
+}
+
+// NewHMACVerifier crea un verificador de JWT HS256 con el secreto compartido
+func NewHMACVerifier(secret []byte) *JWTVerifier {
+	v := newJWTVerifier(JWTAlgHS256)
+	v.secret = secret
+	return v
+}
+
+// NewRSAVerifier crea un verificador de JWT RS256 a partir de una clave pública
+// PEM (PUBLIC KEY, RSA PUBLIC KEY o un certificado)
+func NewRSAVerifier(pemData []byte) (*JWTVerifier, error) {
+	key, err := parseRSAPublicKey(pemData)
+	if err != nil {
+		return nil, err
+	}
+
+	v := newJWTVerifier(JWTAlgRS256)
+	v.publicKey = key
+	return v, nil
+}
+
+// newJWTVerifier aplica los valores por defecto comunes
+func newJWTVerifier(alg string) *JWTVerifier {
+	return &JWTVerifier{
+		alg:            alg,
+		UsernameClaims: []string{"preferred_username", "sub"},
+		RolesClaim:     "roles",
+		AdminRoles:     []string{RoleAdmin},
+		ModeratorRoles: []string{RoleModerator},
+		Leeway:         30 * time.Second,
+		now:            time.Now,
+	}
+}
+
+// parseRSAPublicKey lee una clave pública RSA en formato PEM
+func parseRSAPublicKey(pemData []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("clave pública PEM no encontrada")
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+		return nil, errors.New("el certificado no contiene una clave RSA")
+
+	default:
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := parsed.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+		return nil, errors.New("la clave pública no es RSA")
+	}
+}
+
+// Verify comprueba firma, emisor, audiencia y vigencia del token y devuelve la identidad.
+// La firma se comprueba antes que nada, así que ErrExpiredToken solo se devuelve
+// para tokens auténticos.
+func (v *JWTVerifier) Verify(token string) (*SSOIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	// Solo se acepta el algoritmo configurado (evita "none" y la confusión HS256/RS256)
+	if err := json.Unmarshal(headerJSON, &header); err != nil || header.Alg != v.alg {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !v.validSignature(parts[0]+"."+parts[1], signature) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims map[string]interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(payload)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if err := v.validateClaims(claims); err != nil {
+		return nil, err
+	}
+
+	identity := &SSOIdentity{Roles: stringList(claims[v.RolesClaim])}
+	for _, name := range v.UsernameClaims {
+		if username, ok := claims[name].(string); ok && username != "" {
+			identity.Username = username
+			break
+		}
+	}
+	if identity.Username == "" {
+		return nil, ErrInvalidToken
+	}
+
+	identity.Role = v.chatRole(identity.Roles)
+	return identity, nil
+}
+
+// validSignature comprueba la firma con la clave configurada
+func (v *JWTVerifier) validSignature(signingInput string, signature []byte) bool {
+	switch v.alg {
+	case JWTAlgHS256:
+		return hmac.Equal(signature, hmacSHA256(v.secret, signingInput))
+	case JWTAlgRS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		return rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature) == nil
+	}
+	return false
+}
+
+// validateClaims comprueba exp, nbf, iss y aud
+func (v *JWTVerifier) validateClaims(claims map[string]interface{}) error {
+	now := v.now()
+
+	exp, ok := numericClaim(claims["exp"])
+	if !ok {
+		return ErrInvalidToken
+	}
+	if now.After(time.Unix(exp, 0).Add(v.Leeway)) {
+		return ErrExpiredToken
+	}
+
+	if nbf, ok := numericClaim(claims["nbf"]); ok && now.Add(v.Leeway).Before(time.Unix(nbf, 0)) {
+		return fmt.Errorf("%w: todavía no es válido", ErrInvalidToken)
+	}
+
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return fmt.Errorf("%w: emisor no reconocido", ErrInvalidToken)
+	}
+
+	if v.Audience != "" && !containsString(stringList(claims["aud"]), v.Audience) {
+		return fmt.Errorf("%w: audiencia incorrecta", ErrInvalidToken)
+	}
+	return nil
+}
+
+// chatRole traduce los roles del SSO al rol más alto del chat
+func (v *JWTVerifier) chatRole(roles []string) string {
+	for _, role := range roles {
+		if containsString(v.AdminRoles, role) {
+			return RoleAdmin
+		}
+	}
+	for _, role := range roles {
+		if containsString(v.ModeratorRoles, role) {
+			return RoleModerator
+		}
+	}
+	return RoleUser
+}
+
+// numericClaim lee una fecha numérica (segundos Unix) de las claims
+func numericClaim(value interface{}) (int64, bool) {
+	number, ok := value.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	if seconds, err := number.Int64(); err == nil {
+		return seconds, true
+	}
+	seconds, err := number.Float64()
+	return int64(seconds), err == nil
+}
+
+// stringList acepta una lista JSON de cadenas o una cadena separada por espacios/comas
+func stringList(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return strings.FieldsFunc(v, func(r rune) bool { return r == ' ' || r == ',' })
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// containsString indica si la lista contiene el valor
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
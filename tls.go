@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader sirve el certificado TLS desde disco y lo recarga cuando cambian
+// los archivos (p. ej. al renovarlo certbot), sin reiniciar el servidor
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	mu      sync.RWMutex
+}
+
+// NewCertReloader carga el certificado y la clave indicados
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload vuelve a leer el certificado si alguno de los archivos cambió.
+// Si el par nuevo es inválido se conserva el anterior.
+func (c *CertReloader) Reload() (bool, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.RLock()
+	unchanged := c.cert != nil && certInfo.ModTime().Equal(c.certMod) && keyInfo.ModTime().Equal(c.keyMod)
+	c.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, fmt.Errorf("certificado TLS inválido: %w", err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	c.mu.Unlock()
+
+	slog.Info("certificado TLS cargado", "path", c.certFile)
+	return true, nil
+}
+
+// Watch comprueba periódicamente si los archivos cambiaron
+func (c *CertReloader) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if _, err := c.Reload(); err != nil {
+			slog.Error("error recargando certificado TLS", "error", err)
+		}
+	}
+}
+
+// GetCertificate entrega el certificado vigente en cada handshake
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// newTLSConfig devuelve una configuración TLS con valores seguros por defecto:
+// TLS 1.2 como mínimo y solo suites con intercambio de claves efímero y AEAD
+func newTLSConfig(certs *CertReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		GetCertificate:   certs.GetCertificate,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// httpsRedirectHandler redirige cualquier petición HTTP a la misma URL en HTTPS.
+// httpsPort es el puerto del listener TLS ("" o "443" para omitirlo en la URL).
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+
+		target := "https://" + host + r.URL.RequestURI()
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Eventos que se pueden enviar a los webhooks salientes
+const (
+	WebhookEventMessage    = "message"
+	WebhookEventJoin       = "join"
+	WebhookEventLeave      = "leave"
+	WebhookEventModeration = "moderation"
+)
+
+// validWebhookEvents contiene los eventos a los que se puede suscribir un webhook
+var validWebhookEvents = map[string]bool{
+	WebhookEventMessage:    true,
+	WebhookEventJoin:       true,
+	WebhookEventLeave:      true,
+	WebhookEventModeration: true,
+}
+
+const (
+	// Número de goroutines que entregan webhooks en paralelo
+	webhookWorkers = 4
+
+	// Tamaño de la cola de entregas pendientes
+	webhookQueueSize = 1000
+
+	// Intentos máximos antes de mandar una entrega al dead-letter log
+	webhookMaxAttempts = 5
+
+	// Espera antes del primer reintento; se duplica en cada intento
+	webhookBaseBackoff = time.Second
+
+	// Tiempo máximo para cada POST
+	webhookTimeout = 10 * time.Second
+
+	// Entradas del dead-letter log que se conservan en memoria
+	webhookDeadLetterMemory = 100
+)
+
+// Webhook representa un endpoint externo suscrito a eventos del chat
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	Events    []string  `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// subscribed indica si el webhook está suscrito al evento
+func (wh *Webhook) subscribed(event string) bool {
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload es el cuerpo JSON que recibe cada endpoint
+type WebhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookDelivery es un intento de entrega pendiente
+type webhookDelivery struct {
+	webhook  *Webhook
+	payload  WebhookPayload
+	body     []byte
+	attempts int
+}
+
+// DeadLetter registra una entrega que no se pudo completar
+type DeadLetter struct {
+	WebhookID string          `json:"webhookId"`
+	URL       string          `json:"url"`
+	Event     string          `json:"event"`
+	Attempts  int             `json:"attempts"`
+	Error     string          `json:"error"`
+	FailedAt  time.Time       `json:"failedAt"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// WebhookDispatcher entrega eventos de forma asíncrona, con reintentos y backoff,
+// para que un endpoint lento nunca bloquee Hub.Run
+type WebhookDispatcher struct {
+	webhooks map[string]*Webhook
+	queue    chan *webhookDelivery
+	client   *http.Client
+
+	// Archivo donde se persisten los webhooks registrados ("" = solo memoria)
+	storePath string
+
+	// Archivo JSON Lines con las entregas fallidas ("" = solo memoria)
+	deadLetterPath string
+	deadLetters    []DeadLetter
+
+	// Entregas aún no completadas ni descartadas (incluye reintentos programados)
+	pending atomic.Int64
+
+	backoff time.Duration
+	mu      sync.RWMutex
+}
+
+// NewWebhookDispatcher crea un dispatcher y carga los webhooks persistidos
+func NewWebhookDispatcher(storePath, deadLetterPath string) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		webhooks:       make(map[string]*Webhook),
+		queue:          make(chan *webhookDelivery, webhookQueueSize),
+		client:         &http.Client{Timeout: webhookTimeout},
+		storePath:      storePath,
+		deadLetterPath: deadLetterPath,
+		backoff:        webhookBaseBackoff,
+	}
+
+	if err := d.load(); err != nil {
+		slog.Error("error cargando webhooks", "path", storePath, "error", err)
+	}
+
+	if deadLetterPath != "" {
+		if err := os.MkdirAll(filepath.Dir(deadLetterPath), 0o755); err != nil {
+			slog.Error("error creando directorio del dead-letter log", "error", err)
+		}
+	}
+	return d
+}
+
+// Run inicia los workers de entrega
+func (d *WebhookDispatcher) Run() {
+	var wg sync.WaitGroup
+	for i := 0; i < webhookWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for delivery := range d.queue {
+				d.deliver(delivery)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Register da de alta un webhook; genera un secreto si no se proporciona
+func (d *WebhookDispatcher) Register(rawURL, secret string, events []string) (*Webhook, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.New("la URL del webhook debe ser http(s) absoluta")
+	}
+
+	if len(events) == 0 {
+		return nil, errors.New("se debe indicar al menos un evento")
+	}
+	for _, event := range events {
+		if !validWebhookEvents[event] {
+			return nil, fmt.Errorf("evento desconocido: %s", event)
+		}
+	}
+
+	if secret == "" {
+		secret = randomHex(32)
+	}
+
+	webhook := &Webhook{
+		ID:        randomHex(8),
+		URL:       rawURL,
+		Secret:    secret,
+		Events:    events,
+		CreatedAt: time.Now(),
+	}
+
+	d.mu.Lock()
+	d.webhooks[webhook.ID] = webhook
+	err = d.saveLocked()
+	d.mu.Unlock()
+
+	if err != nil {
+		slog.Error("error persistiendo webhooks", "error", err)
+	}
+
+	slog.Info("webhook registrado", "webhook", webhook.ID, "url", webhook.URL, "events", webhook.Events)
+	return webhook, nil
+}
+
+// Remove elimina un webhook por su ID
+func (d *WebhookDispatcher) Remove(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, exists := d.webhooks[id]; !exists {
+		return false
+	}
+	delete(d.webhooks, id)
+
+	if err := d.saveLocked(); err != nil {
+		slog.Error("error persistiendo webhooks", "error", err)
+	}
+	slog.Info("webhook eliminado", "webhook", id)
+	return true
+}
+
+// List devuelve los webhooks registrados sin sus secretos
+func (d *WebhookDispatcher) List() []Webhook {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	list := make([]Webhook, 0, len(d.webhooks))
+	for _, webhook := range d.webhooks {
+		webhookCopy := *webhook
+		webhookCopy.Secret = ""
+		list = append(list, webhookCopy)
+	}
+	return list
+}
+
+// DeadLetters devuelve las últimas entregas fallidas
+func (d *WebhookDispatcher) DeadLetters() []DeadLetter {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	letters := make([]DeadLetter, len(d.deadLetters))
+	copy(letters, d.deadLetters)
+	return letters
+}
+
+// Dispatch encola el evento para todos los webhooks suscritos. Nunca bloquea.
+func (d *WebhookDispatcher) Dispatch(event string, data interface{}) {
+	d.mu.RLock()
+	targets := make([]*Webhook, 0, len(d.webhooks))
+	for _, webhook := range d.webhooks {
+		if webhook.subscribed(event) {
+			targets = append(targets, webhook)
+		}
+	}
+	d.mu.RUnlock()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	payload := WebhookPayload{
+		ID:        randomHex(8),
+		Event:     event,
+		Timestamp: time.Now(),
+		Data:      data,
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("error serializando evento de webhook", "event", event, "error", err)
+		return
+	}
+
+	for _, webhook := range targets {
+		d.pending.Add(1)
+		d.enqueue(&webhookDelivery{webhook: webhook, payload: payload, body: body})
+	}
+}
+
+// Flush espera a que se completen las entregas pendientes (o a que venza ctx)
+func (d *WebhookDispatcher) Flush(ctx context.Context) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for d.pending.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d entregas pendientes: %w", d.pending.Load(), ctx.Err())
+		}
+	}
+	return nil
+}
+
+// enqueue añade una entrega a la cola o la manda al dead-letter log si está llena
+func (d *WebhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		d.deadLetter(delivery, errors.New("cola de webhooks llena"))
+	}
+}
+
+// deliver hace un intento de entrega y programa el reintento si falla
+func (d *WebhookDispatcher) deliver(delivery *webhookDelivery) {
+	delivery.attempts++
+
+	err := d.post(delivery)
+	if err == nil {
+		d.pending.Add(-1)
+		return
+	}
+
+	if delivery.attempts >= webhookMaxAttempts {
+		d.deadLetter(delivery, err)
+		return
+	}
+
+	wait := d.backoff << (delivery.attempts - 1)
+	slog.Warn("entrega de webhook fallida, se reintentará", "webhook", delivery.webhook.ID,
+		"attempt", delivery.attempts, "maxAttempts", webhookMaxAttempts, "retryIn", wait, "error", err)
+
+	// El reintento se programa fuera del worker para no ocuparlo durante la espera
+	time.AfterFunc(wait, func() { d.enqueue(delivery) })
+}
+
+// post envía el POST firmado al endpoint
+func (d *WebhookDispatcher) post(delivery *webhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.webhook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "realtime-chat-webhooks/1.0")
+	req.Header.Set("X-Chat-Event", delivery.payload.Event)
+	req.Header.Set("X-Chat-Delivery", delivery.payload.ID)
+	req.Header.Set("X-Chat-Signature", "sha256="+SignWebhookBody(delivery.webhook.Secret, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("estado HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// deadLetter registra una entrega definitivamente fallida
+func (d *WebhookDispatcher) deadLetter(delivery *webhookDelivery, cause error) {
+	d.pending.Add(-1)
+
+	letter := DeadLetter{
+		WebhookID: delivery.webhook.ID,
+		URL:       delivery.webhook.URL,
+		Event:     delivery.payload.Event,
+		Attempts:  delivery.attempts,
+		Error:     cause.Error(),
+		FailedAt:  time.Now(),
+		Payload:   delivery.body,
+	}
+
+	slog.Error("entrega de webhook descartada", "webhook", letter.WebhookID,
+		"delivery", delivery.payload.ID, "attempts", letter.Attempts, "error", cause)
+
+	d.mu.Lock()
+	d.deadLetters = append(d.deadLetters, letter)
+	if len(d.deadLetters) > webhookDeadLetterMemory {
+		d.deadLetters = d.deadLetters[1:]
+	}
+	d.mu.Unlock()
+
+	if d.deadLetterPath == "" {
+		return
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		return
+	}
+
+	f, err := os.OpenFile(d.deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		slog.Error("error abriendo dead-letter log", "error", err)
+		return
+	}
+	defer f.Close()
+	f.Write(append(line, '\n'))
+}
+
+// load lee los webhooks persistidos
+func (d *WebhookDispatcher) load() error {
+	if d.storePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(d.storePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var webhooks []*Webhook
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		d.webhooks[webhook.ID] = webhook
+	}
+	slog.Info("webhooks cargados", "count", len(webhooks))
+	return nil
+}
+
+// saveLocked persiste los webhooks. Requiere d.mu tomado.
+func (d *WebhookDispatcher) saveLocked() error {
+	if d.storePath == "" {
+		return nil
+	}
+
+	webhooks := make([]*Webhook, 0, len(d.webhooks))
+	for _, webhook := range d.webhooks {
+		webhooks = append(webhooks, webhook)
+	}
+
+	data, err := json.MarshalIndent(webhooks, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(d.storePath), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(d.storePath, data, 0o600)
+}
+
+// SignWebhookBody calcula la firma HMAC-SHA256 (hex) del cuerpo con el secreto del webhook
+func SignWebhookBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveWebhooksAdmin gestiona los webhooks: GET lista, POST registra, DELETE ?id= elimina
+func serveWebhooksAdmin(dispatcher *WebhookDispatcher, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"webhooks":    dispatcher.List(),
+			"deadLetters": dispatcher.DeadLetters(),
+		})
+
+	case "POST":
+		var req struct {
+			URL    string   `json:"url"`
+			Secret string   `json:"secret"`
+			Events []string `json:"events"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, 64*1024)).Decode(&req); err != nil {
+			http.Error(w, "JSON inválido", http.StatusBadRequest)
+			return
+		}
+
+		webhook, err := dispatcher.Register(req.URL, req.Secret, req.Events)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// El secreto solo se devuelve en la creación
+		writeJSON(w, http.StatusCreated, webhook)
+
+	case "DELETE":
+		if !dispatcher.Remove(r.URL.Query().Get("id")) {
+			http.Error(w, "Webhook no encontrado", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Método no permitido", http.StatusMethodNotAllowed)
+	}
+}
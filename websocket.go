@@ -1,9 +1,11 @@
 package main
 
 import (
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 	"unicode"
 
 	"github.com/gorilla/websocket"
@@ -13,9 +15,8 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	// ⭐ RAILWAY: Permitir conexiones desde cualquier origen
+	// El origen ya se comprobó en serveWS con hub.origins (antes de autenticar)
 	CheckOrigin: func(r *http.Request) bool {
-		// En Railway necesitamos permitir conexiones cross-origin
 		return true
 	},
 }
@@ -37,47 +38,229 @@ func validateUsername(username string) bool {
 	return true
 }
 
+// tokenCookieName es la cookie de la que se lee el token si no viene en cabecera (TOKEN_COOKIE)
+var tokenCookieName = "chat_token"
+
+// bearerSubprotocol es el subprotocolo con el que el navegador envía el token:
+// new WebSocket(url, ["bearer", token]). El servidor responde eligiendo "bearer".
+const bearerSubprotocol = "bearer"
+
+// tokenFromRequest extrae el token de sesión, de SSO o de bot. Solo se acepta en
+// Sec-WebSocket-Protocol o en la cookie: en la URL acabaría en logs y en el historial.
+// Devuelve también el subprotocolo que hay que confirmar en el Upgrade.
+func tokenFromRequest(r *http.Request) (string, string) {
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == bearerSubprotocol && i+1 < len(protocols) {
+			return protocols[i+1], bearerSubprotocol
+		}
+	}
+
+	if cookie, err := r.Cookie(tokenCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, ""
+	}
+	return "", ""
+}
+
+// encodingFromRequest devuelve la codificación que el cliente pide como subprotocolo
+// (p. ej. new WebSocket(url, ["msgpack"])). Se ignora el token que sigue a "bearer".
+func encodingFromRequest(r *http.Request) (Encoding, bool) {
+	protocols := websocket.Subprotocols(r)
+	for i := 0; i < len(protocols); i++ {
+		if protocols[i] == bearerSubprotocol {
+			i++
+			continue
+		}
+		if encoding, ok := encodingByName(protocols[i]); ok {
+			return encoding, true
+		}
+	}
+	return EncodingJSON, false
+}
+
+// identityFromToken resuelve nombre y rol a partir de un JWT: primero como token
+// del SSO y, si no lo es, como token de sesión de una cuenta registrada
+func identityFromToken(hub *Hub, token string) (string, string, error) {
+	if hub.sso != nil {
+		identity, err := hub.sso.Verify(token)
+		if err == nil {
+			if !validateUsername(identity.Username) {
+				return "", "", fmt.Errorf("%w: nombre de usuario no permitido '%s'", ErrInvalidToken, identity.Username)
+			}
+			return identity.Username, identity.Role, nil
+		}
+
+		// Un token del SSO auténtico pero caducado no debe probarse como sesión
+		if hub.auth == nil || errors.Is(err, ErrExpiredToken) {
+			return "", "", err
+		}
+	}
+
+	if hub.auth == nil {
+		return "", "", errors.New("las cuentas no están habilitadas")
+	}
+	return hub.auth.ResolveIdentity("", token)
+}
+
 // serveWS maneja las solicitudes WebSocket del cliente
 func serveWS(hub *Hub, w http.ResponseWriter, r *http.Request) {
+	// Durante el apagado no se aceptan conexiones nuevas
+	if hub.Draining() {
+		w.Header().Set("Retry-After", "5")
+		hub.metrics.HandshakeFailures.Inc("draining")
+		http.Error(w, "El servidor se está reiniciando", http.StatusServiceUnavailable)
+		return
+	}
+
+	// ⭐ SEGURIDAD: solo las páginas permitidas pueden abrir un socket
+	if !checkOrigin(hub, w, r) {
+		hub.metrics.HandshakeFailures.Inc("origin")
+		return
+	}
+
 	// Obtener nombre de usuario de los parámetros de consulta
 	username := strings.TrimSpace(r.URL.Query().Get("username"))
+	role := RoleUser
 
-	log.Printf("🔌 Intento de conexión WebSocket desde %s con username: '%s'", r.RemoteAddr, username)
+	token, subprotocol := tokenFromRequest(r)
 
-	// Validar nombre de usuario
-	if username == "" {
-		log.Printf("❌ Nombre de usuario vacío desde %s", r.RemoteAddr)
-		http.Error(w, "Nombre de usuario requerido", http.StatusBadRequest)
-		return
+	logger := requestLogger(r).With("ip", clientIP(r))
+	logger.Debug("intento de conexión WebSocket", "requestedUsername", username)
+
+	// Validar nombre de usuario elegido por el cliente (con token el nombre viene del token)
+	if token == "" {
+		if username == "" {
+			logger.Info("conexión rechazada: nombre de usuario vacío")
+			hub.metrics.HandshakeFailures.Inc("username_missing")
+			http.Error(w, "Nombre de usuario requerido", http.StatusBadRequest)
+			return
+		}
+
+		if !validateUsername(username) {
+			logger.Info("conexión rechazada: nombre de usuario inválido", "requestedUsername", username)
+			hub.metrics.HandshakeFailures.Inc("username_invalid")
+			http.Error(w, "Nombre de usuario inválido", http.StatusBadRequest)
+			return
+		}
 	}
 
-	if !validateUsername(username) {
-		log.Printf("❌ Nombre de usuario inválido: '%s' desde %s", username, r.RemoteAddr)
-		http.Error(w, "Nombre de usuario inválido", http.StatusBadRequest)
-		return
+	// ⭐ BOTS: se autentican con su token de API y usan el nombre de su cuenta
+	var bot *Bot
+	if token != "" && !isSessionToken(token) {
+		var ok bool
+		if hub.bots != nil {
+			bot, ok = hub.bots.Authenticate(token)
+		}
+		if !ok {
+			logger.Warn("conexión rechazada: token de bot inválido")
+			hub.metrics.HandshakeFailures.Inc("bot_token")
+			http.Error(w, "Token de bot inválido", http.StatusUnauthorized)
+			return
+		}
+		username = bot.Name
+		role = RoleBot
+	} else if token != "" {
+		// ⭐ SSO / CUENTAS: el nombre y el rol vienen del token firmado
+		resolved, resolvedRole, err := identityFromToken(hub, token)
+		if err != nil {
+			logger.Warn("conexión rechazada: token inválido", "error", err)
+			hub.metrics.HandshakeFailures.Inc("token")
+			http.Error(w, "Token inválido", http.StatusUnauthorized)
+			return
+		}
+		username, role = resolved, resolvedRole
+	} else if hub.auth != nil {
+		// ⭐ CUENTAS: los nombres registrados requieren token de sesión; el resto entra como invitado
+		resolved, resolvedRole, err := hub.auth.ResolveIdentity(username, "")
+		if err != nil {
+			logger.Info("conexión rechazada: autenticación", "requestedUsername", username, "error", err)
+			hub.metrics.HandshakeFailures.Inc("auth")
+			http.Error(w, "Autenticación requerida", http.StatusUnauthorized)
+			return
+		}
+		username, role = resolved, resolvedRole
 	}
 
-	// Actualizar la conexión HTTP a WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
+	// Confirmar el subprotocolo de la codificación pedida o, si no pidió ninguna,
+	// "bearer" si el token llegó por Sec-WebSocket-Protocol
+	encoding, negotiated := encodingFromRequest(r)
+	if negotiated {
+		subprotocol = encoding.String()
+	}
+	var responseHeader http.Header
+	if subprotocol != "" {
+		responseHeader = http.Header{"Sec-Websocket-Protocol": {subprotocol}}
+	}
+
+	// Actualizar la conexión HTTP a WebSocket. La compresión depende de la
+	// configuración del hub, así que se usa una copia del upgrader.
+	upgrader := upgrader
+	upgrader.EnableCompression = hub.config.CompressionLevel > 0
+	counter := &countingResponseWriter{ResponseWriter: w}
+	conn, err := upgrader.Upgrade(counter, r, responseHeader)
 	if err != nil {
-		log.Printf("❌ Error actualizando conexión a WebSocket: %v", err)
+		logger.Warn("error actualizando conexión a WebSocket", "error", err)
+		hub.metrics.HandshakeFailures.Inc("upgrade")
 		return
 	}
 
+	compress := upgrader.EnableCompression && offersCompression(r)
+	if compress {
+		if err := conn.SetCompressionLevel(hub.config.CompressionLevel); err != nil {
+			logger.Warn("nivel de compresión inválido", "level", hub.config.CompressionLevel, "error", err)
+		}
+	}
+
 	// Crear cliente
 	client := &Client{
 		hub:      hub,
 		conn:     conn,
-		send:     make(chan []byte, 256),
+		send:     make(chan []byte, hub.config.ClientSendBuffer),
 		username: username,
+		role:     role,
+		bot:      bot,
+		ip:       clientIP(r),
+		encoding: encoding,
+		compress: compress,
+		wire:     counter.conn,
+		logger:   logger.With("user", username, "role", role, "encoding", encoding.String(), "compression", compress),
+	}
+
+	// ⭐ CONFIRMACIONES: solo las identidades autenticadas conservan sus clientMsgId
+	// entre conexiones; un invitado posterior con el mismo nombre no los hereda
+	client.persistentAcks = token != "" && role != RoleGuest
+	client.ackSession = hub.clientMsgIDs.NewSession(username, client.persistentAcks)
+
+	// ⭐ CLÚSTER: el nombre se reserva aquí y no en el loop del hub, que no debe
+	// esperar a Redis. Si otro nodo lo usa, el hub rechaza al cliente al registrarlo.
+	if hub.backplane != nil {
+		client.claimed = hub.claimUsername(username)
+		client.nameTaken = !client.claimed
+	}
+
+	// La conexión se cuenta antes de registrarla: el apagado espera a que writePump
+	// envíe el cierre y no debe poder terminar entre el registro y su arranque
+	hub.connections.Add(1)
+	if hub.Draining() {
+		hub.connections.Done()
+		hub.releaseClaim(client)
+		hub.metrics.HandshakeFailures.Inc("draining")
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, shutdownCloseReason),
+			time.Now().Add(hub.config.WriteWait))
+		conn.Close()
+		return
 	}
 
 	// Registrar cliente en el hub (el hub manejará duplicados)
 	client.hub.register <- client
 
 	// Iniciar las goroutines
-	go client.writePump()
+	go func() {
+		defer hub.connections.Done()
+		client.writePump()
+	}()
 	go client.readPump()
 
-	log.Printf("✅ Cliente '%s' procesado desde %s", username, r.RemoteAddr)
+	client.log().Debug("conexión WebSocket establecida")
 }